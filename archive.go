@@ -0,0 +1,413 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// An archive is a tar.gz holding pastes/<id>.json for every paste,
+// diffs/<id>.json for every diff and finally manifest.json. One file per
+// item lets the archive be written as the store is scanned, without
+// buffering, and read back with nothing but tar and jq.
+
+// archiveVersion is written to the manifest and checked on import
+const archiveVersion = 1
+
+// archivePaste is a paste as stored in an archive
+type archivePaste struct {
+	ID               string            `json:"id"`
+	ExpiresAt        int64             `json:"expiresAt,omitempty"`
+	BurnAfterReading bool              `json:"burnAfterReading,omitempty"`
+	Burned           bool              `json:"burned,omitempty"`
+	OwnerTokenHash   string            `json:"ownerTokenHash,omitempty"`
+	PasswordHash     string            `json:"passwordHash,omitempty"`
+	Kind             string            `json:"kind,omitempty"`
+	Revisions        []archiveRevision `json:"revisions"`
+}
+
+// archiveRevision is one revision of an archived paste, oldest first
+type archiveRevision struct {
+	Revision  int    `json:"revision"`
+	CreatedAt string `json:"createdAt"`
+	Language  string `json:"language"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+}
+
+// archiveDiff is a diff as stored in an archive
+type archiveDiff struct {
+	ID             string `json:"id"`
+	CreatedAt      string `json:"createdAt"`
+	OldText        string `json:"oldText"`
+	NewText        string `json:"newText"`
+	ExpiresAt      int64  `json:"expiresAt,omitempty"`
+	OwnerTokenHash string `json:"ownerTokenHash,omitempty"`
+	PasswordHash   string `json:"passwordHash,omitempty"`
+}
+
+// archiveManifest closes an archive, so a truncated one can be told apart
+// from a complete one
+type archiveManifest struct {
+	Version    int    `json:"version"`
+	ExportedAt string `json:"exportedAt"`
+	Pastes     int    `json:"pastes"`
+	Revisions  int    `json:"revisions"`
+	Diffs      int    `json:"diffs"`
+}
+
+func newArchivePaste(revisions []*Paste) archivePaste {
+	current := revisions[len(revisions)-1]
+	p := archivePaste{
+		ID:               current.PK,
+		ExpiresAt:        current.ExpiresAt,
+		BurnAfterReading: current.BurnAfterReading,
+		Burned:           current.Burned,
+		OwnerTokenHash:   current.OwnerTokenHash,
+		PasswordHash:     current.PasswordHash,
+		Kind:             current.Kind,
+	}
+	for _, rev := range revisions {
+		p.Revisions = append(p.Revisions, archiveRevision{
+			Revision:  rev.Revision,
+			CreatedAt: rev.SK,
+			Language:  rev.Language,
+			Title:     rev.Title,
+			Text:      rev.Text,
+		})
+	}
+	return p
+}
+
+// pastes is the reverse of newArchivePaste
+func (p archivePaste) pastes() []*Paste {
+	revisions := make([]*Paste, 0, len(p.Revisions))
+	for _, rev := range p.Revisions {
+		revisions = append(revisions, &Paste{
+			PK:             p.ID,
+			SK:             rev.CreatedAt,
+			Language:       rev.Language,
+			Title:          rev.Title,
+			Text:           rev.Text,
+			ExpiresAt:      p.ExpiresAt,
+			OwnerTokenHash: p.OwnerTokenHash,
+			PasswordHash:   p.PasswordHash,
+			Revision:       rev.Revision,
+			Kind:           p.Kind,
+		})
+	}
+	current := revisions[len(revisions)-1]
+	current.BurnAfterReading = p.BurnAfterReading
+	current.Burned = p.Burned
+	return revisions
+}
+
+// writeArchive writes every paste and diff of store that has not expired
+// to w as a tar.gz archive
+func writeArchive(ctx context.Context, w io.Writer, store migrationStore) (migrationCounts, error) {
+	var counts migrationCounts
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	writeFile := func(name string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(b)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	}
+
+	err := store.ScanPastes(ctx, func(revisions []*Paste) error {
+		current := revisions[len(revisions)-1]
+		if expired(current.ExpiresAt, now) {
+			return nil
+		}
+		counts.pastes++
+		counts.revisions += len(revisions)
+		return writeFile("pastes/"+current.PK+".json", newArchivePaste(revisions))
+	})
+	if err != nil {
+		return counts, err
+	}
+
+	err = store.ScanDiffs(ctx, func(diff *Diff) error {
+		if expired(diff.ExpiresAt, now) {
+			return nil
+		}
+		counts.diffs++
+		return writeFile("diffs/"+diff.PK+".json", archiveDiff{
+			ID:             diff.PK,
+			CreatedAt:      diff.SK,
+			OldText:        diff.OldText,
+			NewText:        diff.NewText,
+			ExpiresAt:      diff.ExpiresAt,
+			OwnerTokenHash: diff.OwnerTokenHash,
+			PasswordHash:   diff.PasswordHash,
+		})
+	})
+	if err != nil {
+		return counts, err
+	}
+
+	err = writeFile("manifest.json", archiveManifest{
+		Version:    archiveVersion,
+		ExportedAt: now.UTC().Format(time.RFC3339),
+		Pastes:     counts.pastes,
+		Revisions:  counts.revisions,
+		Diffs:      counts.diffs,
+	})
+	if err != nil {
+		return counts, err
+	}
+	if err := tw.Close(); err != nil {
+		return counts, err
+	}
+	return counts, gz.Close()
+}
+
+// readArchive restores the pastes and diffs of a tar.gz archive into store
+// and returns how many were restored and how many were skipped as store
+// already had them. Items that expired since the export are left out.
+func readArchive(ctx context.Context, r io.Reader, store migrationStore) (restored, skipped migrationCounts, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return restored, skipped, err
+	}
+	tr := tar.NewReader(gz)
+	now := time.Now()
+
+	var manifest *archiveManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, skipped, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		dir, name := path.Split(hdr.Name)
+		switch {
+		case hdr.Name == "manifest.json":
+			manifest = &archiveManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return restored, skipped, fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			if manifest.Version != archiveVersion {
+				return restored, skipped, fmt.Errorf("unsupported archive version %d", manifest.Version)
+			}
+		case dir == "pastes/" && strings.HasSuffix(name, ".json"):
+			var p archivePaste
+			if err := json.NewDecoder(tr).Decode(&p); err != nil {
+				return restored, skipped, fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			if p.ID == "" || len(p.Revisions) == 0 {
+				return restored, skipped, fmt.Errorf("%s: no id or revisions", hdr.Name)
+			}
+			if expired(p.ExpiresAt, now) {
+				continue
+			}
+			err := store.ImportPaste(ctx, p.pastes())
+			if errors.Is(err, ErrConflict) {
+				skipped.pastes++
+				skipped.revisions += len(p.Revisions)
+				continue
+			}
+			if err != nil {
+				return restored, skipped, fmt.Errorf("paste %s: %w", p.ID, err)
+			}
+			restored.pastes++
+			restored.revisions += len(p.Revisions)
+		case dir == "diffs/" && strings.HasSuffix(name, ".json"):
+			var d archiveDiff
+			if err := json.NewDecoder(tr).Decode(&d); err != nil {
+				return restored, skipped, fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			if d.ID == "" {
+				return restored, skipped, fmt.Errorf("%s: no id", hdr.Name)
+			}
+			if expired(d.ExpiresAt, now) {
+				continue
+			}
+			err := store.ImportDiff(ctx, &Diff{
+				PK:             d.ID,
+				SK:             d.CreatedAt,
+				OldText:        d.OldText,
+				NewText:        d.NewText,
+				ExpiresAt:      d.ExpiresAt,
+				OwnerTokenHash: d.OwnerTokenHash,
+				PasswordHash:   d.PasswordHash,
+			})
+			if errors.Is(err, ErrConflict) {
+				skipped.diffs++
+				continue
+			}
+			if err != nil {
+				return restored, skipped, fmt.Errorf("diff %s: %w", d.ID, err)
+			}
+			restored.diffs++
+		}
+	}
+	if manifest == nil {
+		return restored, skipped, fmt.Errorf("archive has no manifest.json, it may be truncated")
+	}
+	return restored, skipped, nil
+}
+
+// cliExport runs pbin export
+func cliExport(args []string) error {
+	fs := flag.NewFlagSet("pbin export", flag.ContinueOnError)
+	from := fs.String("from", "", "store to export, as for pbin migrate")
+	out := fs.String("o", "-", "file to write the tar.gz archive to, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	store, err := openMigrationStore(*from)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", *from, err)
+	}
+	defer store.Close()
+
+	if *out == "-" {
+		counts, err := writeArchive(ctx, os.Stdout, store)
+		fmt.Fprintf(os.Stderr, "exported %v\n", counts)
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	counts, err := writeArchive(ctx, f, store)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %v\n", counts)
+	return nil
+}
+
+// cliImport runs pbin import
+func cliImport(args []string) error {
+	fs := flag.NewFlagSet("pbin import", flag.ContinueOnError)
+	to := fs.String("to", "", "store to restore into, as for pbin migrate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return fmt.Errorf("-to is required")
+	}
+
+	r := io.Reader(os.Stdin)
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	store, err := openMigrationStore(*to)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", *to, err)
+	}
+	defer store.Close()
+
+	restored, skipped, err := readArchive(ctx, r, store)
+	fmt.Fprintf(os.Stderr, "restored %v; skipped %v already in %s\n", restored, skipped, *to)
+	return err
+}
+
+// checkAdminToken writes the error response and returns false unless the
+// request carries PBIN_ADMIN_TOKEN as a bearer token. Without
+// PBIN_ADMIN_TOKEN the admin endpoints do not exist.
+func checkAdminToken(writer http.ResponseWriter, request *http.Request) bool {
+	if PBIN_ADMIN_TOKEN == "" {
+		writeError(writer, http.StatusNotFound, errCodeNotFound, "not found")
+		return false
+	}
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		writeError(writer, http.StatusUnauthorized, errCodeUnauthorized, "admin token required")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(PBIN_ADMIN_TOKEN)) != 1 {
+		writeError(writer, http.StatusForbidden, errCodeForbidden, "invalid admin token")
+		return false
+	}
+	return true
+}
+
+// handleExport streams the archive pbin export writes to an admin
+func handleExport(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sugar := zap.L().Sugar()
+
+		if request.Method != "GET" {
+			writeMethodNotAllowed(writer, request)
+			return
+		}
+		if !checkAdminToken(writer, request) {
+			sugar.Warnw("admin_token_rejected", "path", request.URL.Path)
+			return
+		}
+		scanner, ok := store.(migrationStore)
+		if !ok {
+			writeError(writer, http.StatusNotImplemented, errCodeInternal, "the store cannot be exported")
+			return
+		}
+
+		name := fmt.Sprintf("pbin-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+		writer.Header().Set("Content-Type", "application/gzip")
+		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		counts, err := writeArchive(request.Context(), writer, scanner)
+		if err != nil {
+			// the status is long gone, a truncated archive lacks its
+			// manifest and is refused by pbin import
+			sugar.Errorw("failed_to_export_archive", "error", err)
+			return
+		}
+		sugar.Infow("archive_exported", "pastes", counts.pastes, "revisions", counts.revisions, "diffs", counts.diffs)
+	}
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// blobMinBytes is the size from which a paste text, or the texts of a diff
+// together, are kept in blob storage rather than in the store record
+var blobMinBytes = envInt64("PBIN_BLOB_MIN_BYTES", 256<<10)
+
+// blobStorage keeps bodies by key, in S3 or a local directory
+type blobStorage interface {
+	Put(ctx context.Context, key string, body []byte) error
+	// Get returns ErrNotFound for a key that is not there
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete succeeds for a key that is not there
+	Delete(ctx context.Context, key string) error
+	// List calls fn with the keys under the directory prefix, which ends in
+	// a slash, and their last modification in lexical order until fn
+	// returns errStopList
+	List(ctx context.Context, prefix string, fn func(key string, modified time.Time) error) error
+}
+
+// errStopList ends a List early without failing it
+var errStopList = errors.New("stop listing")
+
+// newBlobStorage opens the blob storage named by s3:<bucket>[/<prefix>]
+// or file:<directory>
+func newBlobStorage(spec string) (blobStorage, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "s3":
+		bucket, prefix, _ := strings.Cut(arg, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("s3 blob storage needs a bucket, as in s3:my-bucket")
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return &s3Blobs{svc: s3.New(sess), bucket: bucket, prefix: prefix}, nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("file blob storage needs a directory, as in file:blobs")
+		}
+		if err := os.MkdirAll(arg, 0700); err != nil {
+			return nil, err
+		}
+		return &fileBlobs{dir: arg}, nil
+	}
+	return nil, fmt.Errorf("unknown blob storage %q, expected s3 or file", kind)
+}
+
+// s3Blobs keeps bodies as objects in an S3 bucket, under prefix
+type s3Blobs struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+}
+
+func (s *s3Blobs) Put(ctx context.Context, key string, body []byte) error {
+	_, err := s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+func (s *s3Blobs) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("blob %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3Blobs) Delete(ctx context.Context, key string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	return err
+}
+
+func (s *s3Blobs) List(ctx context.Context, prefix string, fn func(key string, modified time.Time) error) error {
+	var fnErr error
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(aws.StringValue(obj.Key), s.prefix)
+			if fnErr = fn(key, aws.TimeValue(obj.LastModified)); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if errors.Is(fnErr, errStopList) {
+		return nil
+	}
+	return fnErr
+}
+
+// fileBlobs keeps bodies as files under dir, a stand-in for S3 in
+// development and tests
+type fileBlobs struct {
+	dir string
+}
+
+func (f *fileBlobs) path(key string) string {
+	return filepath.Join(f.dir, filepath.FromSlash(key))
+}
+
+// Put writes body to a temporary file first, so a reader never sees half
+// of it
+func (f *fileBlobs) Put(ctx context.Context, key string, body []byte) error {
+	p := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (f *fileBlobs) Get(ctx context.Context, key string) ([]byte, error) {
+	body, err := os.ReadFile(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("blob %s: %w", key, ErrNotFound)
+	}
+	return body, err
+}
+
+func (f *fileBlobs) Delete(ctx context.Context, key string) error {
+	err := os.Remove(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileBlobs) List(ctx context.Context, prefix string, fn func(key string, modified time.Time) error) error {
+	// ReadDir sorts by name
+	entries, err := os.ReadDir(f.path(prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".tmp-") {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(prefix+e.Name(), info.ModTime()); err != nil {
+			if errors.Is(err, errStopList) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Blob keys start with the expiry of their paste or diff, zero padded so
+// that listing expires/ visits them in the order they expire. Texts that
+// never expire go under never/ and only leave with their paste or diff.
+// The shared bodies of dedupStore, whose expiry moves as pastes come and
+// go, are kept under bodies/<hash>-<uuid>.
+const (
+	blobExpiresPrefix = "expires/"
+	blobNeverPrefix   = "never/"
+	blobBodiesPrefix  = "bodies/"
+)
+
+// orphanGrace is how long a body blob is left alone after it was written,
+// as its Body record follows the upload
+const orphanGrace = time.Hour
+
+// newBlobKey returns a fresh key for a body expiring at expiresAt
+func newBlobKey(expiresAt int64) string {
+	if expiresAt == 0 {
+		return blobNeverPrefix + uuid.New().String()
+	}
+	return fmt.Sprintf("%s%012d-%s", blobExpiresPrefix, expiresAt, uuid.New())
+}
+
+// blobKeyExpiry is the expiry newBlobKey put into key
+func blobKeyExpiry(key string) (int64, bool) {
+	rest, ok := strings.CutPrefix(key, blobExpiresPrefix)
+	if !ok {
+		return 0, false
+	}
+	stamp, _, _ := strings.Cut(rest, "-")
+	expiresAt, err := strconv.ParseInt(stamp, 10, 64)
+	return expiresAt, err == nil
+}
+
+// diffBlob is the body of a diff in blob storage
+type diffBlob struct {
+	OldText string `json:"oldText"`
+	NewText string `json:"newText"`
+}
+
+// blobStore keeps large texts of the store it wraps in blob storage, the
+// record holding only their key, and fetches them back on every read.
+// Texts go when their paste or diff is deleted or burned, or, keyed by
+// expiry, are swept once it has passed. Shared bodies are swept once their
+// Body record is gone.
+type blobStore struct {
+	migrationStore
+	blobs    blobStorage
+	minBytes int64
+	done     chan struct{}
+}
+
+// newBlobStore wraps store, offloading to blobs from the configured
+// threshold, and starts sweeping expired texts
+func newBlobStore(store migrationStore, blobs blobStorage) *blobStore {
+	b := &blobStore{migrationStore: store, blobs: blobs, minBytes: blobMinBytes, done: make(chan struct{})}
+	go b.sweepExpired(sweepInterval)
+	return b
+}
+
+// offloadPaste returns a copy of paste to store, with its text moved to
+// blob storage when it is large. The key is returned for cleaning up
+// after a failed write.
+func (b *blobStore) offloadPaste(ctx context.Context, paste *Paste) (*Paste, string, error) {
+	stored := *paste
+	if int64(len(paste.Text)) < b.minBytes {
+		return &stored, "", nil
+	}
+	key := newBlobKey(paste.ExpiresAt)
+	if err := b.blobs.Put(ctx, key, []byte(paste.Text)); err != nil {
+		return nil, "", fmt.Errorf("storing paste body: %w", err)
+	}
+	stored.Text, stored.BlobKey = "", key
+	return &stored, key, nil
+}
+
+// fetchPaste puts the text of a paste kept in blob storage back in place
+func (b *blobStore) fetchPaste(ctx context.Context, paste *Paste) error {
+	if paste.BlobKey == "" {
+		return nil
+	}
+	body, err := b.blobs.Get(ctx, paste.BlobKey)
+	if err != nil {
+		return fmt.Errorf("paste %s: %w", paste.PK, err)
+	}
+	paste.Text, paste.BlobKey = string(body), ""
+	return nil
+}
+
+// offloadDiff is offloadPaste for diffs, which move both texts together
+func (b *blobStore) offloadDiff(ctx context.Context, diff *Diff) (*Diff, string, error) {
+	stored := *diff
+	if int64(len(diff.OldText)+len(diff.NewText)) < b.minBytes {
+		return &stored, "", nil
+	}
+	body, err := json.Marshal(diffBlob{OldText: diff.OldText, NewText: diff.NewText})
+	if err != nil {
+		return nil, "", err
+	}
+	key := newBlobKey(diff.ExpiresAt)
+	if err := b.blobs.Put(ctx, key, body); err != nil {
+		return nil, "", fmt.Errorf("storing diff body: %w", err)
+	}
+	stored.OldText, stored.NewText, stored.BlobKey = "", "", key
+	return &stored, key, nil
+}
+
+// fetchDiff puts the texts of a diff kept in blob storage back in place
+func (b *blobStore) fetchDiff(ctx context.Context, diff *Diff) error {
+	if diff.BlobKey == "" {
+		return nil
+	}
+	body, err := b.blobs.Get(ctx, diff.BlobKey)
+	if err != nil {
+		return fmt.Errorf("diff %s: %w", diff.PK, err)
+	}
+	var texts diffBlob
+	if err := json.Unmarshal(body, &texts); err != nil {
+		return fmt.Errorf("diff %s: %w", diff.PK, err)
+	}
+	diff.OldText, diff.NewText, diff.BlobKey = texts.OldText, texts.NewText, ""
+	return nil
+}
+
+// deleteBlobs removes the given keys, leaving any it cannot remove to the
+// sweeper or, for bodies that never expire, behind
+func (b *blobStore) deleteBlobs(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := b.blobs.Delete(ctx, key); err != nil {
+			zap.L().Sugar().Warnw("failed_to_delete_blob", "key", key, "error", err)
+		}
+	}
+}
+
+func (b *blobStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := b.migrationStore.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return paste, b.fetchPaste(ctx, paste)
+}
+
+// TakePaste reads the revisions of a burn-after-reading paste before
+// burning it, as their bodies have to go with them
+func (b *blobStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := b.migrationStore.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !paste.BurnAfterReading {
+		return paste, b.fetchPaste(ctx, paste)
+	}
+
+	revisions, err := b.migrationStore.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	paste, err = b.migrationStore.TakePaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.fetchPaste(ctx, paste); err != nil {
+		return nil, err
+	}
+	for _, rev := range revisions {
+		b.deleteBlobs(ctx, rev.BlobKey)
+	}
+	return paste, nil
+}
+
+// AddPaste uploads a large text before writing the record that points at
+// it, and deletes the upload again when that write fails
+func (b *blobStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	stored, key, err := b.offloadPaste(ctx, paste)
+	if err != nil {
+		return "", err
+	}
+	id, err := b.migrationStore.AddPaste(ctx, stored)
+	if err != nil {
+		b.deleteBlobs(context.Background(), key)
+		return "", err
+	}
+	paste.PK, paste.SK, paste.Revision = stored.PK, stored.SK, stored.Revision
+	if key != "" {
+		zap.L().Sugar().Infow("paste_body_offloaded", "id", id, "key", key, "bytes", len(paste.Text))
+	}
+	return id, nil
+}
+
+// UpdatePaste uploads the text of the new revision under a key of its own,
+// so the blobs of earlier revisions stay untouched
+func (b *blobStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	stored, key, err := b.offloadPaste(ctx, paste)
+	if err != nil {
+		return err
+	}
+	if err := b.migrationStore.UpdatePaste(ctx, stored); err != nil {
+		b.deleteBlobs(context.Background(), key)
+		return err
+	}
+	paste.SK, paste.Revision = stored.SK, stored.Revision
+	if key != "" {
+		zap.L().Sugar().Infow("paste_body_offloaded", "id", paste.PK, "key", key, "bytes", len(paste.Text))
+	}
+	return nil
+}
+
+func (b *blobStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	revisions, err := b.migrationStore.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, paste := range revisions {
+		if err := b.fetchPaste(ctx, paste); err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+func (b *blobStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	paste, err := b.migrationStore.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return paste, b.fetchPaste(ctx, paste)
+}
+
+// DeletePaste removes the bodies of every revision once the paste is gone
+func (b *blobStore) DeletePaste(ctx context.Context, id string) error {
+	// an expired or burned paste has no bodies left to remove
+	revisions, _ := b.migrationStore.ListRevisions(ctx, id)
+	if err := b.migrationStore.DeletePaste(ctx, id); err != nil {
+		return err
+	}
+	for _, rev := range revisions {
+		b.deleteBlobs(ctx, rev.BlobKey)
+	}
+	return nil
+}
+
+func (b *blobStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	diff, err := b.migrationStore.GetDiff(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return diff, b.fetchDiff(ctx, diff)
+}
+
+// AddDiff uploads both texts of a large diff as one JSON blob
+func (b *blobStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
+	stored, key, err := b.offloadDiff(ctx, diff)
+	if err != nil {
+		return "", err
+	}
+	id, err := b.migrationStore.AddDiff(ctx, stored)
+	if err != nil {
+		b.deleteBlobs(context.Background(), key)
+		return "", err
+	}
+	diff.PK, diff.SK = stored.PK, stored.SK
+	if key != "" {
+		zap.L().Sugar().Infow("diff_body_offloaded", "id", id, "key", key, "bytes", len(diff.OldText)+len(diff.NewText))
+	}
+	return id, nil
+}
+
+func (b *blobStore) DeleteDiff(ctx context.Context, id string) error {
+	diff, _ := b.migrationStore.GetDiff(ctx, id)
+	if err := b.migrationStore.DeleteDiff(ctx, id); err != nil {
+		return err
+	}
+	if diff != nil {
+		b.deleteBlobs(ctx, diff.BlobKey)
+	}
+	return nil
+}
+
+func (b *blobStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	return b.migrationStore.ScanPastes(ctx, func(revisions []*Paste) error {
+		for _, paste := range revisions {
+			// the body of an expired paste may be swept already
+			if err := b.fetchPaste(ctx, paste); err != nil && !expired(paste.ExpiresAt, time.Now()) {
+				return err
+			}
+		}
+		return fn(revisions)
+	})
+}
+
+func (b *blobStore) ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error {
+	return b.migrationStore.ScanDiffs(ctx, func(diff *Diff) error {
+		if err := b.fetchDiff(ctx, diff); err != nil && !expired(diff.ExpiresAt, time.Now()) {
+			return err
+		}
+		return fn(diff)
+	})
+}
+
+func (b *blobStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	stored := make([]*Paste, 0, len(revisions))
+	var keys []string
+	for _, paste := range revisions {
+		s, key, err := b.offloadPaste(ctx, paste)
+		if err != nil {
+			b.deleteBlobs(context.Background(), keys...)
+			return err
+		}
+		stored = append(stored, s)
+		keys = append(keys, key)
+	}
+	if err := b.migrationStore.ImportPaste(ctx, stored); err != nil {
+		b.deleteBlobs(context.Background(), keys...)
+		return err
+	}
+	return nil
+}
+
+func (b *blobStore) ImportDiff(ctx context.Context, diff *Diff) error {
+	stored, key, err := b.offloadDiff(ctx, diff)
+	if err != nil {
+		return err
+	}
+	if err := b.migrationStore.ImportDiff(ctx, stored); err != nil {
+		b.deleteBlobs(context.Background(), key)
+		return err
+	}
+	return nil
+}
+
+// sweepExpired deletes expired texts every interval, and orphaned bodies
+// every orphanGrace, until the store is closed
+func (b *blobStore) sweepExpired(interval time.Duration) {
+	sugar := zap.L().Sugar()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var orphansSwept time.Time
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			n, err := b.deleteExpired(context.Background(), now)
+			if err != nil {
+				sugar.Errorw("failed_to_sweep_expired_blobs", "error", err)
+			} else if n > 0 {
+				sugar.Infow("swept_expired_blobs", "count", n)
+			}
+
+			if now.Sub(orphansSwept) < orphanGrace {
+				continue
+			}
+			orphansSwept = now
+			n, err = b.deleteOrphans(context.Background(), now)
+			if err != nil {
+				sugar.Errorw("failed_to_sweep_orphaned_blobs", "error", err)
+			} else if n > 0 {
+				sugar.Infow("swept_orphaned_blobs", "count", n)
+			}
+		}
+	}
+}
+
+// deleteExpired removes the texts that have expired at now, stopping at
+// the first one that has not, and returns how many were removed
+func (b *blobStore) deleteExpired(ctx context.Context, now time.Time) (int, error) {
+	n := 0
+	err := b.blobs.List(ctx, blobExpiresPrefix, func(key string, modified time.Time) error {
+		expiresAt, ok := blobKeyExpiry(key)
+		if !ok {
+			return nil
+		}
+		if !expired(expiresAt, now) {
+			return errStopList
+		}
+		if err := b.blobs.Delete(ctx, key); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// AcquireBody keeps a large body in blob storage. Whether the body is
+// stored already is only known afterwards, so it is uploaded every time,
+// under a fresh key, and the upload deleted again if it was. Encrypted
+// bodies differ with every upload, so the stored one must not be written
+// over.
+func (b *blobStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	if int64(len(body.Text)) < b.minBytes {
+		return b.migrationStore.AcquireBody(ctx, body)
+	}
+	stored := *body
+	key := fmt.Sprintf("%s%s-%s", blobBodiesPrefix, body.Hash, uuid.New())
+	if err := b.blobs.Put(ctx, key, []byte(body.Text)); err != nil {
+		return false, fmt.Errorf("storing body: %w", err)
+	}
+	stored.Text, stored.BlobKey = "", key
+	created, err := b.migrationStore.AcquireBody(ctx, &stored)
+	if err != nil || !created {
+		b.deleteBlobs(context.Background(), key)
+	}
+	return created, err
+}
+
+func (b *blobStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	body, err := b.migrationStore.GetBody(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if body.BlobKey == "" {
+		return body, nil
+	}
+	text, err := b.blobs.Get(ctx, body.BlobKey)
+	if err != nil {
+		return nil, fmt.Errorf("body %s: %w", hash, err)
+	}
+	body.Text, body.BlobKey = string(text), ""
+	return body, nil
+}
+
+// deleteOrphans removes the body blobs older than orphanGrace whose Body
+// record is gone or has expired, and returns how many were removed
+func (b *blobStore) deleteOrphans(ctx context.Context, now time.Time) (int, error) {
+	n := 0
+	err := b.blobs.List(ctx, blobBodiesPrefix, func(key string, modified time.Time) error {
+		if now.Sub(modified) < orphanGrace {
+			return nil
+		}
+		hash, _, _ := strings.Cut(strings.TrimPrefix(key, blobBodiesPrefix), "-")
+		body, err := b.migrationStore.GetBody(ctx, hash)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if body != nil && body.BlobKey == key {
+			return nil
+		}
+		if err := b.blobs.Delete(ctx, key); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Close stops the sweeper and closes the wrapped store
+func (b *blobStore) Close() error {
+	close(b.done)
+	return b.migrationStore.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// blobFiles returns the contents of the blobs stored under dir
+func blobFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		files = append(files, string(b))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestBlobStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	m := NewMemoryStore()
+	b := newBlobStore(m, &fileBlobs{dir: dir})
+	t.Cleanup(func() { b.Close() })
+	b.minBytes = 16
+
+	id, err := b.AddPaste(ctx, &Paste{Text: "the first large text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpdatePaste(ctx, &Paste{PK: id, Text: "the second large text"}); err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := b.AddDiff(ctx, &Diff{OldText: "old diff text", NewText: "new diff text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallID, err := b.AddPaste(ctx, &Paste{Text: "small"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current := m.pastes[id]; current.Text != "" || current.BlobKey == "" {
+		t.Errorf("stored paste = %+v, want only a blob key", current)
+	}
+	if diff := m.diffs[diffID]; diff.OldText != "" || diff.NewText != "" || diff.BlobKey == "" {
+		t.Errorf("stored diff = %+v, want only a blob key", diff)
+	}
+	if small := m.pastes[smallID]; small.Text != "small" || small.BlobKey != "" {
+		t.Errorf("stored small paste = %+v, want it kept in the record", small)
+	}
+	if files := blobFiles(t, dir); len(files) != 3 {
+		t.Errorf("stored %d blobs, want one for each large revision and the diff", len(files))
+	}
+
+	revisions, err := b.ListRevisions(ctx, id)
+	if err != nil || len(revisions) != 2 || revisions[0].Text != "the first large text" || revisions[1].BlobKey != "" {
+		t.Errorf("ListRevisions = %v, want both texts fetched back", err)
+	}
+	if paste, err := b.GetPaste(ctx, id); err != nil || paste.Text != "the second large text" {
+		t.Errorf("GetPaste = %v, want the current text", err)
+	}
+	if diff, err := b.GetDiff(ctx, diffID); err != nil || diff.OldText != "old diff text" || diff.NewText != "new diff text" {
+		t.Errorf("GetDiff = %v, want both texts", err)
+	}
+
+	if err := b.DeletePaste(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteDiff(ctx, diffID); err != nil {
+		t.Fatal(err)
+	}
+	if files := blobFiles(t, dir); len(files) != 0 {
+		t.Errorf("%d blobs left after deleting, want none", len(files))
+	}
+}
+
+func TestBlobStoreOnlySeesCiphertext(t *testing.T) {
+	clearStoreEnv(t)
+	dir := t.TempDir()
+	t.Setenv("PBIN_BLOB_STORE", "file:"+dir)
+	t.Setenv("PBIN_ENCRYPTION_KEYS", testKey("k1", 1))
+	saved := blobMinBytes
+	t.Cleanup(func() { blobMinBytes = saved })
+	blobMinBytes = 16
+
+	store, err := wrapStore(NewMemoryStore())
+	if err != nil {
+		t.Fatalf("wrapStore: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	id, err := store.AddPaste(ctx, &Paste{Text: "a secret worth offloading"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := blobFiles(t, dir)
+	if len(files) != 1 || strings.Contains(files[0], "secret") {
+		t.Errorf("blobs = %q, want one holding ciphertext", files)
+	}
+	if paste, err := store.GetPaste(ctx, id); err != nil || paste.Text != "a secret worth offloading" {
+		t.Errorf("GetPaste = %v, want the text", err)
+	}
+
+	// a record whose blob is gone says so
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPaste(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPaste with its blob gone = %v, want ErrNotFound", err)
+	}
+}
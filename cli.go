@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"pbin/client"
+)
+
+// defaultServerURL is used by the command line tool when neither the -url
+// flag, PBIN_URL nor the config file name a server
+const defaultServerURL = "https://p.jjk.is"
+
+// cliCommands are the subcommands that make pbin act as a client rather
+// than start the server
+var cliCommands = map[string]func(args []string) error{
+	"paste":   cliPaste,
+	"get":     cliGet,
+	"diff":    cliDiff,
+	"open":    cliOpen,
+	"migrate": cliMigrate,
+	"export":  cliExport,
+	"import":  cliImport,
+	"rekey":   cliRekey,
+}
+
+const cliUsage = `usage:
+  pbin                          start the server
+  pbin paste [flags] [file...]  paste stdin or each file and print the links
+  pbin get [flags] <id>         print the text of a paste
+  pbin diff [flags] <old> <new> diff two files and print the link
+  pbin open [flags] <id>        open a paste in the browser
+  pbin migrate -from <store> -to <store>
+                                copy every paste and diff between stores
+  pbin export -from <store> [-o file]
+                                write every paste and diff to a tar.gz
+  pbin import -to <store> [file]
+                                restore a tar.gz written by pbin export
+  pbin rekey -store <store>     wrap every data key in the current key
+
+run pbin <command> -h for the flags of a command
+`
+
+// cliConfig is read from $XDG_CONFIG_HOME/pbin/config.yaml
+type cliConfig struct {
+	URL string `yaml:"url"`
+}
+
+// runCLI runs a client subcommand and returns the exit code
+func runCLI(args []string) int {
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	if err := cmd(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "pbin %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// serverURL picks the server from the -url flag, PBIN_URL or the config
+// file, in that order
+func serverURL(flagURL string) string {
+	if flagURL != "" {
+		return flagURL
+	}
+	if u := os.Getenv("PBIN_URL"); u != "" {
+		return u
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		if b, err := os.ReadFile(filepath.Join(dir, "pbin", "config.yaml")); err == nil {
+			var cfg cliConfig
+			if err := yaml.Unmarshal(b, &cfg); err == nil && cfg.URL != "" {
+				return cfg.URL
+			}
+		}
+	}
+	return defaultServerURL
+}
+
+// newFlagSet returns the flags shared by every subcommand and a function
+// building the client once they are parsed
+func newFlagSet(name string) (*flag.FlagSet, func() *client.Client) {
+	fs := flag.NewFlagSet("pbin "+name, flag.ContinueOnError)
+	url := fs.String("url", "", "server URL, overrides PBIN_URL and the config file")
+	return fs, func() *client.Client {
+		return client.New(serverURL(*url))
+	}
+}
+
+func cliPaste(args []string) error {
+	fs, newClient := newFlagSet("paste")
+	lang := fs.String("lang", "", "language of the paste, guessed by the server when empty")
+	expiry := fs.String("expiry", "", "10m, 1h, 1d, 1w or never")
+	burn := fs.Bool("burn", false, "delete the paste once it has been read")
+	open := fs.Bool("open", false, "open the paste in the browser")
+	encrypt := fs.Bool("encrypt", false, "encrypt the paste so the server cannot read it, the key goes in the link")
+	password := fs.String("password", "", "password needed to read the paste")
+	slug := fs.String("slug", "", "id to give the paste instead of a generated one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *slug != "" && fs.NArg() > 1 {
+		return fmt.Errorf("-slug names a single paste, got %d files", fs.NArg())
+	}
+	c := newClient()
+	opts := client.PasteOptions{Language: *lang, Expiry: *expiry, Burn: *burn, Password: *password, Slug: *slug}
+
+	paste := func(r io.Reader) error {
+		text, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		var created *client.Created
+		if *encrypt {
+			created, _, err = c.CreateEncryptedPaste(context.Background(), string(text), opts)
+		} else {
+			created, err = c.CreatePaste(context.Background(), string(text), opts)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(created.URL)
+		if *open {
+			return openBrowser(created.URL)
+		}
+		return nil
+	}
+
+	if fs.NArg() == 0 {
+		return paste(os.Stdin)
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = paste(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func cliGet(args []string) error {
+	fs, newClient := newFlagSet("get")
+	key := fs.String("key", "", "key of an encrypted paste, taken from the link when it has one")
+	password := fs.String("password", "", "password of a protected paste")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a paste id")
+	}
+	if *key == "" {
+		*key = pasteKey(fs.Arg(0))
+	}
+
+	var paste *client.Paste
+	var err error
+	if *password != "" {
+		paste, err = newClient().GetProtectedPaste(context.Background(), pasteID(fs.Arg(0)), *password)
+	} else {
+		paste, err = newClient().GetPaste(context.Background(), pasteID(fs.Arg(0)))
+	}
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.Code == "password_required" && *password == "" {
+		return fmt.Errorf("paste is password protected, pass -password")
+	}
+	if err != nil {
+		return err
+	}
+	if paste.Kind == client.KindEncrypted {
+		if *key == "" {
+			return fmt.Errorf("paste is encrypted, pass its whole link or -key")
+		}
+		if paste.Text, err = client.DecryptText(paste.Text, *key); err != nil {
+			return err
+		}
+	}
+	fmt.Print(paste.Text)
+	return nil
+}
+
+func cliDiff(args []string) error {
+	fs, newClient := newFlagSet("diff")
+	expiry := fs.String("expiry", "", "10m, 1h, 1d, 1w or never")
+	open := fs.Bool("open", false, "open the diff in the browser")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected two files")
+	}
+
+	original, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	modified, err := os.ReadFile(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	created, err := newClient().CreateDiff(context.Background(), string(original), string(modified), *expiry)
+	if err != nil {
+		return err
+	}
+	fmt.Println(created.URL)
+	if *open {
+		return openBrowser(created.URL)
+	}
+	return nil
+}
+
+func cliOpen(args []string) error {
+	fs, newClient := newFlagSet("open")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a paste id")
+	}
+	link := fmt.Sprintf("%s/paste?id=%s", newClient().BaseURL, pasteID(fs.Arg(0)))
+	if key := pasteKey(fs.Arg(0)); key != "" {
+		link += "#" + key
+	}
+	return openBrowser(link)
+}
+
+// pasteID accepts either a bare id, a link to a paste or a short /p/ link
+func pasteID(arg string) string {
+	arg, _, _ = strings.Cut(arg, "#")
+	if _, id, ok := strings.Cut(arg, "id="); ok {
+		id, _, _ = strings.Cut(id, "&")
+		return id
+	}
+	if _, id, ok := strings.Cut(arg, "/p/"); ok {
+		id, _, _ = strings.Cut(id, "?")
+		return id
+	}
+	return arg
+}
+
+// pasteKey returns the key of an encrypted paste from the fragment of its
+// link, or "" when there is none
+func pasteKey(arg string) string {
+	_, key, _ := strings.Cut(arg, "#")
+	return key
+}
+
+// openBrowser opens url with the desktop's default handler
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,248 @@
+// Package client talks to a pbin server over its HTTP API. The calls
+// mirror PastebinService in proto/pastebin.proto; programs that would
+// rather speak gRPC can use pbin/proto directly.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// passwordHeader carries the password of a protected paste or diff
+const passwordHeader = "X-Paste-Password"
+
+// Client is a pbin API client. The zero value is not usable, create one
+// with New.
+type Client struct {
+	// BaseURL is the server root, e.g. https://p.jjk.is
+	BaseURL string
+	// HTTPClient makes the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// PasteOptions are the optional settings of a new paste
+type PasteOptions struct {
+	// Language is a Monaco language id, guessed by the server when empty
+	Language string
+	// Expiry is one of 10m, 1h, 1d, 1w or never
+	Expiry string
+	// Burn deletes the paste the first time it is read
+	Burn bool
+	// Kind is KindEncrypted when the text is ciphertext from EncryptText
+	Kind string
+	// Password, when set, has to be given to read the paste
+	Password string
+	// Slug is the id the paste should have instead of a generated one. The
+	// server answers with an Error whose Code is "conflict" when it is
+	// taken.
+	Slug string
+}
+
+// Created is the answer to creating a paste or a diff
+type Created struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Token lets its holder edit or delete what was created
+	Token string `json:"token"`
+}
+
+// Paste is a paste as returned by GET /api/paste
+type Paste struct {
+	ID        string `json:"id"`
+	Text      string `json:"text"`
+	Language  string `json:"language"`
+	Title     string `json:"title"`
+	Revision  int    `json:"revision"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	// Kind is KindEncrypted when Text is ciphertext, see DecryptText
+	Kind string `json:"kind,omitempty"`
+}
+
+// Diff is a diff as returned by GET /api/diff
+type Diff struct {
+	ID        string `json:"id"`
+	OldText   string `json:"oldText"`
+	NewText   string `json:"newText"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+// Error is a response from the server with a non 2xx status. Code is the
+// error code from the JSON body, such as "not_found" or "expired", and is
+// empty when the server did not send one.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("pbin: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("pbin: %s: %s", http.StatusText(e.StatusCode), e.Message)
+}
+
+// CreatePaste stores text as a new paste
+func (c *Client) CreatePaste(ctx context.Context, text string, opts PasteOptions) (*Created, error) {
+	created := &Created{}
+	err := c.do(ctx, "POST", "/api/paste", map[string]interface{}{
+		"text":     text,
+		"language": opts.Language,
+		"expiry":   opts.Expiry,
+		"burn":     opts.Burn,
+		"kind":     opts.Kind,
+		"password": opts.Password,
+		"slug":     opts.Slug,
+	}, created)
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetPaste fetches the paste with the given id. Reading a burn after
+// reading paste deletes it.
+func (c *Client) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	paste := &Paste{}
+	if err := c.do(ctx, "GET", "/api/paste?id="+url.QueryEscape(id), nil, paste); err != nil {
+		return nil, err
+	}
+	return paste, nil
+}
+
+// GetProtectedPaste fetches a password protected paste like GetPaste.
+// Without the right password the server answers with an Error whose Code
+// is "password_required", or "too_many_attempts" once it has seen too many
+// wrong ones.
+func (c *Client) GetProtectedPaste(ctx context.Context, id, password string) (*Paste, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/api/paste?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(passwordHeader, password)
+	paste := &Paste{}
+	if err := c.send(req, paste); err != nil {
+		return nil, err
+	}
+	return paste, nil
+}
+
+// CreateDiff stores a diff between original and modified. expiry takes the
+// same values as PasteOptions.Expiry.
+func (c *Client) CreateDiff(ctx context.Context, original, modified, expiry string) (*Created, error) {
+	created := &Created{}
+	err := c.do(ctx, "POST", "/api/diff", map[string]interface{}{
+		"original": original,
+		"modified": modified,
+		"expiry":   expiry,
+	}, created)
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetDiff fetches the diff with the given id
+func (c *Client) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	diff := &Diff{}
+	if err := c.do(ctx, "GET", "/api/diff?id="+url.QueryEscape(id), nil, diff); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// GetProtectedDiff fetches a password protected diff like GetDiff
+func (c *Client) GetProtectedDiff(ctx context.Context, id, password string) (*Diff, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/api/diff?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(passwordHeader, password)
+	diff := &Diff{}
+	if err := c.send(req, diff); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// GetCompletion asks the server to complete text
+func (c *Client) GetCompletion(ctx context.Context, text string) ([]string, error) {
+	form := url.Values{"text": {text}}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/api/complete", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp struct {
+		Completions []string `json:"completions"`
+	}
+	if err := c.send(req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Completions, nil
+}
+
+// do sends body as JSON to path and decodes the JSON answer into out
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+// send makes the request and decodes the JSON answer into out
+func (c *Client) send(req *http.Request, out interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(msg, &body) == nil && body.Error.Code != "" {
+			return &Error{StatusCode: resp.StatusCode, Code: body.Error.Code, Message: body.Error.Message}
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
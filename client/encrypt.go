@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KindEncrypted marks a paste whose text is encrypted by its client. The
+// server stores and returns the ciphertext as it is; the key travels in
+// the fragment of the paste URL, which browsers never send.
+const KindEncrypted = "encrypted"
+
+// ErrWrongKey is returned by DecryptText when the key does not open the
+// ciphertext
+var ErrWrongKey = errors.New("pbin: wrong key for encrypted paste")
+
+// EncryptText encrypts text with a new random key for an encrypted paste.
+// ciphertext is the base64 of a 12 byte nonce followed by the AES-256-GCM
+// ciphertext, and key is the base64url of the 32 byte key, without
+// padding, as the web app puts it after the # of a paste URL.
+func EncryptText(text string) (ciphertext, key string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	aead, err := newGCM(raw)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), nil)
+	return base64.StdEncoding.EncodeToString(sealed), base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// DecryptText is the reverse of EncryptText
+func DecryptText(ciphertext, key string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("pbin: malformed key: %w", err)
+	}
+	aead, err := newGCM(raw)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("pbin: malformed ciphertext")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	text, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrWrongKey
+	}
+	return string(text), nil
+}
+
+// newGCM returns AES-256-GCM with the given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("pbin: key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// CreateEncryptedPaste encrypts text and stores it as a new encrypted
+// paste. The URL of the answer carries the key in its fragment; the key is
+// also returned on its own.
+func (c *Client) CreateEncryptedPaste(ctx context.Context, text string, opts PasteOptions) (*Created, string, error) {
+	ciphertext, key, err := EncryptText(text)
+	if err != nil {
+		return nil, "", err
+	}
+	opts.Kind = KindEncrypted
+	created, err := c.CreatePaste(ctx, ciphertext, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	created.URL += "#" + key
+	return created, key, nil
+}
+
+// GetEncryptedPaste fetches an encrypted paste and decrypts its text with
+// key. It returns an error for a paste that is not encrypted.
+func (c *Client) GetEncryptedPaste(ctx context.Context, id, key string) (*Paste, error) {
+	paste, err := c.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if paste.Kind != KindEncrypted {
+		return nil, fmt.Errorf("pbin: paste %s is not encrypted", id)
+	}
+	if paste.Text, err = DecryptText(paste.Text, key); err != nil {
+		return nil, err
+	}
+	return paste, nil
+}
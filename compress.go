@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+// compressMinBytes is the size from which paste and diff texts are stored
+// compressed. Zero turns compression off.
+var compressMinBytes = envInt64("PBIN_COMPRESS_MIN_BYTES", 4096)
+
+// encodingGzip marks texts stored gzipped. Every backend keeps texts as
+// strings, so the gzip stream is base64 encoded.
+const encodingGzip = "gzip"
+
+// compressStore compresses the texts of large pastes and diffs on their way
+// into the store it wraps and decompresses them on the way out, recording
+// the encoding on the record so texts written uncompressed, before or
+// below the threshold, still read back as they are.
+type compressStore struct {
+	migrationStore
+	minBytes int64
+}
+
+// newCompressStore wraps store with the configured threshold
+func newCompressStore(store migrationStore) *compressStore {
+	return &compressStore{migrationStore: store, minBytes: compressMinBytes}
+}
+
+// compressText returns text gzipped and base64 encoded
+func compressText(text string) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, text); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeText is the reverse of compressText for the given encoding
+func decodeText(text, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return text, nil
+	case encodingGzip:
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return "", err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return "", err
+		}
+		plain, err := io.ReadAll(zr)
+		if err != nil {
+			return "", err
+		}
+		return string(plain), nil
+	}
+	return "", fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// encodePaste returns a copy of paste to store, with its text compressed
+// when that is worth it
+func (c *compressStore) encodePaste(paste *Paste) (*Paste, error) {
+	stored := *paste
+	stored.Encoding = ""
+	if c.minBytes <= 0 || int64(len(paste.Text)) < c.minBytes {
+		return &stored, nil
+	}
+	text, err := compressText(paste.Text)
+	if err != nil {
+		return nil, err
+	}
+	// text that hardly compresses grows by the base64 encoding
+	if len(text) < len(paste.Text) {
+		stored.Text, stored.Encoding = text, encodingGzip
+	}
+	return &stored, nil
+}
+
+// decodePaste turns a stored paste back into plain text in place
+func decodePaste(paste *Paste) error {
+	text, err := decodeText(paste.Text, paste.Encoding)
+	if err != nil {
+		return fmt.Errorf("paste %s: %w", paste.PK, err)
+	}
+	paste.Text, paste.Encoding = text, ""
+	return nil
+}
+
+// encodeDiff returns a copy of diff to store. Both texts are compressed or
+// neither, depending on their combined size.
+func (c *compressStore) encodeDiff(diff *Diff) (*Diff, error) {
+	stored := *diff
+	stored.Encoding = ""
+	size := len(diff.OldText) + len(diff.NewText)
+	if c.minBytes <= 0 || int64(size) < c.minBytes {
+		return &stored, nil
+	}
+	oldText, err := compressText(diff.OldText)
+	if err != nil {
+		return nil, err
+	}
+	newText, err := compressText(diff.NewText)
+	if err != nil {
+		return nil, err
+	}
+	if len(oldText)+len(newText) < size {
+		stored.OldText, stored.NewText, stored.Encoding = oldText, newText, encodingGzip
+	}
+	return &stored, nil
+}
+
+// decodeDiff turns a stored diff back into plain text in place
+func decodeDiff(diff *Diff) error {
+	oldText, err := decodeText(diff.OldText, diff.Encoding)
+	if err != nil {
+		return fmt.Errorf("diff %s: %w", diff.PK, err)
+	}
+	newText, err := decodeText(diff.NewText, diff.Encoding)
+	if err != nil {
+		return fmt.Errorf("diff %s: %w", diff.PK, err)
+	}
+	diff.OldText, diff.NewText, diff.Encoding = oldText, newText, ""
+	return nil
+}
+
+// logSaved reports the bytes compression saved on a write
+func logSaved(event, id string, plain, stored int) {
+	zap.L().Sugar().Infow(event,
+		"id", id,
+		"plain_bytes", plain,
+		"stored_bytes", stored,
+		"saved_bytes", plain-stored,
+	)
+}
+
+func (c *compressStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := c.migrationStore.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return paste, decodePaste(paste)
+}
+
+func (c *compressStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := c.migrationStore.TakePaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return paste, decodePaste(paste)
+}
+
+// AddPaste hands the wrapped store a copy of paste whose large text is
+// gzipped where that saves space, so paste itself keeps its plain text
+func (c *compressStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	stored, err := c.encodePaste(paste)
+	if err != nil {
+		return "", err
+	}
+	id, err := c.migrationStore.AddPaste(ctx, stored)
+	if err != nil {
+		return "", err
+	}
+	paste.PK, paste.SK, paste.Revision = stored.PK, stored.SK, stored.Revision
+	if stored.Encoding != "" {
+		logSaved("paste_compressed", id, len(paste.Text), len(stored.Text))
+	}
+	return id, nil
+}
+
+// UpdatePaste compresses the new revision on its own; earlier revisions
+// keep whatever encoding they were written with
+func (c *compressStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	stored, err := c.encodePaste(paste)
+	if err != nil {
+		return err
+	}
+	if err := c.migrationStore.UpdatePaste(ctx, stored); err != nil {
+		return err
+	}
+	paste.SK, paste.Revision = stored.SK, stored.Revision
+	if stored.Encoding != "" {
+		logSaved("paste_compressed", paste.PK, len(paste.Text), len(stored.Text))
+	}
+	return nil
+}
+
+func (c *compressStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	revisions, err := c.migrationStore.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, paste := range revisions {
+		if err := decodePaste(paste); err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+func (c *compressStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	paste, err := c.migrationStore.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return paste, decodePaste(paste)
+}
+
+func (c *compressStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	diff, err := c.migrationStore.GetDiff(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return diff, decodeDiff(diff)
+}
+
+// AddDiff compresses both texts of a large diff, or neither
+func (c *compressStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
+	stored, err := c.encodeDiff(diff)
+	if err != nil {
+		return "", err
+	}
+	id, err := c.migrationStore.AddDiff(ctx, stored)
+	if err != nil {
+		return "", err
+	}
+	diff.PK, diff.SK = stored.PK, stored.SK
+	if stored.Encoding != "" {
+		logSaved("diff_compressed", id, len(diff.OldText)+len(diff.NewText), len(stored.OldText)+len(stored.NewText))
+	}
+	return id, nil
+}
+
+// AcquireBody compresses body as AddPaste would a paste
+func (c *compressStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	stored := *body
+	paste, err := c.encodePaste(&Paste{Text: body.Text})
+	if err != nil {
+		return false, err
+	}
+	stored.Text, stored.Encoding = paste.Text, paste.Encoding
+	return c.migrationStore.AcquireBody(ctx, &stored)
+}
+
+func (c *compressStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	body, err := c.migrationStore.GetBody(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeText(body.Text, body.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("body %s: %w", hash, err)
+	}
+	body.Text, body.Encoding = text, ""
+	return body, nil
+}
+
+// ScanPastes hands fn the revisions of every paste in plain text
+func (c *compressStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	return c.migrationStore.ScanPastes(ctx, func(revisions []*Paste) error {
+		for _, paste := range revisions {
+			if err := decodePaste(paste); err != nil {
+				return err
+			}
+		}
+		return fn(revisions)
+	})
+}
+
+// ScanDiffs hands fn every diff in plain text
+func (c *compressStore) ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error {
+	return c.migrationStore.ScanDiffs(ctx, func(diff *Diff) error {
+		if err := decodeDiff(diff); err != nil {
+			return err
+		}
+		return fn(diff)
+	})
+}
+
+// ImportPaste compresses the revisions of a paste as AddPaste would
+func (c *compressStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	stored := make([]*Paste, 0, len(revisions))
+	for _, paste := range revisions {
+		s, err := c.encodePaste(paste)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, s)
+	}
+	return c.migrationStore.ImportPaste(ctx, stored)
+}
+
+// ImportDiff compresses diff as AddDiff would
+func (c *compressStore) ImportDiff(ctx context.Context, diff *Diff) error {
+	stored, err := c.encodeDiff(diff)
+	if err != nil {
+		return err
+	}
+	return c.migrationStore.ImportDiff(ctx, stored)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCompressStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	c := newCompressStore(m)
+	c.minBytes = 1024
+
+	large := strings.Repeat("a log line\n", 1000)
+	id, err := c.AddPaste(ctx, &Paste{Text: large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdatePaste(ctx, &Paste{PK: id, Text: "small"}); err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := c.AddDiff(ctx, &Diff{OldText: large, NewText: large + "one more\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := contentHash(large)
+	if _, err := c.AcquireBody(ctx, &Body{Hash: hash, Text: large}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only texts from the threshold on are stored gzipped
+	if rev := m.revisions[id][0]; rev.Encoding != encodingGzip || len(rev.Text) >= len(large) {
+		t.Errorf("stored large revision has encoding %q and %d bytes, want it gzipped", rev.Encoding, len(rev.Text))
+	}
+	if current := m.pastes[id]; current.Encoding != "" || current.Text != "small" {
+		t.Errorf("stored small revision = %+v, want it as it is", current)
+	}
+	if diff := m.diffs[diffID]; diff.Encoding != encodingGzip || len(diff.OldText)+len(diff.NewText) >= len(large) {
+		t.Errorf("stored diff has encoding %q, want it gzipped", diff.Encoding)
+	}
+	if body := m.bodies[hash]; body.Encoding != encodingGzip || len(body.Text) >= len(large) {
+		t.Errorf("stored body has encoding %q, want it gzipped", body.Encoding)
+	}
+
+	revisions, err := c.ListRevisions(ctx, id)
+	if err != nil || len(revisions) != 2 || revisions[0].Text != large || revisions[0].Encoding != "" || revisions[1].Text != "small" {
+		t.Errorf("ListRevisions = %v, want both revisions as written", err)
+	}
+	if rev, err := c.GetRevision(ctx, id, 1); err != nil || rev.Text != large {
+		t.Errorf("GetRevision 1 = %v, want the large text", err)
+	}
+	if diff, err := c.GetDiff(ctx, diffID); err != nil || diff.OldText != large || diff.NewText != large+"one more\n" {
+		t.Errorf("GetDiff = %v, want both texts as written", err)
+	}
+	if body, err := c.GetBody(ctx, hash); err != nil || body.Text != large {
+		t.Errorf("GetBody = %v, want the text as written", err)
+	}
+	if paste, err := c.TakePaste(ctx, id); err != nil || paste.Text != "small" {
+		t.Errorf("TakePaste = %v, want the current text", err)
+	}
+}
+
+func TestCompressStoreReadsUncompressedRecords(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	large := strings.Repeat("b", 8192)
+	// written before compression was configured
+	id, err := m.AddPaste(ctx, &Paste{Text: large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paste, err := newCompressStore(m).GetPaste(ctx, id); err != nil || paste.Text != large {
+		t.Errorf("GetPaste of an uncompressed record = %v, want it as it is", err)
+	}
+
+	m.pastes[id].Encoding = "zstd"
+	if _, err := newCompressStore(m).GetPaste(ctx, id); err == nil || !strings.Contains(err.Error(), `unknown encoding "zstd"`) {
+		t.Errorf("GetPaste of an unknown encoding = %v, want it named", err)
+	}
+}
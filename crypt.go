@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// keyring holds the keys that data keys are wrapped in, by id. Records are
+// written under the current key; the others stay to read records written
+// before a rotation until pbin rekey has moved them over.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// loadKeyring reads the keys from PBIN_ENCRYPTION_KEYS or, for
+// development, from the file named by PBIN_ENCRYPTION_KEYFILE, which is
+// created with a fresh key if it does not exist. It returns nil when
+// neither is set.
+func loadKeyring() (*keyring, error) {
+	if s := os.Getenv("PBIN_ENCRYPTION_KEYS"); s != "" {
+		return parseKeyring(s)
+	}
+	path := os.Getenv("PBIN_ENCRYPTION_KEYFILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		b, err = createKeyfile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading keyfile: %w", err)
+	}
+	return parseKeyring(string(b))
+}
+
+// createKeyfile writes a keyfile holding one new key and returns its
+// contents
+func createKeyfile(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	id := "dev-" + time.Now().UTC().Format("20060102")
+	b := []byte(id + ":" + base64.StdEncoding.EncodeToString(key) + "\n")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	zap.L().Sugar().Infow("encryption_keyfile_created", "path", path, "key_id", id)
+	return b, nil
+}
+
+// parseKeyring reads keys written as <id>:<base64 of 32 bytes>, separated
+// by commas or newlines, the first being the current one. Blank lines and
+// lines starting with # are skipped.
+func parseKeyring(s string) (*keyring, error) {
+	k := &keyring{keys: make(map[string]cipher.AEAD)}
+	entries := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key %q is not <id>:<base64>", entry)
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("key %s is given twice", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s is %d bytes, not 32", id, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		if k.current == "" {
+			k.current = id
+		}
+		k.keys[id] = aead
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("no keys given")
+	}
+	return k, nil
+}
+
+// newAEAD returns AES-256-GCM under key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain, prefixed with the random nonce it used
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// unseal is the reverse of seal
+func unseal(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// newDataKey returns a fresh data key, wrapped in the current key, to
+// encrypt one record with
+func (k *keyring) newDataKey() (keyID, wrapped string, aead cipher.AEAD, err error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", nil, err
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return "", "", nil, err
+	}
+	sealed, err := seal(k.keys[k.current], key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return k.current, base64.StdEncoding.EncodeToString(sealed), aead, nil
+}
+
+// unwrap returns the data key wrapped in the key keyID
+func (k *keyring) unwrap(keyID, wrapped string) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("encrypted under key %s, but no encryption keys are configured", keyID)
+	}
+	kek, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encrypted under key %s, which is not configured", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unseal(kek, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key under key %s: %w", keyID, err)
+	}
+	return key, nil
+}
+
+// dataKey returns the cipher of a record encrypted with the data key
+// wrapped in the key keyID
+func (k *keyring) dataKey(keyID, wrapped string) (cipher.AEAD, error) {
+	key, err := k.unwrap(keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// rewrap wraps a data key in the current key, leaving it as it is when it
+// is already
+func (k *keyring) rewrap(keyID, wrapped string) (string, string, error) {
+	if keyID == k.current {
+		return keyID, wrapped, nil
+	}
+	key, err := k.unwrap(keyID, wrapped)
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := seal(k.keys[k.current], key)
+	if err != nil {
+		return "", "", err
+	}
+	return k.current, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// rewrapFunc returns the key id and wrapped data key a record should have
+// instead of the given ones, the same ones to leave it alone
+type rewrapFunc func(keyID, dataKey string) (string, string, error)
+
+// rewrapFields applies rewrap to the key fields of a record, reporting
+// whether they changed
+func rewrapFields(rewrap rewrapFunc, keyID, dataKey *string) (bool, error) {
+	if *keyID == "" {
+		return false, nil
+	}
+	id, key, err := rewrap(*keyID, *dataKey)
+	if err != nil {
+		return false, err
+	}
+	if id == *keyID {
+		return false, nil
+	}
+	*keyID, *dataKey = id, key
+	return true, nil
+}
+
+// encryptText returns text sealed with aead and base64 encoded. Empty
+// texts stay empty.
+func encryptText(aead cipher.AEAD, text string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	sealed, err := seal(aead, []byte(text))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptText is the reverse of encryptText
+func decryptText(aead cipher.AEAD, text string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", err
+	}
+	plain, err := unseal(aead, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// cryptStore encrypts the texts of pastes, diffs and bodies on their way
+// into the store it wraps and decrypts them on the way out. Every record
+// gets a data key of its own, stored wrapped in the current key under its
+// id, so rotating keys only rewraps data keys. Records written without a
+// key, before encryption was configured, read back as they are.
+type cryptStore struct {
+	migrationStore
+	keys *keyring
+}
+
+// newCryptStore wraps store with keys, which may be nil to write plain
+// text
+func newCryptStore(store migrationStore, keys *keyring) *cryptStore {
+	return &cryptStore{migrationStore: store, keys: keys}
+}
+
+// encrypt encrypts the non-empty texts in place under a new data key and
+// returns its key id and wrapped form, both empty when nothing was
+// encrypted
+func (c *cryptStore) encrypt(texts ...*string) (keyID, wrapped string, err error) {
+	if c.keys == nil || allEmpty(texts) {
+		return "", "", nil
+	}
+	keyID, wrapped, aead, err := c.keys.newDataKey()
+	if err != nil {
+		return "", "", err
+	}
+	for _, text := range texts {
+		if *text, err = encryptText(aead, *text); err != nil {
+			return "", "", err
+		}
+	}
+	return keyID, wrapped, nil
+}
+
+func allEmpty(texts []*string) bool {
+	for _, text := range texts {
+		if *text != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// decrypt is the reverse of encrypt. Texts without a key id are plain
+// already.
+func (c *cryptStore) decrypt(keyID, wrapped string, texts ...*string) error {
+	if keyID == "" {
+		return nil
+	}
+	aead, err := c.keys.dataKey(keyID, wrapped)
+	if err != nil {
+		return err
+	}
+	for _, text := range texts {
+		if *text, err = decryptText(aead, *text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptPaste returns a copy of paste to store, with its text encrypted
+func (c *cryptStore) encryptPaste(paste *Paste) (*Paste, error) {
+	stored := *paste
+	var err error
+	stored.KeyID, stored.DataKey, err = c.encrypt(&stored.Text)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// decryptPaste turns a stored paste back into plain text in place
+func (c *cryptStore) decryptPaste(paste *Paste) error {
+	if err := c.decrypt(paste.KeyID, paste.DataKey, &paste.Text); err != nil {
+		return fmt.Errorf("paste %s: %w", paste.PK, err)
+	}
+	paste.KeyID, paste.DataKey = "", ""
+	return nil
+}
+
+// encryptDiff returns a copy of diff to store, with both texts encrypted
+// under one data key
+func (c *cryptStore) encryptDiff(diff *Diff) (*Diff, error) {
+	stored := *diff
+	var err error
+	stored.KeyID, stored.DataKey, err = c.encrypt(&stored.OldText, &stored.NewText)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// decryptDiff turns a stored diff back into plain text in place
+func (c *cryptStore) decryptDiff(diff *Diff) error {
+	if err := c.decrypt(diff.KeyID, diff.DataKey, &diff.OldText, &diff.NewText); err != nil {
+		return fmt.Errorf("diff %s: %w", diff.PK, err)
+	}
+	diff.KeyID, diff.DataKey = "", ""
+	return nil
+}
+
+func (c *cryptStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := c.migrationStore.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return paste, c.decryptPaste(paste)
+}
+
+func (c *cryptStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := c.migrationStore.TakePaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return paste, c.decryptPaste(paste)
+}
+
+// AddPaste seals the text of paste under a fresh data key. A text emptied
+// by the layers above, such as a shared body, is stored without one.
+func (c *cryptStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	stored, err := c.encryptPaste(paste)
+	if err != nil {
+		return "", err
+	}
+	id, err := c.migrationStore.AddPaste(ctx, stored)
+	if err != nil {
+		return "", err
+	}
+	paste.PK, paste.SK, paste.Revision = stored.PK, stored.SK, stored.Revision
+	return id, nil
+}
+
+// UpdatePaste seals the new revision under a data key of its own, so each
+// revision can be rewrapped or read without the others
+func (c *cryptStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	stored, err := c.encryptPaste(paste)
+	if err != nil {
+		return err
+	}
+	if err := c.migrationStore.UpdatePaste(ctx, stored); err != nil {
+		return err
+	}
+	paste.SK, paste.Revision = stored.SK, stored.Revision
+	return nil
+}
+
+func (c *cryptStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	revisions, err := c.migrationStore.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, paste := range revisions {
+		if err := c.decryptPaste(paste); err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+func (c *cryptStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	paste, err := c.migrationStore.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return paste, c.decryptPaste(paste)
+}
+
+func (c *cryptStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	diff, err := c.migrationStore.GetDiff(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return diff, c.decryptDiff(diff)
+}
+
+// AddDiff seals both texts of diff under the same data key
+func (c *cryptStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
+	stored, err := c.encryptDiff(diff)
+	if err != nil {
+		return "", err
+	}
+	id, err := c.migrationStore.AddDiff(ctx, stored)
+	if err != nil {
+		return "", err
+	}
+	diff.PK, diff.SK = stored.PK, stored.SK
+	return id, nil
+}
+
+// AcquireBody encrypts body as AddPaste would a paste. When the body is
+// there already it is kept under its own data key.
+func (c *cryptStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	stored := *body
+	var err error
+	stored.KeyID, stored.DataKey, err = c.encrypt(&stored.Text)
+	if err != nil {
+		return false, err
+	}
+	return c.migrationStore.AcquireBody(ctx, &stored)
+}
+
+func (c *cryptStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	body, err := c.migrationStore.GetBody(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decrypt(body.KeyID, body.DataKey, &body.Text); err != nil {
+		return nil, fmt.Errorf("body %s: %w", hash, err)
+	}
+	body.KeyID, body.DataKey = "", ""
+	return body, nil
+}
+
+// ScanPastes hands fn the revisions of every paste decrypted
+func (c *cryptStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	return c.migrationStore.ScanPastes(ctx, func(revisions []*Paste) error {
+		for _, paste := range revisions {
+			if err := c.decryptPaste(paste); err != nil {
+				return err
+			}
+		}
+		return fn(revisions)
+	})
+}
+
+// ScanDiffs hands fn every diff decrypted
+func (c *cryptStore) ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error {
+	return c.migrationStore.ScanDiffs(ctx, func(diff *Diff) error {
+		if err := c.decryptDiff(diff); err != nil {
+			return err
+		}
+		return fn(diff)
+	})
+}
+
+// ImportPaste encrypts the revisions of a paste as AddPaste would
+func (c *cryptStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	stored := make([]*Paste, 0, len(revisions))
+	for _, paste := range revisions {
+		s, err := c.encryptPaste(paste)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, s)
+	}
+	return c.migrationStore.ImportPaste(ctx, stored)
+}
+
+// ImportDiff encrypts diff as AddDiff would
+func (c *cryptStore) ImportDiff(ctx context.Context, diff *Diff) error {
+	stored, err := c.encryptDiff(diff)
+	if err != nil {
+		return err
+	}
+	return c.migrationStore.ImportDiff(ctx, stored)
+}
+
+const rekeyUsage = `usage: pbin rekey -store <store> [-dry-run]
+
+wraps the data key of every encrypted paste, revision, diff and body in the
+current key, the first of PBIN_ENCRYPTION_KEYS or PBIN_ENCRYPTION_KEYFILE.
+The texts themselves are left as they are. Once it has run, the keys before
+the current one can be dropped. Records written before encryption was
+configured stay plain; pbin migrate to a new store encrypts them. The store
+is given as for pbin migrate.
+
+flags:
+`
+
+// cliRekey runs pbin rekey. Like pbin migrate it talks to the store
+// directly, below every layer, as only the key fields change.
+func cliRekey(args []string) error {
+	fs := flag.NewFlagSet("pbin rekey", flag.ContinueOnError)
+	spec := fs.String("store", "", "store to rekey")
+	dryRun := fs.Bool("dry-run", false, "only count the records to rewrap")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), rekeyUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *spec == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	keys, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return fmt.Errorf("set PBIN_ENCRYPTION_KEYS or PBIN_ENCRYPTION_KEYFILE")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	store, err := openBackendStore(*spec)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", *spec, err)
+	}
+	defer store.Close()
+
+	rewrap := keys.rewrap
+	stale := 0
+	if *dryRun {
+		rewrap = func(keyID, dataKey string) (string, string, error) {
+			if keyID != keys.current {
+				stale++
+			}
+			return keyID, dataKey, nil
+		}
+	}
+	n, err := store.RewrapKeys(ctx, rewrap)
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "would rewrap %d records under key %s\n", stale, keys.current)
+	} else {
+		fmt.Fprintf(os.Stderr, "rewrapped %d records under key %s\n", n, keys.current)
+	}
+	return err
+}
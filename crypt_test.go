@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey returns a keyring entry for id whose 32 bytes are all b
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+// testKeyring parses keys, failing the test if they do not parse
+func testKeyring(t *testing.T, keys ...string) *keyring {
+	t.Helper()
+	k, err := parseKeyring(strings.Join(keys, ","))
+	if err != nil {
+		t.Fatalf("parseKeyring: %v", err)
+	}
+	return k
+}
+
+func TestCryptStoreRoundTrip(t *testing.T) {
+	clearStoreEnv(t)
+	t.Setenv("PBIN_ENCRYPTION_KEYS", testKey("k1", 1))
+	m := NewMemoryStore()
+	store, err := wrapStore(m)
+	if err != nil {
+		t.Fatalf("wrapStore: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	id, err := store.AddPaste(ctx, &Paste{Text: "first secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdatePaste(ctx, &Paste{PK: id, Text: "second secret"}); err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := store.AddDiff(ctx, &Diff{OldText: "old secret", NewText: "new secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := m.pastes[id]
+	if stored.KeyID != "k1" || stored.DataKey == "" || strings.Contains(stored.Text, "secret") {
+		t.Errorf("stored paste = %+v, want its text sealed under k1", stored)
+	}
+	if rev := m.revisions[id][0]; rev.KeyID != "k1" || rev.DataKey == stored.DataKey || strings.Contains(rev.Text, "secret") {
+		t.Errorf("stored revision = %+v, want its text sealed under a data key of its own", rev)
+	}
+	if diff := m.diffs[diffID]; diff.KeyID != "k1" || strings.Contains(diff.OldText+diff.NewText, "secret") {
+		t.Errorf("stored diff = %+v, want its texts sealed under k1", diff)
+	}
+
+	paste, err := store.GetPaste(ctx, id)
+	if err != nil || paste.Text != "second secret" || paste.KeyID != "" {
+		t.Errorf("GetPaste = %+v, %v, want the plain text", paste, err)
+	}
+	revisions, err := store.ListRevisions(ctx, id)
+	if err != nil || len(revisions) != 2 || revisions[0].Text != "first secret" {
+		t.Errorf("ListRevisions = %v, want both revisions in plain text", err)
+	}
+	diff, err := store.GetDiff(ctx, diffID)
+	if err != nil || diff.OldText != "old secret" || diff.NewText != "new secret" {
+		t.Errorf("GetDiff = %+v, %v, want the plain texts", diff, err)
+	}
+}
+
+func TestCryptStoreNeedsTheKeyItWroteWith(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	id, err := newCryptStore(m, testKeyring(t, testKey("k1", 1))).AddPaste(ctx, &Paste{Text: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		keys *keyring
+		want string
+	}{
+		{"no keys", nil, "encrypted under key k1, but no encryption keys are configured"},
+		{"other key id", testKeyring(t, testKey("k2", 2)), "encrypted under key k1, which is not configured"},
+		{"wrong key", testKeyring(t, testKey("k1", 2)), "unwrapping data key under key k1"},
+	} {
+		_, err := newCryptStore(m, tc.keys).GetPaste(ctx, id)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: GetPaste = %v, want an error saying %q", tc.name, err, tc.want)
+		}
+	}
+
+	// plain records written before encryption was configured still read
+	plainID, err := m.AddPaste(ctx, &Paste{Text: "plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paste, err := newCryptStore(m, testKeyring(t, testKey("k1", 1))).GetPaste(ctx, plainID)
+	if err != nil || paste.Text != "plain" {
+		t.Errorf("GetPaste of a plain record = %v, want it as it is", err)
+	}
+}
+
+func TestRewrapKeysMovesRecordsToTheNewKey(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	old := newCryptStore(m, testKeyring(t, testKey("k1", 1)))
+
+	id, err := old.AddPaste(ctx, &Paste{Text: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.UpdatePaste(ctx, &Paste{PK: id, Text: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := old.AddDiff(ctx, &Diff{OldText: "a", NewText: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := contentHash("body")
+	if _, err := old.AcquireBody(ctx, &Body{Hash: hash, Text: "body"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := testKeyring(t, testKey("k2", 2), testKey("k1", 1))
+	n, err := m.RewrapKeys(ctx, rotated.rewrap)
+	if err != nil || n != 4 {
+		t.Fatalf("RewrapKeys = %d, %v, want 4 records rewrapped", n, err)
+	}
+	if n, err := m.RewrapKeys(ctx, rotated.rewrap); err != nil || n != 0 {
+		t.Errorf("RewrapKeys again = %d, %v, want nothing left to rewrap", n, err)
+	}
+
+	// k1 can be dropped now
+	current := newCryptStore(m, testKeyring(t, testKey("k2", 2)))
+	revisions, err := current.ListRevisions(ctx, id)
+	if err != nil || len(revisions) != 2 || revisions[0].Text != "one" || revisions[1].Text != "two" {
+		t.Errorf("ListRevisions under k2 alone = %v, want both revisions", err)
+	}
+	if diff, err := current.GetDiff(ctx, diffID); err != nil || diff.OldText != "a" || diff.NewText != "b" {
+		t.Errorf("GetDiff under k2 alone = %v, want its texts", err)
+	}
+	if body, err := current.GetBody(ctx, hash); err != nil || body.Text != "body" {
+		t.Errorf("GetBody under k2 alone = %v, want its text", err)
+	}
+}
+
+func TestCLIRekey(t *testing.T) {
+	clearStoreEnv(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "pbin.sqlite")
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := newCryptStore(s, testKeyring(t, testKey("k1", 1))).AddPaste(ctx, &Paste{Text: "secret"})
+	s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PBIN_ENCRYPTION_KEYS", testKey("k2", 2)+","+testKey("k1", 1))
+	if err := cliRekey([]string{"-store", "sqlite:" + path, "-dry-run"}); err != nil {
+		t.Fatalf("pbin rekey -dry-run: %v", err)
+	}
+	if err := cliRekey([]string{"-store", "sqlite:" + path}); err != nil {
+		t.Fatalf("pbin rekey: %v", err)
+	}
+
+	s, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	paste, err := newCryptStore(s, testKeyring(t, testKey("k2", 2))).GetPaste(ctx, id)
+	if err != nil || paste.Text != "secret" {
+		t.Errorf("GetPaste under k2 alone after rekey = %v, want the text", err)
+	}
+}
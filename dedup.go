@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// bodyStore keeps Bodies, counting the revisions that point at each
+type bodyStore interface {
+	// AcquireBody stores body unless one with its hash is already there
+	// and counts one more reference to it, expiring at body.ExpiresAt.
+	// created reports whether body was stored.
+	AcquireBody(ctx context.Context, body *Body) (created bool, err error)
+	// GetBody retrieves the body with the given hash
+	GetBody(ctx context.Context, hash string) (*Body, error)
+	// ReleaseBody drops the reference acquired with expiresAt, deleting
+	// the body when none are left and otherwise leaving it to expire with
+	// the latest of the others
+	ReleaseBody(ctx context.Context, hash string, expiresAt int64) error
+}
+
+// dedupMinBytes is the size from which paste texts are kept as shared
+// bodies. Zero turns deduplication off.
+var dedupMinBytes = envInt64("PBIN_DEDUP_MIN_BYTES", 1024)
+
+// contentHash is the hex SHA-256 of text, under which its body is kept
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashPattern matches what contentHash returns
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// dedupStore keeps large paste texts once, as a Body under their hash,
+// however many pastes and revisions hold them. Every revision pointing at
+// a body counts as a reference, released when the paste is deleted or
+// burned. Revisions that expire are not counted down; instead every
+// reference keeps its expiry and a body expires with the last of those
+// still held, so an expired revision never keeps a deleted one's text.
+type dedupStore struct {
+	migrationStore
+	minBytes int64
+}
+
+// newDedupStore wraps store with the configured threshold
+func newDedupStore(store migrationStore) *dedupStore {
+	return &dedupStore{migrationStore: store, minBytes: dedupMinBytes}
+}
+
+// shareable reports whether the text of paste may be kept as a shared
+// body. Pastes behind a password, burned after reading or encrypted by
+// their client keep their text to themselves, so that it can neither be
+// found with /api/body nor reused by its hash.
+func shareable(paste *Paste) bool {
+	return paste.PasswordHash == "" && !paste.BurnAfterReading && paste.Kind == ""
+}
+
+// sharePaste returns a copy of paste to store, with its text moved to a
+// shared body when it is large and shareable
+func (d *dedupStore) sharePaste(ctx context.Context, paste *Paste) (*Paste, error) {
+	stored := *paste
+	if d.minBytes <= 0 || int64(len(paste.Text)) < d.minBytes || !shareable(paste) {
+		return &stored, nil
+	}
+	hash := contentHash(paste.Text)
+	created, err := d.migrationStore.AcquireBody(ctx, &Body{Hash: hash, Text: paste.Text, ExpiresAt: paste.ExpiresAt})
+	if err != nil {
+		return nil, fmt.Errorf("storing paste body: %w", err)
+	}
+	if !created {
+		zap.L().Sugar().Infow("paste_body_deduplicated", "hash", hash, "saved_bytes", len(paste.Text))
+	}
+	stored.Text, stored.BodyHash = "", hash
+	return &stored, nil
+}
+
+// fetchPaste puts the text of a paste kept as a shared body back in place
+func (d *dedupStore) fetchPaste(ctx context.Context, paste *Paste) error {
+	if paste.BodyHash == "" {
+		return nil
+	}
+	body, err := d.migrationStore.GetBody(ctx, paste.BodyHash)
+	if err != nil {
+		return fmt.Errorf("paste %s: %w", paste.PK, err)
+	}
+	paste.Text, paste.BodyHash = body.Text, ""
+	return nil
+}
+
+// releaseBodies drops the references of the given revisions, leaving a
+// body it cannot release to expire
+func (d *dedupStore) releaseBodies(ctx context.Context, revisions ...*Paste) {
+	for _, paste := range revisions {
+		if paste.BodyHash == "" {
+			continue
+		}
+		if err := d.migrationStore.ReleaseBody(ctx, paste.BodyHash, paste.ExpiresAt); err != nil {
+			zap.L().Sugar().Warnw("failed_to_release_body", "hash", paste.BodyHash, "error", err)
+		}
+	}
+}
+
+func (d *dedupStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := d.migrationStore.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return paste, d.fetchPaste(ctx, paste)
+}
+
+// TakePaste reads the revisions of a burn-after-reading paste before
+// burning it, as their references go with them
+func (d *dedupStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := d.migrationStore.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !paste.BurnAfterReading {
+		return paste, d.fetchPaste(ctx, paste)
+	}
+
+	revisions, err := d.migrationStore.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	paste, err = d.migrationStore.TakePaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.fetchPaste(ctx, paste); err != nil {
+		return nil, err
+	}
+	d.releaseBodies(ctx, revisions...)
+	return paste, nil
+}
+
+// GetBody answers only while texts are shared, so that clients are not
+// told to create pastes by a hash that new pastes no longer use
+func (d *dedupStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	if d.minBytes <= 0 {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrNotFound)
+	}
+	return d.migrationStore.GetBody(ctx, hash)
+}
+
+// AddPaste stores a large text once as a shared body, counting the new
+// paste as one more reference to it
+func (d *dedupStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	stored, err := d.sharePaste(ctx, paste)
+	if err != nil {
+		return "", err
+	}
+	id, err := d.migrationStore.AddPaste(ctx, stored)
+	if err != nil {
+		d.releaseBodies(context.Background(), stored)
+		return "", err
+	}
+	paste.PK, paste.SK, paste.Revision = stored.PK, stored.SK, stored.Revision
+	return id, nil
+}
+
+// UpdatePaste shares the text of the new revision on its own. Earlier
+// revisions keep their references until the paste goes.
+func (d *dedupStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	stored, err := d.sharePaste(ctx, paste)
+	if err != nil {
+		return err
+	}
+	if err := d.migrationStore.UpdatePaste(ctx, stored); err != nil {
+		d.releaseBodies(context.Background(), stored)
+		return err
+	}
+	paste.SK, paste.Revision = stored.SK, stored.Revision
+	return nil
+}
+
+func (d *dedupStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	revisions, err := d.migrationStore.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, paste := range revisions {
+		if err := d.fetchPaste(ctx, paste); err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+func (d *dedupStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	paste, err := d.migrationStore.GetRevision(ctx, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	return paste, d.fetchPaste(ctx, paste)
+}
+
+// DeletePaste releases the bodies of every revision once the paste is gone
+func (d *dedupStore) DeletePaste(ctx context.Context, id string) error {
+	// an expired or burned paste holds no references any more
+	revisions, _ := d.migrationStore.ListRevisions(ctx, id)
+	if err := d.migrationStore.DeletePaste(ctx, id); err != nil {
+		return err
+	}
+	d.releaseBodies(ctx, revisions...)
+	return nil
+}
+
+func (d *dedupStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	return d.migrationStore.ScanPastes(ctx, func(revisions []*Paste) error {
+		for _, paste := range revisions {
+			// the body of an expired paste may be swept already
+			if err := d.fetchPaste(ctx, paste); err != nil && !expired(paste.ExpiresAt, time.Now()) {
+				return err
+			}
+		}
+		return fn(revisions)
+	})
+}
+
+func (d *dedupStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	stored := make([]*Paste, 0, len(revisions))
+	// the current revision, last, decides for the earlier ones
+	share := len(revisions) > 0 && shareable(revisions[len(revisions)-1])
+	for _, paste := range revisions {
+		if !share {
+			s := *paste
+			stored = append(stored, &s)
+			continue
+		}
+		s, err := d.sharePaste(ctx, paste)
+		if err != nil {
+			d.releaseBodies(context.Background(), stored...)
+			return err
+		}
+		stored = append(stored, s)
+	}
+	if err := d.migrationStore.ImportPaste(ctx, stored); err != nil {
+		d.releaseBodies(context.Background(), stored...)
+		return err
+	}
+	return nil
+}
+
+// storedText returns the text kept under hash, for creating a paste by
+// hash. A hash that is not stored is the client's mistake.
+func storedText(ctx context.Context, store DataStore, hash string) (string, error) {
+	bodies, ok := store.(bodyStore)
+	if !hashPattern.MatchString(hash) || !ok {
+		return "", &invalidRequestError{"no text with hash " + hash + " is stored"}
+	}
+	body, err := bodies.GetBody(ctx, hash)
+	if errors.Is(err, ErrNotFound) {
+		return "", &invalidRequestError{"no text with hash " + hash + " is stored"}
+	}
+	if err != nil {
+		return "", err
+	}
+	return body.Text, nil
+}
+
+// handleBody answers GET and HEAD /api/body?hash=<sha256> with 200 when a
+// paste with that text is stored, so a client can create another by hash
+// rather than upload a large text again, and 404 otherwise. Texts below
+// PBIN_DEDUP_MIN_BYTES, those of pastes that are not shareable and any
+// while encryption at rest is on are not kept by hash and are never found.
+func handleBody(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" && request.Method != "HEAD" {
+			writeMethodNotAllowed(writer, request)
+			return
+		}
+		hash := request.URL.Query().Get("hash")
+		if !hashPattern.MatchString(hash) {
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "hash must be a hex SHA-256")
+			return
+		}
+		bodies, ok := store.(bodyStore)
+		if !ok {
+			writeError(writer, http.StatusNotFound, errCodeNotFound, "body not found")
+			return
+		}
+		body, err := bodies.GetBody(request.Context(), hash)
+		if err != nil {
+			writeStoreError(writer, err, "body")
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"hash": hash,
+			"size": len(body.Text),
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupKeepsPrivateTextsToThemselves(t *testing.T) {
+	store := newTestStore(t)
+	secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", 2048)))
+
+	for _, tc := range []struct {
+		name, fields, text string
+		shared             bool
+	}{
+		{"public", ``, strings.Repeat("a", 2048), true},
+		{"password", `,"password":"hunter2"`, strings.Repeat("b", 2048), false},
+		{"burn", `,"burn":true`, strings.Repeat("c", 2048), false},
+		{"client encrypted", `,"kind":"` + pasteKindEncrypted + `"`, secret, false},
+	} {
+		createTestPaste(t, store, fmt.Sprintf(`{"text":%q%s}`, tc.text, tc.fields))
+		hash := contentHash(tc.text)
+
+		want := http.StatusNotFound
+		if tc.shared {
+			want = http.StatusOK
+		}
+		if resp := serve(handleBody(store), "GET", "/api/body?hash="+hash, ""); resp.StatusCode != want {
+			t.Errorf("%s: GET /api/body = %d, want %d", tc.name, resp.StatusCode, want)
+		}
+		if tc.shared {
+			continue
+		}
+		resp := serve(handlePaste(store), "POST", "/api/paste", `{"hash":"`+hash+`"}`)
+		if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || strings.Contains(body, tc.text) {
+			t.Errorf("%s: POST by hash = %d %q, want %d", tc.name, resp.StatusCode, body, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDedupIsOffWithEncryptionKeys(t *testing.T) {
+	clearStoreEnv(t)
+	t.Setenv("PBIN_ENCRYPTION_KEYS", "k1:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	m := NewMemoryStore()
+	store, err := wrapStore(m)
+	if err != nil {
+		t.Fatalf("wrapStore: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	text := strings.Repeat("a", 2048)
+	id, err := store.AddPaste(ctx, &Paste{Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.bodies) != 0 {
+		t.Errorf("stored %d bodies, want none", len(m.bodies))
+	}
+	if _, err := store.GetBody(ctx, contentHash(text)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetBody = %v, want ErrNotFound", err)
+	}
+	paste, err := store.GetPaste(ctx, id)
+	if err != nil || paste.Text != text {
+		t.Errorf("GetPaste = %v, want the text back", err)
+	}
+}
+
+func TestDedupDeletingTheLastLiveReferenceFreesTheText(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	text := strings.Repeat("a", 2048)
+
+	kept, err := store.AddPaste(ctx, &Paste{Text: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// already expired, but not yet swept
+	if _, err := store.AddPaste(ctx, &Paste{Text: text, ExpiresAt: time.Now().Add(-time.Minute).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeletePaste(ctx, kept); err != nil {
+		t.Fatal(err)
+	}
+
+	// the text expires with the paste left holding it
+	hash := contentHash(text)
+	if resp := serve(handleBody(store), "GET", "/api/body?hash="+hash, ""); resp.StatusCode != http.StatusGone {
+		t.Errorf("GET /api/body after deleting the live paste = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+	resp := serve(handlePaste(store), "POST", "/api/paste", `{"hash":"`+hash+`"}`)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || strings.Contains(body, text) {
+		t.Errorf("POST by hash after deleting the live paste = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// TestStoresExpireBodiesWithTheirLastReference checks that every backend
+// keeps an expiry per reference, so a body outlives neither its references
+// nor a released one that never expired
+func TestStoresExpireBodiesWithTheirLastReference(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		open func(t *testing.T) bodyStore
+	}{
+		{"memory", func(t *testing.T) bodyStore { return NewMemoryStore() }},
+		{"bolt", func(t *testing.T) bodyStore { return newTestBoltStore(t) }},
+		{"sqlite", func(t *testing.T) bodyStore { return newTestSQLiteStore(t) }},
+		{"dynamo", func(t *testing.T) bodyStore {
+			s, _ := newTestDynamoStore(t)
+			return s
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := tc.open(t)
+			past := time.Now().Add(-time.Minute).Unix()
+
+			if _, err := s.AcquireBody(ctx, &Body{Hash: "h", Text: "shared"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.AcquireBody(ctx, &Body{Hash: "h", Text: "shared", ExpiresAt: past}); err != nil {
+				t.Fatal(err)
+			}
+			if body, err := s.GetBody(ctx, "h"); err != nil || body.Refs != 2 || body.ExpiresAt != 0 {
+				t.Errorf("GetBody = %+v, %v, want 2 refs never expiring", body, err)
+			}
+
+			if err := s.ReleaseBody(ctx, "h", 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GetBody(ctx, "h"); !errors.Is(err, ErrExpired) && !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetBody with only an expired reference left = %v, want it gone", err)
+			}
+			if err := s.ReleaseBody(ctx, "h", past); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GetBody(ctx, "h"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetBody after the last release = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
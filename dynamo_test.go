@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamo is an in-memory stand-in for the DynamoDB calls DynamoStore
+// makes. It understands the condition and update expressions the store
+// writes, and nothing more; other calls panic on the nil interface.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu     sync.Mutex
+	table  string
+	status string
+	ttl    string
+	items  map[fakeKey]map[string]*dynamodb.AttributeValue
+	// calls names the table level calls in the order they were made
+	calls []string
+	// waitErr, when set, is what waiting for the table returns
+	waitErr error
+	// beforeWrite, when set, runs once before the next write, standing in
+	// for another client that gets in between a read and a write
+	beforeWrite func()
+	// staleReads counts the item reads and queries made without
+	// ConsistentRead, which DynamoDB may answer from before a recent write
+	staleReads int
+}
+
+type fakeKey struct{ pk, sk string }
+
+// newFakeDynamo returns a fake with no table
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{items: make(map[fakeKey]map[string]*dynamodb.AttributeValue)}
+}
+
+// newTestDynamoStore returns a DynamoStore on a fake whose table it created
+func newTestDynamoStore(t *testing.T) (*DynamoStore, *fakeDynamo) {
+	t.Helper()
+	fake := newFakeDynamo()
+	d, err := newDynamoStore(fake, "pbin")
+	if err != nil {
+		t.Fatalf("newDynamoStore: %v", err)
+	}
+	return d, fake
+}
+
+func (f *fakeDynamo) call(name string) {
+	f.mu.Lock()
+	f.calls = append(f.calls, name)
+	f.mu.Unlock()
+}
+
+// write runs beforeWrite, if set, and then takes the lock for a write
+func (f *fakeDynamo) write() {
+	f.mu.Lock()
+	hook := f.beforeWrite
+	f.beforeWrite = nil
+	f.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+	f.mu.Lock()
+}
+
+// checkTable fails calls made before the table is ACTIVE, as DynamoDB does
+func (f *fakeDynamo) checkTable(name *string) error {
+	if aws.StringValue(name) != f.table || f.status != dynamodb.TableStatusActive {
+		return awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found", nil)
+	}
+	return nil
+}
+
+// item returns the stored item under key, or nil
+func (f *fakeDynamo) item(key map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	return f.items[fakeKey{aws.StringValue(key["PK"].S), aws.StringValue(key["SK"].S)}]
+}
+
+func (f *fakeDynamo) put(item map[string]*dynamodb.AttributeValue) {
+	f.items[fakeKey{aws.StringValue(item["PK"].S), aws.StringValue(item["SK"].S)}] = copyItem(item)
+}
+
+func (f *fakeDynamo) remove(key map[string]*dynamodb.AttributeValue) {
+	delete(f.items, fakeKey{aws.StringValue(key["PK"].S), aws.StringValue(key["SK"].S)})
+}
+
+// copyItem copies the attributes of item so the caller and the fake never
+// share them
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	c := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		av := *v
+		c[k] = &av
+	}
+	return c
+}
+
+var conditionFailed = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+
+var (
+	existsPattern     = regexp.MustCompile(`^(attribute_exists|attribute_not_exists)\((\S+)\)$`)
+	beginsWithPattern = regexp.MustCompile(`^begins_with\((\S+), (\S+)\)$`)
+	comparePattern    = regexp.MustCompile(`^(\S+) (=|<>|<=|<|>=|>) (\S+)$`)
+)
+
+// operand resolves a #name, :value or attribute name of an expression
+func operand(s string, item map[string]*dynamodb.AttributeValue, names map[string]*string, values map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if strings.HasPrefix(s, ":") {
+		return values[s]
+	}
+	if strings.HasPrefix(s, "#") {
+		s = aws.StringValue(names[s])
+	}
+	return item[s]
+}
+
+// attributeName resolves a #name or attribute name of an expression
+func attributeName(s string, names map[string]*string) string {
+	if strings.HasPrefix(s, "#") {
+		return aws.StringValue(names[s])
+	}
+	return s
+}
+
+// compare orders two numbers or two strings
+func compare(a, b *dynamodb.AttributeValue) (int, error) {
+	switch {
+	case a.N != nil && b.N != nil:
+		x, err := strconv.ParseFloat(*a.N, 64)
+		if err != nil {
+			return 0, err
+		}
+		y, err := strconv.ParseFloat(*b.N, 64)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), nil
+	case a.BOOL != nil && b.BOOL != nil:
+		if *a.BOOL == *b.BOOL {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	return 0, fmt.Errorf("fake: cannot compare %v and %v", a, b)
+}
+
+// holds evaluates a condition made of clauses joined by AND against item,
+// which is nil when there is none
+func holds(expr *string, item map[string]*dynamodb.AttributeValue, names map[string]*string, values map[string]*dynamodb.AttributeValue) (bool, error) {
+	if expr == nil {
+		return true, nil
+	}
+	for _, clause := range strings.Split(*expr, " AND ") {
+		clause = strings.TrimSpace(clause)
+		if m := existsPattern.FindStringSubmatch(clause); m != nil {
+			_, ok := item[attributeName(m[2], names)]
+			if ok != (m[1] == "attribute_exists") {
+				return false, nil
+			}
+			continue
+		}
+		if m := beginsWithPattern.FindStringSubmatch(clause); m != nil {
+			a, prefix := operand(m[1], item, names, values), operand(m[2], item, names, values)
+			if a == nil || a.S == nil || !strings.HasPrefix(*a.S, aws.StringValue(prefix.S)) {
+				return false, nil
+			}
+			continue
+		}
+		if m := comparePattern.FindStringSubmatch(clause); m != nil {
+			a, b := operand(m[1], item, names, values), operand(m[3], item, names, values)
+			// a comparison with a missing attribute never holds
+			if a == nil || b == nil {
+				return false, nil
+			}
+			c, err := compare(a, b)
+			if err != nil {
+				return false, err
+			}
+			ok := map[string]bool{"=": c == 0, "<>": c != 0, "<": c < 0, "<=": c <= 0, ">": c > 0, ">=": c >= 0}[m[2]]
+			if !ok {
+				return false, nil
+			}
+			continue
+		}
+		return false, fmt.Errorf("fake: unsupported condition %q", clause)
+	}
+	return true, nil
+}
+
+var (
+	addPattern = regexp.MustCompile(`^ADD (\S+) (\S+)$`)
+	setPattern = regexp.MustCompile(`^(\S+) = (\S+)$`)
+)
+
+// update applies an ADD or SET update expression to item and returns the
+// attributes it changed
+func update(expr string, item map[string]*dynamodb.AttributeValue, names map[string]*string, values map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	changed := make(map[string]*dynamodb.AttributeValue)
+	if m := addPattern.FindStringSubmatch(expr); m != nil {
+		name := attributeName(m[1], names)
+		n, err := strconv.ParseInt(aws.StringValue(values[m[2]].N), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if old, ok := item[name]; ok {
+			o, err := strconv.ParseInt(aws.StringValue(old.N), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			n += o
+		}
+		item[name] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+		changed[name] = item[name]
+		return changed, nil
+	}
+	if !strings.HasPrefix(expr, "SET ") {
+		return nil, fmt.Errorf("fake: unsupported update %q", expr)
+	}
+	for _, assignment := range strings.Split(strings.TrimPrefix(expr, "SET "), ", ") {
+		m := setPattern.FindStringSubmatch(assignment)
+		if m == nil {
+			return nil, fmt.Errorf("fake: unsupported update %q", expr)
+		}
+		name := attributeName(m[1], names)
+		v := *values[m[2]]
+		item[name] = &v
+		changed[name] = item[name]
+	}
+	return changed, nil
+}
+
+func (f *fakeDynamo) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	f.call("DescribeTable")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status == "" || aws.StringValue(input.TableName) != f.table {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found", nil)
+	}
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		TableName:   input.TableName,
+		TableStatus: aws.String(f.status),
+	}}, nil
+}
+
+func (f *fakeDynamo) CreateTableWithContext(ctx aws.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	f.call("CreateTable")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != "" {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, "Table already exists", nil)
+	}
+	var schema []string
+	for _, k := range input.KeySchema {
+		schema = append(schema, aws.StringValue(k.AttributeName)+" "+aws.StringValue(k.KeyType))
+	}
+	if strings.Join(schema, ", ") != "PK HASH, SK RANGE" {
+		return nil, fmt.Errorf("fake: unexpected key schema %v", schema)
+	}
+	f.table = aws.StringValue(input.TableName)
+	f.status = dynamodb.TableStatusCreating
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+// WaitUntilTableExistsWithContext stands in for the SDK waiter, which polls
+// DescribeTable until the table is ACTIVE
+func (f *fakeDynamo) WaitUntilTableExistsWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.WaiterOption) error {
+	f.call("WaitUntilTableExists")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.waitErr != nil {
+		return f.waitErr
+	}
+	if f.status == "" {
+		return awserr.New(request.WaiterResourceNotReadyErrorCode, "exceeded wait attempts", nil)
+	}
+	f.status = dynamodb.TableStatusActive
+	return nil
+}
+
+func (f *fakeDynamo) DescribeTimeToLiveWithContext(ctx aws.Context, input *dynamodb.DescribeTimeToLiveInput, opts ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	f.call("DescribeTimeToLive")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkTable(input.TableName); err != nil {
+		return nil, err
+	}
+	status := dynamodb.TimeToLiveStatusDisabled
+	if f.ttl != "" {
+		status = dynamodb.TimeToLiveStatusEnabled
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &dynamodb.TimeToLiveDescription{
+		TimeToLiveStatus: aws.String(status),
+	}}, nil
+}
+
+func (f *fakeDynamo) UpdateTimeToLiveWithContext(ctx aws.Context, input *dynamodb.UpdateTimeToLiveInput, opts ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	f.call("UpdateTimeToLive")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkTable(input.TableName); err != nil {
+		return nil, err
+	}
+	if f.ttl != "" {
+		return nil, awserr.New("ValidationException", "TimeToLive is already enabled", nil)
+	}
+	f.ttl = aws.StringValue(input.TimeToLiveSpecification.AttributeName)
+	return &dynamodb.UpdateTimeToLiveOutput{}, nil
+}
+
+func (f *fakeDynamo) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.checkTable(input.TableName); err != nil {
+		return nil, err
+	}
+	if !aws.BoolValue(input.ConsistentRead) {
+		f.staleReads++
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(f.item(input.Key))}, nil
+}
+
+func (f *fakeDynamo) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.write()
+	defer f.mu.Unlock()
+	if err := f.checkTable(input.TableName); err != nil {
+		return nil, err
+	}
+	old := f.item(input.Item)
+	ok, err := holds(input.ConditionExpression, old, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed
+	}
+	f.put(input.Item)
+	out := &dynamodb.PutItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+func (f *fakeDynamo) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	f.write()
+	defer f.mu.Unlock()
+	if err := f.checkTable(input.TableName); err != nil {
+		return nil, err
+	}
+	old := f.item(input.Key)
+	ok, err := holds(input.ConditionExpression, old, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed
+	}
+	item := copyItem(old)
+	if item == nil {
+		item = copyItem(input.Key)
+	}
+	changed, err := update(aws.StringValue(input.UpdateExpression), item, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	f.put(item)
+	out := &dynamodb.UpdateItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueUpdatedNew {
+		out.Attributes = copyItem(changed)
+	}
+	return out, nil
+}
+
+func (f *fakeDynamo) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.write()
+	defer f.mu.Unlock()
+	if err := f.checkTable(input.TableName); err != nil {
+		return nil, err
+	}
+	ok, err := holds(input.ConditionExpression, f.item(input.Key), input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed
+	}
+	f.remove(input.Key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// TransactWriteItemsWithContext checks the condition of every item first
+// and, only if all hold, applies the writes. A failed condition cancels the
+// transaction with a reason per item, as DynamoDB does.
+func (f *fakeDynamo) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.write()
+	defer f.mu.Unlock()
+
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	canceled := false
+	for i, ti := range input.TransactItems {
+		var table, condition, returnValues *string
+		var key, values map[string]*dynamodb.AttributeValue
+		var names map[string]*string
+		switch {
+		case ti.Put != nil:
+			table, condition, returnValues = ti.Put.TableName, ti.Put.ConditionExpression, ti.Put.ReturnValuesOnConditionCheckFailure
+			key, names, values = ti.Put.Item, ti.Put.ExpressionAttributeNames, ti.Put.ExpressionAttributeValues
+		case ti.ConditionCheck != nil:
+			table, condition, returnValues = ti.ConditionCheck.TableName, ti.ConditionCheck.ConditionExpression, ti.ConditionCheck.ReturnValuesOnConditionCheckFailure
+			key, names, values = ti.ConditionCheck.Key, ti.ConditionCheck.ExpressionAttributeNames, ti.ConditionCheck.ExpressionAttributeValues
+		case ti.Delete != nil:
+			table, condition, returnValues = ti.Delete.TableName, ti.Delete.ConditionExpression, ti.Delete.ReturnValuesOnConditionCheckFailure
+			key, names, values = ti.Delete.Key, ti.Delete.ExpressionAttributeNames, ti.Delete.ExpressionAttributeValues
+		default:
+			return nil, fmt.Errorf("fake: unsupported transaction item %v", ti)
+		}
+		if err := f.checkTable(table); err != nil {
+			return nil, err
+		}
+		old := f.item(key)
+		ok, err := holds(condition, old, names, values)
+		if err != nil {
+			return nil, err
+		}
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+		if !ok {
+			canceled = true
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+			if aws.StringValue(returnValues) == dynamodb.ReturnValuesOnConditionCheckFailureAllOld {
+				reasons[i].Item = copyItem(old)
+			}
+		}
+	}
+	if canceled {
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons"),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, ti := range input.TransactItems {
+		switch {
+		case ti.Put != nil:
+			f.put(ti.Put.Item)
+		case ti.Delete != nil:
+			f.remove(ti.Delete.Key)
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// QueryPagesWithContext answers the revision queries of DynamoStore.query
+// in a single page
+func (f *fakeDynamo) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	if err := f.checkTable(input.TableName); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	if aws.StringValue(input.KeyConditionExpression) != "PK = :pk AND begins_with(SK, :rev)" {
+		f.mu.Unlock()
+		return fmt.Errorf("fake: unsupported key condition %q", aws.StringValue(input.KeyConditionExpression))
+	}
+	if !aws.BoolValue(input.ConsistentRead) {
+		f.staleReads++
+	}
+	pk := aws.StringValue(input.ExpressionAttributeValues[":pk"].S)
+	prefix := aws.StringValue(input.ExpressionAttributeValues[":rev"].S)
+	var items []map[string]*dynamodb.AttributeValue
+	for key, item := range f.items {
+		if key.pk == pk && strings.HasPrefix(key.sk, prefix) {
+			items = append(items, copyItem(item))
+		}
+	}
+	f.mu.Unlock()
+
+	forward := aws.BoolValue(input.ScanIndexForward) || input.ScanIndexForward == nil
+	sort.Slice(items, func(i, j int) bool {
+		less := aws.StringValue(items[i]["SK"].S) < aws.StringValue(items[j]["SK"].S)
+		return less == forward
+	})
+	if limit := aws.Int64Value(input.Limit); limit > 0 && int64(len(items)) > limit {
+		items = items[:limit]
+	}
+	fn(&dynamodb.QueryOutput{Items: items}, true)
+	return nil
+}
+
+// ScanPagesWithContext returns the items matching the filter in a single
+// page
+func (f *fakeDynamo) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	if err := f.checkTable(input.TableName); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	for _, item := range f.items {
+		ok, err := holds(input.FilterExpression, item, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		if ok {
+			items = append(items, copyItem(item))
+		}
+	}
+	f.mu.Unlock()
+	fn(&dynamodb.ScanOutput{Items: items}, true)
+	return nil
+}
+
+// keys lists the PK and SK of every stored item, sorted
+func (f *fakeDynamo) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.items {
+		keys = append(keys, key.pk+" "+key.sk)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDynamoTableIsActiveBeforeUse(t *testing.T) {
+	d, fake := newTestDynamoStore(t)
+
+	want := []string{"DescribeTable", "CreateTable", "WaitUntilTableExists", "DescribeTimeToLive", "UpdateTimeToLive"}
+	if strings.Join(fake.calls, " ") != strings.Join(want, " ") {
+		t.Errorf("table calls %v, want %v", fake.calls, want)
+	}
+	if fake.ttl != "ExpiresAt" {
+		t.Errorf("TTL attribute %q, want ExpiresAt", fake.ttl)
+	}
+	if _, err := d.AddPaste(context.Background(), &Paste{Text: "hello"}); err != nil {
+		t.Errorf("AddPaste on the new table: %v", err)
+	}
+
+	// a restart finds the table ready and leaves it alone
+	fake.calls = nil
+	if _, err := newDynamoStore(fake, "pbin"); err != nil {
+		t.Fatalf("newDynamoStore on an existing table: %v", err)
+	}
+	want = []string{"DescribeTable", "WaitUntilTableExists", "DescribeTimeToLive"}
+	if strings.Join(fake.calls, " ") != strings.Join(want, " ") {
+		t.Errorf("table calls on restart %v, want %v", fake.calls, want)
+	}
+}
+
+func TestDynamoStoreFailsWhenTableNeverActive(t *testing.T) {
+	fake := newFakeDynamo()
+	fake.waitErr = awserr.New(request.WaiterResourceNotReadyErrorCode, "exceeded wait attempts", nil)
+	if _, err := newDynamoStore(fake, "pbin"); err == nil {
+		t.Fatal("newDynamoStore succeeded on a table that never became ACTIVE")
+	}
+	for _, call := range fake.calls {
+		if call == "DescribeTimeToLive" || call == "UpdateTimeToLive" {
+			t.Errorf("%s called before the table was ACTIVE", call)
+		}
+	}
+}
+
+func TestDynamoKeyLayout(t *testing.T) {
+	ctx := context.Background()
+	d, fake := newTestDynamoStore(t)
+	expiresAt := time.Now().Add(time.Hour).Unix()
+
+	paste, err := d.AddPaste(ctx, &Paste{PK: "my-paste", Text: "one", ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdatePaste(ctx, &Paste{PK: paste, Text: "two", ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.AddDiff(ctx, &Diff{PK: "my-diff", OldText: "a", NewText: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.AcquireBody(ctx, &Body{Hash: "abc", Text: "body"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"BODY#abc META",
+		"DIFF#my-diff META",
+		"PASTE#my-paste ID",
+		"PASTE#my-paste REV#00000001",
+		"PASTE#my-paste REV#00000002",
+	}
+	if got := fake.keys(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("stored keys\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the claim expires with the paste, and revisions keep their write time
+	// apart from the key
+	claim := fake.items[fakeKey{"PASTE#my-paste", "ID"}]
+	if got := aws.StringValue(claim["ExpiresAt"].N); got != strconv.FormatInt(expiresAt, 10) {
+		t.Errorf("claim ExpiresAt %s, want %d", got, expiresAt)
+	}
+	rev := fake.items[fakeKey{"PASTE#my-paste", "REV#00000002"}]
+	if aws.StringValue(rev["Text"].S) != "two" || aws.StringValue(rev["CreatedAt"].S) == "" {
+		t.Errorf("revision 2 item %v", rev)
+	}
+
+	got, err := d.GetPaste(ctx, paste)
+	if err != nil || got.PK != paste || got.Text != "two" || got.Revision != 2 {
+		t.Errorf("GetPaste = %+v, %v", got, err)
+	}
+}
+
+func TestDynamoConditionalConflicts(t *testing.T) {
+	ctx := context.Background()
+	d, fake := newTestDynamoStore(t)
+
+	id, err := d.AddPaste(ctx, &Paste{Text: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.AddPaste(ctx, &Paste{PK: id, Text: "again"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddPaste with a taken id = %v, want ErrConflict", err)
+	}
+	diff, err := d.AddDiff(ctx, &Diff{OldText: "a", NewText: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.AddDiff(ctx, &Diff{PK: diff}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddDiff with a taken id = %v, want ErrConflict", err)
+	}
+
+	// an edit that lands between the read and the write of another wins,
+	// and the other is told so rather than overwriting it
+	fake.beforeWrite = func() {
+		if err := d.UpdatePaste(ctx, &Paste{PK: id, Text: "first"}); err != nil {
+			t.Errorf("interleaved UpdatePaste: %v", err)
+		}
+	}
+	if err := d.UpdatePaste(ctx, &Paste{PK: id, Text: "second"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("UpdatePaste racing another edit = %v, want ErrConflict", err)
+	}
+	if got, err := d.GetPaste(ctx, id); err != nil || got.Text != "first" || got.Revision != 2 {
+		t.Errorf("GetPaste after the race = %+v, %v, want the first edit as revision 2", got, err)
+	}
+
+	// of two readers of a burn-after-reading paste only one gets the text
+	burn, err := d.AddPaste(ctx, &Paste{Text: "secret", BurnAfterReading: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.beforeWrite = func() {
+		if _, err := d.TakePaste(ctx, burn); err != nil {
+			t.Errorf("interleaved TakePaste: %v", err)
+		}
+	}
+	if _, err := d.TakePaste(ctx, burn); !errors.Is(err, ErrAlreadyViewed) {
+		t.Errorf("TakePaste racing another reader = %v, want ErrAlreadyViewed", err)
+	}
+	if _, err := d.GetPaste(ctx, burn); !errors.Is(err, ErrAlreadyViewed) {
+		t.Errorf("GetPaste after burning = %v, want ErrAlreadyViewed", err)
+	}
+}
+
+func TestDynamoTakePasteBurnsARacingEdit(t *testing.T) {
+	ctx := context.Background()
+	d, fake := newTestDynamoStore(t)
+
+	id, err := d.AddPaste(ctx, &Paste{Text: "secret", BurnAfterReading: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the edit lands between the read of revision 1 and its burning
+	fake.beforeWrite = func() {
+		if err := d.UpdatePaste(ctx, &Paste{PK: id, Text: "edited secret", BurnAfterReading: true}); err != nil {
+			t.Errorf("interleaved UpdatePaste: %v", err)
+		}
+	}
+	got, err := d.TakePaste(ctx, id)
+	if err != nil {
+		t.Fatalf("TakePaste: %v", err)
+	}
+	if got.Text != "edited secret" || got.Revision != 2 {
+		t.Errorf("TakePaste = %q revision %d, want the edit as revision 2", got.Text, got.Revision)
+	}
+	if _, err := d.GetPaste(ctx, id); !errors.Is(err, ErrAlreadyViewed) {
+		t.Errorf("GetPaste after burning = %v, want ErrAlreadyViewed", err)
+	}
+	for key, item := range fake.items {
+		if strings.HasPrefix(key.sk, dynamoRevPrefix) && item["Burned"] == nil {
+			t.Errorf("%s %s outlived the burn", key.pk, key.sk)
+		}
+	}
+}
+
+func TestDynamoUpdatePasteChecksTheRevisionItFollows(t *testing.T) {
+	ctx := context.Background()
+	d, fake := newTestDynamoStore(t)
+
+	burn, err := d.AddPaste(ctx, &Paste{Text: "secret", BurnAfterReading: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.beforeWrite = func() {
+		if _, err := d.TakePaste(ctx, burn); err != nil {
+			t.Errorf("interleaved TakePaste: %v", err)
+		}
+	}
+	if err := d.UpdatePaste(ctx, &Paste{PK: burn, Text: "too late", BurnAfterReading: true}); !errors.Is(err, ErrAlreadyViewed) {
+		t.Errorf("UpdatePaste of a paste burned in between = %v, want ErrAlreadyViewed", err)
+	}
+	if _, ok := fake.items[fakeKey{dynamoPastePrefix + burn, revisionSK(2)}]; ok {
+		t.Error("UpdatePaste wrote a revision after the paste was burned")
+	}
+
+	deleted, err := d.AddPaste(ctx, &Paste{Text: "doomed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.beforeWrite = func() {
+		if err := d.DeletePaste(ctx, deleted); err != nil {
+			t.Errorf("interleaved DeletePaste: %v", err)
+		}
+	}
+	if err := d.UpdatePaste(ctx, &Paste{PK: deleted, Text: "too late"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdatePaste of a paste deleted in between = %v, want ErrNotFound", err)
+	}
+	if _, ok := fake.items[fakeKey{dynamoPastePrefix + deleted, revisionSK(2)}]; ok {
+		t.Error("UpdatePaste wrote a revision after the paste was deleted")
+	}
+}
+
+func TestDynamoNotFound(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDynamoStore(t)
+
+	for name, err := range map[string]error{
+		"GetPaste":    func() error { _, err := d.GetPaste(ctx, "nope"); return err }(),
+		"TakePaste":   func() error { _, err := d.TakePaste(ctx, "nope"); return err }(),
+		"GetRevision": func() error { _, err := d.GetRevision(ctx, "nope", 1); return err }(),
+		"UpdatePaste": d.UpdatePaste(ctx, &Paste{PK: "nope", Text: "x"}),
+		"DeletePaste": d.DeletePaste(ctx, "nope"),
+		"GetDiff":     func() error { _, err := d.GetDiff(ctx, "nope"); return err }(),
+		"DeleteDiff":  d.DeleteDiff(ctx, "nope"),
+		"GetBody":     func() error { _, err := d.GetBody(ctx, "nope"); return err }(),
+	} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s of a missing id = %v, want ErrNotFound", name, err)
+		}
+	}
+
+	id, err := d.AddPaste(ctx, &Paste{Text: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetRevision(ctx, id, 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRevision of a missing revision = %v, want ErrNotFound", err)
+	}
+	if err := d.DeletePaste(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetPaste(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPaste after delete = %v, want ErrNotFound", err)
+	}
+	// deleting a paste frees its id
+	if _, err := d.AddPaste(ctx, &Paste{PK: id, Text: "reused"}); err != nil {
+		t.Errorf("AddPaste with a deleted paste's id: %v", err)
+	}
+}
+
+func TestDynamoReadsAreConsistent(t *testing.T) {
+	ctx := context.Background()
+	d, fake := newTestDynamoStore(t)
+
+	id, err := d.AddPaste(ctx, &Paste{Text: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdatePaste(ctx, &Paste{PK: id, Text: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := d.AddDiff(ctx, &Diff{OldText: "a", NewText: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetPaste(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetRevision(ctx, id, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ListRevisions(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	// a diff read straight after it was written must see it
+	if _, err := d.GetDiff(ctx, diffID); err != nil {
+		t.Fatal(err)
+	}
+	if fake.staleReads != 0 {
+		t.Errorf("%d reads without ConsistentRead, want none", fake.staleReads)
+	}
+}
+
+func TestDynamoImportPasteResumesOnlyItsOwnPaste(t *testing.T) {
+	ctx := context.Background()
+	d, fake := newTestDynamoStore(t)
+
+	source := []*Paste{
+		{PK: "deploy-notes", SK: "2024-01-01T00:00:00Z", Revision: 1, Text: "one"},
+		{PK: "deploy-notes", SK: "2024-01-02T00:00:00Z", Revision: 2, Text: "two"},
+	}
+	if err := d.ImportPaste(ctx, source); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ImportPaste(ctx, source); !errors.Is(err, ErrConflict) {
+		t.Errorf("importing the paste again = %v, want ErrConflict", err)
+	}
+
+	// a run cut short after the first revision is completed
+	delete(fake.items, fakeKey{dynamoPastePrefix + "deploy-notes", revisionSK(2)})
+	if err := d.ImportPaste(ctx, source); err != nil {
+		t.Errorf("resuming the import = %v", err)
+	}
+	if revisions, err := d.ListRevisions(ctx, "deploy-notes"); err != nil || len(revisions) != 2 {
+		t.Errorf("ListRevisions after resuming = %d revisions, %v, want 2", len(revisions), err)
+	}
+
+	// another paste under a taken slug is not mixed into it
+	if _, err := d.AddPaste(ctx, &Paste{PK: "release", Text: "theirs"}); err != nil {
+		t.Fatal(err)
+	}
+	other := []*Paste{
+		{PK: "release", SK: "2024-01-01T00:00:00Z", Revision: 1, Text: "mine"},
+		{PK: "release", SK: "2024-01-02T00:00:00Z", Revision: 2, Text: "mine too"},
+	}
+	if err := d.ImportPaste(ctx, other); !errors.Is(err, ErrConflict) {
+		t.Errorf("importing over another paste = %v, want ErrConflict", err)
+	}
+	paste, err := d.GetPaste(ctx, "release")
+	if err != nil || paste.Text != "theirs" || paste.revision() != 1 {
+		t.Errorf("GetPaste after the refused import = %+v, %v, want the stored paste untouched", paste, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	api "pbin/proto"
+)
+
+// grpcServer implements api.PastebinServiceServer on top of a DataStore
+type grpcServer struct {
+	api.UnimplementedPastebinServiceServer
+
+	store DataStore
+	sugar *zap.SugaredLogger
+}
+
+func newGRPCServer(store DataStore, sugar *zap.SugaredLogger) *grpcServer {
+	return &grpcServer{store: store, sugar: sugar}
+}
+
+// storeError maps a DataStore error to a gRPC status error
+func storeError(err error, what string) error {
+	switch {
+	case errors.Is(err, ErrAlreadyViewed):
+		return status.Errorf(codes.NotFound, "%s has already been viewed", what)
+	case errors.Is(err, ErrExpired):
+		return status.Errorf(codes.NotFound, "%s has expired", what)
+	case errors.Is(err, ErrNotFound):
+		return status.Errorf(codes.NotFound, "%s not found", what)
+	case errors.Is(err, ErrTooLarge):
+		return status.Errorf(codes.ResourceExhausted, "%s too large, the limit is %d bytes", what, maxPasteBytes)
+	case errors.Is(err, ErrConflict):
+		return status.Errorf(codes.Aborted, "%s was changed by another request", what)
+	case errors.Is(err, errPasswordRequired):
+		return status.Errorf(codes.Unauthenticated, "%s is password protected, send the password in the %s metadata", what, strings.ToLower(passwordHeader))
+	case errors.As(err, new(*passwordThrottledError)):
+		return status.Errorf(codes.ResourceExhausted, "%s: %v", what, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "timed out accessing %s", what)
+	case errors.Is(err, context.Canceled):
+		return status.Errorf(codes.Canceled, "cancelled accessing %s", what)
+	case errors.As(err, new(*invalidRequestError)):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// retrying will not help with a bug, and its message is not passed on,
+	// as over HTTP
+	zap.L().Sugar().Errorw("grpc_store_error", "what", what, "error", err)
+	return status.Errorf(codes.Internal, "failed to access %s", what)
+}
+
+// grpcRateLimit puts every call behind lmt, keyed by the client IP as the
+// HTTP handlers are
+func grpcRateLimit(lmt *limiter.Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ip := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			ip, _, _ = net.SplitHostPort(p.Addr.String())
+		}
+		if tollbooth.LimitByKeys(lmt, []string{ip}) != nil {
+			zap.L().Sugar().Warnw("grpc_rate_limited", "remote_addr", ip, "method", info.FullMethod)
+			return nil, status.Error(codes.ResourceExhausted, rateLimitedMessage)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// sendOwnerToken returns the owner token of a created paste or diff in the
+// response header metadata, as the proto responses only carry the id
+func sendOwnerToken(ctx context.Context, token string) {
+	// this only fails outside of a gRPC call
+	_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(ownerTokenHeader), token))
+}
+
+func (s *grpcServer) CreatePaste(ctx context.Context, req *api.CreatePasteRequest) (*api.CreatePasteResponse, error) {
+	text := req.GetText()
+	lang := req.GetLanguage()
+	if text == "" {
+		return nil, status.Error(codes.InvalidArgument, "text is required")
+	}
+	if err := checkSize(text); err != nil {
+		return nil, storeError(err, "paste")
+	}
+
+	// try to generate title using OpenAI
+	// but leave it blank if it fails
+	title, err := generateTitle(ctx, text, os.Getenv("OPENAPIKEY"))
+	if err != nil {
+		s.sugar.Warnw("failed_to_generate_title", "error", err, "text_preview", text[:min(len(text), 100)])
+	}
+
+	passwordHash, err := hashPassword(grpcPassword(ctx))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	token, tokenHash, err := newOwnerToken()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate owner token: %v", err)
+	}
+
+	id, err := s.store.AddPaste(ctx, &Paste{Text: text, Language: lang, Title: title, OwnerTokenHash: tokenHash, PasswordHash: passwordHash})
+	if err != nil {
+		s.sugar.Errorw("grpc_failed_to_add_paste", "error", err, "text_length", len(text), "language", lang)
+		return nil, storeError(err, "paste")
+	}
+	sendOwnerToken(ctx, token)
+
+	s.sugar.Infow("grpc_paste_added", "id", id, "text_length", len(text), "language", lang, "title", title)
+	return &api.CreatePasteResponse{Id: id}, nil
+}
+
+func (s *grpcServer) GetPaste(ctx context.Context, req *api.GetPasteRequest) (*api.GetPasteResponse, error) {
+	id := req.GetId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	// the proto has no kind, so ciphertext would pass for the text
+	paste, err := getPlainPaste(ctx, s.store, id, grpcPassword(ctx))
+	if errors.Is(err, errEncryptedPaste) {
+		return nil, status.Error(codes.FailedPrecondition, errEncryptedPaste.Error())
+	}
+	if err != nil {
+		s.sugar.Warnw("grpc_failed_to_get_paste", "id", id, "error", err)
+		return nil, storeError(err, "paste")
+	}
+
+	return &api.GetPasteResponse{
+		Id:       id,
+		Text:     paste.Text,
+		Language: paste.Language,
+		Title:    paste.Title,
+	}, nil
+}
+
+func (s *grpcServer) CreateDiff(ctx context.Context, req *api.CreateDiffRequest) (*api.CreateDiffResponse, error) {
+	original := req.GetOriginal()
+	modified := req.GetModified()
+	if original == "" && modified == "" {
+		return nil, status.Error(codes.InvalidArgument, "original or modified text is required")
+	}
+	if err := checkSize(original, modified); err != nil {
+		return nil, storeError(err, "diff")
+	}
+
+	passwordHash, err := hashPassword(grpcPassword(ctx))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	token, tokenHash, err := newOwnerToken()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate owner token: %v", err)
+	}
+
+	id, err := s.store.AddDiff(ctx, &Diff{OldText: original, NewText: modified, OwnerTokenHash: tokenHash, PasswordHash: passwordHash})
+	if err != nil {
+		s.sugar.Errorw("grpc_failed_to_add_diff", "error", err, "original_length", len(original), "modified_length", len(modified))
+		return nil, storeError(err, "diff")
+	}
+	sendOwnerToken(ctx, token)
+
+	s.sugar.Infow("grpc_diff_added", "id", id, "original_length", len(original), "modified_length", len(modified))
+	return &api.CreateDiffResponse{Id: id}, nil
+}
+
+func (s *grpcServer) GetDiff(ctx context.Context, req *api.GetDiffRequest) (*api.GetDiffResponse, error) {
+	id := req.GetId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	diff, err := getDiff(ctx, s.store, id, grpcPassword(ctx))
+	if err != nil {
+		s.sugar.Warnw("grpc_failed_to_get_diff", "id", id, "error", err)
+		return nil, storeError(err, "diff")
+	}
+
+	return &api.GetDiffResponse{
+		Id:      id,
+		OldText: diff.OldText,
+		NewText: diff.NewText,
+	}, nil
+}
+
+func (s *grpcServer) GetCompletion(ctx context.Context, req *api.GetCompletionRequest) (*api.GetCompletionResponse, error) {
+	openapikey := os.Getenv("OPENAPIKEY")
+	if openapikey == "" {
+		return nil, status.Error(codes.Unavailable, "completions are not configured")
+	}
+	if req.GetText() == "" {
+		return nil, status.Error(codes.InvalidArgument, "text is required")
+	}
+
+	completions, err := getCompletion(ctx, req.GetText(), openapikey)
+	if err != nil {
+		s.sugar.Errorw("grpc_completion_failed", "error", err)
+		return nil, status.Errorf(codes.Unavailable, "completion failed: %v", err)
+	}
+	return &api.GetCompletionResponse{Completions: completions}, nil
+}
+
+// serveGRPC registers the PastebinService and serves it on port, behind
+// lmt, until the listener fails
+func serveGRPC(port string, store DataStore, lmt *limiter.Limiter, sugar *zap.SugaredLogger) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(grpcRateLimit(lmt)))
+	api.RegisterPastebinServiceServer(s, newGRPCServer(store, sugar))
+	sugar.Infow("starting_grpc_server", "port", port)
+	return s.Serve(lis)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Error codes sent in the body of error responses, so clients need not
+// tell apart errors sharing a status code by their message
+const (
+	errCodeInvalidRequest   = "invalid_request"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeConflict         = "conflict"
+	errCodeAlreadyViewed    = "already_viewed"
+	errCodeExpired          = "expired"
+	errCodeTooLarge         = "too_large"
+	errCodeTimeout          = "timeout"
+	errCodeInternal         = "internal"
+	errCodePasswordRequired = "password_required"
+	errCodeTooManyAttempts  = "too_many_attempts"
+	errCodeRateLimited      = "rate_limited"
+)
+
+// rateLimitedMessage is what a client over the rate limit is told, whether
+// it came over HTTP, netcat or gRPC
+const rateLimitedMessage = "too many requests, try again in a moment"
+
+// apiError is the body of every error response of the API, wrapped in an
+// "error" object
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError answers a request with status and a JSON error body
+func writeError(writer http.ResponseWriter, status int, code, message string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(map[string]apiError{
+		"error": {Code: code, Message: message},
+	})
+}
+
+// errorStatus maps an error to the status and error code it is answered
+// with. Anything it does not know is an internal error.
+func errorStatus(err error) (int, string) {
+	var tooLarge *http.MaxBytesError
+	var invalid *invalidRequestError
+	var throttled *passwordThrottledError
+	switch {
+	case errors.Is(err, ErrAlreadyViewed):
+		return http.StatusGone, errCodeAlreadyViewed
+	// ErrExpired wraps ErrNotFound, so it has to come first
+	case errors.Is(err, ErrExpired):
+		return http.StatusGone, errCodeExpired
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, errCodeNotFound
+	case errors.Is(err, ErrTooLarge), errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, errCodeTooLarge
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, errCodeConflict
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest, errCodeInvalidRequest
+	case errors.Is(err, errPasswordRequired):
+		return http.StatusUnauthorized, errCodePasswordRequired
+	case errors.As(err, &throttled):
+		return http.StatusTooManyRequests, errCodeTooManyAttempts
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, errCodeTimeout
+	}
+	return http.StatusInternalServerError, errCodeInternal
+}
+
+// writeStoreError answers a request that failed with err while reading or
+// writing what, a paste or a diff. The message of an internal error is not
+// passed on, it is only logged by the caller.
+func writeStoreError(writer http.ResponseWriter, err error, what string) {
+	status, code := errorStatus(err)
+	var message string
+	switch code {
+	case errCodeAlreadyViewed:
+		message = what + " has already been viewed"
+	case errCodeExpired:
+		message = what + " has expired"
+	case errCodeNotFound:
+		message = what + " not found"
+	case errCodeTooLarge:
+		message = fmt.Sprintf("%s too large, the limit is %d bytes", what, maxPasteBytes)
+	case errCodeConflict:
+		message = what + " was changed by another request, try again"
+		if errors.Is(err, errSlugTaken) {
+			message = "slug is already taken by another " + what
+		}
+	case errCodeInvalidRequest:
+		message = err.Error()
+	case errCodePasswordRequired:
+		message = what + " is password protected, send the password in the " + passwordHeader + " header"
+	case errCodeTooManyAttempts:
+		var throttled *passwordThrottledError
+		errors.As(err, &throttled)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+		message = err.Error()
+	case errCodeTimeout:
+		message = "timed out reading or writing the " + what
+	default:
+		message = "internal error"
+	}
+	writeError(writer, status, code, message)
+}
+
+// writeBodyError answers a request whose body could not be read or parsed
+func writeBodyError(writer http.ResponseWriter, err error, what string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeStoreError(writer, err, what)
+		return
+	}
+	writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+}
+
+// writeMethodNotAllowed answers a request with a method the endpoint does
+// not support
+func writeMethodNotAllowed(writer http.ResponseWriter, request *http.Request) {
+	writeError(writer, http.StatusMethodNotAllowed, errCodeMethodNotAllowed,
+		fmt.Sprintf("method %s not allowed", request.Method))
+}
+
+// checkSize returns ErrTooLarge for text over maxPasteBytes, for callers
+// whose input is not already limited by http.MaxBytesReader
+func checkSize(text ...string) error {
+	var n int64
+	for _, t := range text {
+		n += int64(len(t))
+	}
+	if n > maxPasteBytes {
+		return fmt.Errorf("%d bytes: %w", n, ErrTooLarge)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// idGenerator returns a candidate id for a new paste or diff. Stores try
+// another when it is taken, so it need not be unique, only unlikely to
+// repeat.
+type idGenerator func() string
+
+// idAttempts is how many generated ids a store tries before giving up
+const idAttempts = 5
+
+// minIDBits is the randomness below which generated ids become guessable
+// by walking the id space, which would reveal unlisted pastes
+const minIDBits = 72
+
+// newID is the generator picked by PBIN_ID_STYLE: short (the default) for
+// PBIN_ID_LENGTH base62 characters, words for PBIN_ID_LENGTH words from
+// idWords joined by dashes, or uuid for the ids pbin used to hand out. It
+// is the default until loadIDGenerator runs.
+var newID = idGeneratorFor("", 0)
+
+// loadIDGenerator sets newID from the environment. It is called once zap
+// is set up, so that warnings about the configuration are not lost.
+func loadIDGenerator() {
+	newID = idGeneratorFor(os.Getenv("PBIN_ID_STYLE"), int(envInt64("PBIN_ID_LENGTH", 0)))
+}
+
+// idGeneratorFor returns the generator of a style, with its default length
+// when n is not positive
+func idGeneratorFor(style string, n int) idGenerator {
+	switch style {
+	case "uuid":
+		return func() string { return uuid.New().String() }
+	case "words":
+		if n <= 0 {
+			n = 9
+		}
+		checkIDBits(style, n, len(idWords))
+		return func() string { return wordID(n) }
+	case "", "short":
+		if n <= 0 {
+			n = 16
+		}
+		checkIDBits(style, n, len(base62Alphabet))
+		return func() string { return base62ID(n) }
+	}
+	zap.L().Sugar().Warnw("unknown_id_style", "style", style)
+	return idGeneratorFor("", n)
+}
+
+// checkIDBits warns when ids of n symbols, each one of choices, carry
+// less than minIDBits
+func checkIDBits(style string, n, choices int) {
+	if bits := float64(n) * math.Log2(float64(choices)); bits < minIDBits {
+		zap.L().Sugar().Warnw("guessable_id_length",
+			"style", style,
+			"length", n,
+			"bits", int(bits),
+			"min_bits", minIDBits,
+		)
+	}
+}
+
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// base62ID returns n random base62 characters
+func base62ID(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = base62Alphabet[randIntn(len(base62Alphabet))]
+	}
+	return string(b)
+}
+
+// wordID returns n random words from idWords joined by dashes
+func wordID(n int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = idWords[randIntn(len(idWords))]
+	}
+	return strings.Join(words, "-")
+}
+
+// randIntn returns a uniform random number in [0, n)
+func randIntn(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return int(v.Int64())
+}
+
+// assignID stores a new record with insert, which returns ErrConflict when
+// its id is taken. A slug chosen by the caller is tried as it is; otherwise
+// ids from newID are tried until one is free.
+func assignID(slug string, insert func(id string) error) (string, error) {
+	if slug != "" {
+		return slug, insert(slug)
+	}
+	var err error
+	for i := 0; i < idAttempts; i++ {
+		id := newID()
+		if err = insert(id); !errors.Is(err, ErrConflict) {
+			return id, err
+		}
+		zap.L().Sugar().Infow("generated_id_taken", "id", id, "attempt", i+1)
+	}
+	return "", fmt.Errorf("no free id after %d attempts: %w", idAttempts, err)
+}
+
+// slugPattern is what a custom id may look like. It keeps slugs usable in
+// paths and query strings as they are.
+var slugPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{2,63}$`)
+
+// errSlugTaken is returned when the slug asked for is the id of another
+// paste or diff
+var errSlugTaken = errors.New("slug is already taken")
+
+// slugError turns the ErrConflict of a store asked for slug into
+// errSlugTaken, keeping ErrConflict in the chain
+func slugError(slug string, err error) error {
+	if slug != "" && errors.Is(err, ErrConflict) {
+		return fmt.Errorf("%w: %w", errSlugTaken, err)
+	}
+	return err
+}
+
+// checkSlug rejects custom ids that do not match slugPattern
+func checkSlug(slug string) error {
+	if slug != "" && !slugPattern.MatchString(slug) {
+		return &invalidRequestError{"slug must be 3 to 64 letters, digits, dashes or underscores, starting with a letter or digit"}
+	}
+	return nil
+}
+
+// idWords are short, distinct, inoffensive words for word ids, about 8.2
+// bits each. Nine of them give about 74 bits.
+var idWords = strings.Fields(`
+	able acid aged also area army away baby back ball band bank base bath
+	bear beat bell belt best bird blow blue boat body bone book boot born
+	boss both bowl bulk burn bush busy cake calm came camp card care cart
+	case cash cast cell chat chip city clay club coal coat code cold cook
+	cool cope copy core cost crew crop dark data date dawn deal dear deep
+	deer desk dial diet disk dock door dose down draw drop drum duck dust
+	duty each earn ease east easy edge else even ever face fact fair fall
+	farm fast fern file fill film find fine fire firm fish five flag flat
+	flow folk food foot fork form fort four free frog fuel full fund gain
+	game gate gear gift girl give glad glow goal goat gold golf good gray
+	grew grid grow gulf hair half hall hand hard harm hawk head heat held
+	herb hero high hill hint hold hole home hope horn host hour huge idea
+	inch iron item jazz join joke jump june jury just keen keep kelp kept
+	kind king kite knee knew knot lace lake lamp land lane last late lawn
+	lead leaf lean left lens life lift like lime line link lion list live
+	load loan lock loft long look loop lord loud love luck lung made mail
+	main make malt many mark mars mass mast meal meat melt memo menu mild
+	milk mill mind mine mint miss mode mole moon more moss most moth move
+	much must nail name navy near neat neck nest news next nice nine node
+	none noon norm nose note oak oat odd oval oven over pace pack page
+	paid pain pair palm park part pass past path peak pear peer pine pink
+`)
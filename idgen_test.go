@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// stubNewID makes newID hand out ids in turn, repeating the last, for the
+// rest of the test
+func stubNewID(t *testing.T, ids ...string) {
+	t.Helper()
+	saved := newID
+	t.Cleanup(func() { newID = saved })
+	newID = func() string {
+		id := ids[0]
+		if len(ids) > 1 {
+			ids = ids[1:]
+		}
+		return id
+	}
+}
+
+func TestIDGeneratorDefaults(t *testing.T) {
+	if id := idGeneratorFor("", 0)(); len(id) != 16 {
+		t.Errorf("short id %q has %d characters, want 16", id, len(id))
+	}
+	if id := idGeneratorFor("words", 0)(); len(strings.Split(id, "-")) != 9 {
+		t.Errorf("words id %q, want 9 words", id)
+	}
+}
+
+func TestIDGeneratorWarnsWhenGuessable(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	t.Cleanup(zap.ReplaceGlobals(zap.New(core)))
+
+	for _, tc := range []struct {
+		style string
+		n     int
+		warn  bool
+	}{
+		{"short", 0, false},
+		{"short", 8, true},
+		{"short", 13, false},
+		{"words", 0, false},
+		{"words", 4, true},
+		{"uuid", 0, false},
+	} {
+		idGeneratorFor(tc.style, tc.n)
+		warned := false
+		for _, entry := range logs.TakeAll() {
+			warned = warned || entry.Message == "guessable_id_length"
+		}
+		if warned != tc.warn {
+			t.Errorf("%s of %d: warned %v, want %v", tc.style, tc.n, warned, tc.warn)
+		}
+	}
+}
+
+func TestAssignIDRetriesTakenIDs(t *testing.T) {
+	taken := map[string]bool{"taken": true}
+	insert := func(id string) error {
+		if taken[id] {
+			return ErrConflict
+		}
+		taken[id] = true
+		return nil
+	}
+
+	stubNewID(t, "taken", "taken", "free")
+	if id, err := assignID("", insert); err != nil || id != "free" {
+		t.Errorf("assignID = %q, %v, want free", id, err)
+	}
+
+	stubNewID(t, "taken")
+	if _, err := assignID("", insert); !errors.Is(err, ErrConflict) {
+		t.Errorf("assignID with every id taken = %v, want ErrConflict", err)
+	}
+
+	// a slug is tried once, as it is
+	stubNewID(t, "unused")
+	if _, err := assignID("taken", insert); !errors.Is(err, ErrConflict) {
+		t.Errorf("assignID of a taken slug = %v, want ErrConflict", err)
+	}
+}
+
+// TestStoresRefuseTakenIDs checks that every backend claims ids atomically
+// enough to refuse a taken slug and to retry a taken generated id
+func TestStoresRefuseTakenIDs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		open func(t *testing.T) DataStore
+	}{
+		{"memory", func(t *testing.T) DataStore { return NewMemoryStore() }},
+		{"bolt", func(t *testing.T) DataStore { return newTestBoltStore(t) }},
+		{"sqlite", func(t *testing.T) DataStore { return newTestSQLiteStore(t) }},
+		{"dynamo", func(t *testing.T) DataStore {
+			s, _ := newTestDynamoStore(t)
+			return s
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := tc.open(t)
+
+			if _, err := s.AddPaste(ctx, &Paste{PK: "deploy-notes", Text: "one"}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := s.AddPaste(ctx, &Paste{PK: "deploy-notes", Text: "two"})
+			if err = slugError("deploy-notes", err); !errors.Is(err, errSlugTaken) || !errors.Is(err, ErrConflict) {
+				t.Errorf("AddPaste with a taken slug = %v, want errSlugTaken", err)
+			}
+			// diffs have ids of their own
+			if _, err := s.AddDiff(ctx, &Diff{PK: "deploy-notes"}); err != nil {
+				t.Errorf("AddDiff with a paste's slug = %v", err)
+			}
+			if _, err := s.AddDiff(ctx, &Diff{PK: "deploy-notes"}); !errors.Is(err, ErrConflict) {
+				t.Errorf("AddDiff with a taken slug = %v, want ErrConflict", err)
+			}
+
+			stubNewID(t, "deploy-notes", "fresh-id")
+			if id, err := s.AddPaste(ctx, &Paste{Text: "three"}); err != nil || id != "fresh-id" {
+				t.Errorf("AddPaste colliding with a taken id = %q, %v, want fresh-id", id, err)
+			}
+			paste, err := s.GetPaste(ctx, "deploy-notes")
+			if err != nil || paste.Text != "one" {
+				t.Errorf("GetPaste of the slug = %v, want the first paste untouched", err)
+			}
+		})
+	}
+}
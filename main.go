@@ -11,12 +11,15 @@ import (
 	"io/fs"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"net/http"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
 	_ "github.com/joho/godotenv/autoload"
 	openai "github.com/sashabaranov/go-openai"
 
@@ -59,7 +62,8 @@ var (
 	README_TEXT     string
 	PBIN_TABLE_NAME = os.Getenv("PBIN_TABLE_NAME")
 	PBIN_URL        = os.Getenv("PBIN_URL")
-	dataStore       DataStore
+	// PBIN_ADMIN_TOKEN enables the admin endpoints for requests bearing it
+	PBIN_ADMIN_TOKEN = os.Getenv("PBIN_ADMIN_TOKEN")
 )
 
 type PasteTemplateContent struct {
@@ -70,27 +74,29 @@ type DiffTemplateContent struct {
 	OldText, NewText string
 }
 
-func init() {
-	sugar := zap.L().Sugar()
+// initDataStore opens the store the server runs on. It is not done in
+// init() so the command line client never touches the database.
+func initDataStore(sugar *zap.SugaredLogger) DataStore {
 	sugar.Info("initializing_application")
 
-	var err error
 	sugar.Info("creating_data_store")
-	dataStore, err = NewDataStore()
+	store, err := NewDataStore()
 	if err != nil {
 		sugar.Fatalw("failed_to_initialize_data_store", "error", err)
 		log.Fatalf("Failed to initialize data store: %v", err)
 	}
 
 	sugar.Info("data_store_initialized_successfully")
+	return store
 }
 
-func generateTitle(text, openapikey string) (string, error) {
+func generateTitle(ctx context.Context, text, openapikey string) (string, error) {
 	if openapikey == "" {
 		return "", fmt.Errorf("OPENAPIKEY not set")
 	}
 	c := openai.NewClient(openapikey)
-	ctx := context.Background()
+	ctx, cancel := withTimeout(ctx, openAITimeout)
+	defer cancel()
 
 	req := openai.ChatCompletionRequest{
 		Model: openai.GPT3Dot5Turbo,
@@ -117,113 +123,441 @@ Only output the title, nothing else.`,
 	return resp.Choices[0].Message.Content, nil
 }
 
-func handlePaste(writer http.ResponseWriter, request *http.Request) {
-	sugar := zap.L().Sugar()
+// expiryDurations are the expiry options accepted when creating a paste or
+// diff
+var expiryDurations = map[string]time.Duration{
+	"10m": 10 * time.Minute,
+	"1h":  time.Hour,
+	"1d":  24 * time.Hour,
+	"1w":  7 * 24 * time.Hour,
+}
 
-	switch request.Method {
-	case "POST":
-		sugar.Infow("paste_write_request_started", "method", request.Method, "content_length", request.ContentLength)
+// parseExpiry turns an expiry option into the unix time the item expires
+// at, or zero if it never does
+func parseExpiry(expiry string, now time.Time) (int64, error) {
+	if expiry == "" || expiry == "never" {
+		return 0, nil
+	}
+	d, ok := expiryDurations[expiry]
+	if !ok {
+		return 0, fmt.Errorf("invalid expiry %q, expected one of 10m, 1h, 1d, 1w, never", expiry)
+	}
+	return now.Add(d).Unix(), nil
+}
 
-		if err := request.ParseForm(); err != nil {
-			sugar.Errorw("failed_to_parse_form", "error", err)
-			fmt.Fprintf(writer, "ParseForm() err: %v", err)
-			return
-		}
+// formBool reports whether a form value is set to a truthy value, as sent by
+// checkboxes and API clients alike
+func formBool(v string) bool {
+	switch strings.ToLower(v) {
+	case "1", "true", "on", "yes":
+		return true
+	}
+	return false
+}
 
-		text := request.FormValue("text")
-		lang := request.FormValue("lang")
+// invalidRequestError is returned for create requests that can never
+// succeed as sent
+type invalidRequestError struct {
+	msg string
+}
 
-		sugar.Infow("paste_data_received",
-			"text_length", len(text),
-			"language", lang,
-			"has_text", text != "",
-		)
+func (e *invalidRequestError) Error() string {
+	return e.msg
+}
 
-		title := ""
-		var err error
-		// try to generate title using OpenAI
-		// but leave it blank if it fails
+// createPaste generates a title and an owner token for a requested paste
+// and stores it, returning its id and the owner token
+func createPaste(ctx context.Context, store DataStore, req *createPasteRequest, sugar *zap.SugaredLogger) (string, string, error) {
+	text := req.Text
+	lang := req.Language
+	expiry := req.Expiry
+	burn := req.Burn
+
+	sugar.Infow("paste_data_received",
+		"text_length", len(text),
+		"language", lang,
+		"has_text", text != "",
+		"expiry", expiry,
+		"burn_after_reading", burn,
+		"has_password", req.Password != "",
+		"slug", req.Slug,
+	)
+
+	expiresAt, err := parseExpiry(expiry, time.Now())
+	if err != nil {
+		sugar.Warnw("invalid_paste_expiry", "expiry", expiry, "error", err)
+		return "", "", &invalidRequestError{err.Error()}
+	}
+
+	if text == "" && req.Hash != "" {
+		text, err = storedText(ctx, store, req.Hash)
+		if err != nil {
+			sugar.Warnw("failed_to_get_paste_body", "hash", req.Hash, "error", err)
+			return "", "", err
+		}
+	}
+	if err := checkKind(req.Kind, text); err != nil {
+		sugar.Warnw("invalid_paste_kind", "kind", req.Kind, "error", err)
+		return "", "", err
+	}
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		sugar.Warnw("failed_to_hash_paste_password", "error", err)
+		return "", "", err
+	}
+	if err := checkSlug(req.Slug); err != nil {
+		sugar.Warnw("invalid_paste_slug", "slug", req.Slug, "error", err)
+		return "", "", err
+	}
+
+	title := ""
+	// try to generate title using OpenAI
+	// but leave it blank if it fails. Ciphertext has nothing to go on.
+	if req.Kind != pasteKindEncrypted {
 		openapikey := os.Getenv("OPENAPIKEY")
-		title, err = generateTitle(text, openapikey)
+		title, err = generateTitle(ctx, text, openapikey)
 		if err != nil {
 			sugar.Warnw("failed_to_generate_title", "error", err, "text_preview", text[:min(len(text), 100)])
 		} else {
 			sugar.Infow("title_generated", "title", title)
 		}
+	}
 
-		sugar.Infow("attempting_to_add_paste",
+	token, tokenHash, err := newOwnerToken()
+	if err != nil {
+		sugar.Errorw("failed_to_generate_owner_token", "error", err)
+		return "", "", err
+	}
+
+	sugar.Infow("attempting_to_add_paste",
+		"text_length", len(text),
+		"language", lang,
+		"title", title,
+	)
+
+	id, err := store.AddPaste(ctx, &Paste{
+		PK:               req.Slug,
+		Language:         lang,
+		Text:             text,
+		Title:            title,
+		ExpiresAt:        expiresAt,
+		BurnAfterReading: burn,
+		OwnerTokenHash:   tokenHash,
+		PasswordHash:     passwordHash,
+		Kind:             req.Kind,
+	})
+
+	if err != nil {
+		sugar.Errorw("failed_to_add_paste",
+			"error", err,
 			"text_length", len(text),
 			"language", lang,
 			"title", title,
 		)
+		return "", "", slugError(req.Slug, err)
+	}
 
-		id, err := dataStore.AddPaste(text, lang, title)
+	sugar.Infow("paste_successfully_added",
+		"id", id,
+		"text_length", len(text),
+		"language", lang,
+		"title", title,
+	)
+	return id, token, nil
+}
 
-		if err != nil {
-			sugar.Errorw("failed_to_add_paste",
-				"error", err,
-				"text_length", len(text),
-				"language", lang,
-				"title", title,
+func handlePaste(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sugar := zap.L().Sugar()
+
+		switch request.Method {
+		case "POST":
+			sugar.Infow("paste_write_request_started", "method", request.Method, "content_length", request.ContentLength)
+
+			req, err := parsePasteRequest(writer, request)
+			if err != nil {
+				sugar.Errorw("failed_to_parse_paste_request", "error", err)
+				writeBodyError(writer, err, "paste")
+				return
+			}
+
+			id, token, err := createPaste(request.Context(), store, req, sugar)
+			if err != nil {
+				log.Printf("Failed to add paste: %v", err)
+				writeStoreError(writer, err, "paste")
+				return
+			}
+
+			if req.Raw {
+				writeRawCreated(writer, pasteLink(baseURL(request), id), token)
+				return
+			}
+
+			q := request.URL.Query()
+			q.Del("text")
+			q.Del("lang")
+			q.Del("expiry")
+			q.Del("burn")
+			q.Del("hash")
+			q.Del("kind")
+			q.Del("password")
+			q.Del("slug")
+			q.Set("id", id)
+			request.URL.RawQuery = q.Encode()
+			writer.Header().Set(ownerTokenHeader, token)
+			// following a redirect would read, and so burn, a burn-after-reading
+			// paste before its creator could share it
+			if req.Burn || wantsJSON(request) {
+				url := pasteLink(baseURL(request), id)
+				writeCreated(writer, request.URL.String(), id, url, token)
+				return
+			}
+			http.Redirect(writer, request, request.URL.String(), http.StatusMovedPermanently)
+		case "GET":
+			id := request.URL.Query().Get("id")
+			sugar.Infow("paste_read_request", "id", id, "has_id", id != "")
+
+			if id == "" {
+				sugar.Warnw("paste_read_request_without_id")
+				writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "id is required")
+				return
+			}
+
+			var paste *Paste
+			var err error
+			if rev := request.URL.Query().Get("rev"); rev != "" {
+				n, convErr := strconv.Atoi(rev)
+				if convErr != nil || n < 1 {
+					writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("invalid revision %q", rev))
+					return
+				}
+				sugar.Infow("attempting_to_get_paste_revision", "id", id, "revision", n)
+				paste, err = getRevision(request.Context(), store, id, n, requestPassword(request))
+			} else {
+				sugar.Infow("attempting_to_get_paste", "id", id)
+				paste, err = getPaste(request.Context(), store, id, requestPassword(request))
+			}
+			if errors.Is(err, ErrAlreadyViewed) {
+				sugar.Infow("paste_already_viewed", "id", id)
+			} else if isPasswordError(err) {
+				sugar.Warnw("paste_password_rejected", "id", id, "error", err)
+			} else if err != nil {
+				sugar.Errorw("failed_to_get_paste", "id", id, "error", err)
+				log.Printf("Failed to get paste: %v", err)
+			}
+			if err != nil {
+				writeStoreError(writer, err, "paste")
+				return
+			}
+
+			sugar.Infow("paste_successfully_retrieved",
+				"id", id,
+				"text_length", len(paste.Text),
+				"language", paste.Language,
+				"title", paste.Title,
 			)
-			log.Printf("Failed to add paste: %v", err)
-			writer.WriteHeader(http.StatusInternalServerError)
+
+			// Return JSON for API requests
+			resp := map[string]interface{}{
+				"id":       id,
+				"text":     paste.Text,
+				"language": paste.Language,
+				"title":    paste.Title,
+				"revision": paste.revision(),
+				"hash":     contentHash(paste.Text),
+			}
+			if paste.ExpiresAt != 0 {
+				resp["expiresAt"] = paste.ExpiresAt
+			}
+			if paste.Kind != "" {
+				resp["kind"] = paste.Kind
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(writer).Encode(resp)
+		case "PUT", "PATCH":
+			updatePaste(store, writer, request, sugar)
+		case "DELETE":
+			deletePaste(store, writer, request, sugar)
+		default:
+			sugar.Warnw("unsupported_method", "method", request.Method)
+			writeMethodNotAllowed(writer, request)
+		}
+	}
+}
+
+// getOwnedPaste loads the paste named by the id query parameter and checks
+// the request's owner token against it, writing the error response and
+// returning nil if either fails
+func getOwnedPaste(store DataStore, writer http.ResponseWriter, request *http.Request, sugar *zap.SugaredLogger) *Paste {
+	id := request.URL.Query().Get("id")
+	if id == "" {
+		writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "id is required")
+		return nil
+	}
+
+	paste, err := store.GetPaste(request.Context(), id)
+	if err != nil {
+		sugar.Warnw("failed_to_get_owned_paste", "id", id, "error", err)
+		writeStoreError(writer, err, "paste")
+		return nil
+	}
+
+	if !checkOwnerToken(writer, request, paste.OwnerTokenHash) {
+		sugar.Warnw("paste_owner_token_rejected", "id", id)
+		return nil
+	}
+	return paste
+}
+
+// updatePaste handles PUT, which replaces the text, language and title of
+// a paste, and PATCH, which only changes the fields that are sent
+func updatePaste(store DataStore, writer http.ResponseWriter, request *http.Request, sugar *zap.SugaredLogger) {
+	if err := request.ParseForm(); err != nil {
+		sugar.Errorw("failed_to_parse_form", "error", err)
+		writeBodyError(writer, fmt.Errorf("ParseForm() err: %w", err), "paste")
+		return
+	}
+
+	paste := getOwnedPaste(store, writer, request, sugar)
+	if paste == nil {
+		return
+	}
+
+	replace := request.Method == "PUT"
+	if _, ok := request.PostForm["text"]; ok || replace {
+		paste.Text = request.PostFormValue("text")
+		if err := checkKind(paste.Kind, paste.Text); err != nil {
+			writeStoreError(writer, err, "paste")
 			return
 		}
+	}
+	if _, ok := request.PostForm["lang"]; ok || replace {
+		paste.Language = request.PostFormValue("lang")
+	}
+	if _, ok := request.PostForm["title"]; ok || replace {
+		paste.Title = request.PostFormValue("title")
+	}
 
-		sugar.Infow("paste_successfully_added",
-			"id", id,
-			"text_length", len(text),
-			"language", lang,
-			"title", title,
-		)
+	if err := store.UpdatePaste(request.Context(), paste); err != nil {
+		sugar.Errorw("failed_to_update_paste", "id", paste.PK, "error", err)
+		writeStoreError(writer, err, "paste")
+		return
+	}
 
-		q := request.URL.Query()
-		q.Del("text")
-		q.Del("lang")
-		q.Set("id", id)
-		request.URL.RawQuery = q.Encode()
-		http.Redirect(writer, request, request.URL.String(), http.StatusMovedPermanently)
-	case "GET":
-		id := request.URL.Query().Get("id")
-		sugar.Infow("paste_read_request", "id", id, "has_id", id != "")
+	sugar.Infow("paste_successfully_updated",
+		"id", paste.PK,
+		"revision", paste.Revision,
+		"text_length", len(paste.Text),
+		"language", paste.Language,
+		"title", paste.Title,
+	)
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":       paste.PK,
+		"revision": paste.Revision,
+	})
+}
 
+// handleRevisions lists the revisions of a paste, oldest first
+func handleRevisions(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sugar := zap.L().Sugar()
+
+		if request.Method != "GET" {
+			writeMethodNotAllowed(writer, request)
+			return
+		}
+
+		id := request.URL.Query().Get("id")
 		if id == "" {
-			sugar.Warnw("paste_read_request_without_id")
-			// For React app, return empty response for API calls without ID
-			writer.WriteHeader(http.StatusBadRequest)
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "id is required")
 			return
 		}
 
-		sugar.Infow("attempting_to_get_paste", "id", id)
-		paste, err := dataStore.GetPaste(id)
+		paste, err := openPaste(request.Context(), store, id, requestPassword(request))
+		if err == nil && paste.BurnAfterReading {
+			err = errBurnRevisions
+		}
 		if err != nil {
-			sugar.Errorw("failed_to_get_paste", "id", id, "error", err)
-			log.Printf("Failed to get paste: %v", err)
-			writer.WriteHeader(http.StatusNotFound)
+			sugar.Warnw("failed_to_open_paste", "id", id, "error", err)
+			writeStoreError(writer, err, "paste")
+			return
+		}
+		revisions, err := store.ListRevisions(request.Context(), id)
+		if err != nil {
+			sugar.Warnw("failed_to_list_revisions", "id", id, "error", err)
+			writeStoreError(writer, err, "paste")
 			return
 		}
 
-		sugar.Infow("paste_successfully_retrieved",
-			"id", id,
-			"text_length", len(paste.Text),
-			"language", paste.Language,
-			"title", paste.Title,
-		)
-
-		// Return JSON for API requests
+		resp := make([]map[string]interface{}, 0, len(revisions))
+		for _, rev := range revisions {
+			resp = append(resp, map[string]interface{}{
+				"revision":  rev.revision(),
+				"createdAt": rev.SK,
+				"language":  rev.Language,
+				"title":     rev.Title,
+				"hash":      contentHash(rev.Text),
+			})
+		}
 		writer.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(writer).Encode(map[string]interface{}{
-			"id":       id,
-			"text":     paste.Text,
-			"language": paste.Language,
-			"title":    paste.Title,
+			"id":        id,
+			"revisions": resp,
 		})
+	}
+}
+
+// handleRevisionDiff answers GET /api/diff?paste=X&from=A&to=B with two
+// revisions of a paste in the same shape as a stored diff
+func handleRevisionDiff(store DataStore, writer http.ResponseWriter, request *http.Request, sugar *zap.SugaredLogger) {
+	q := request.URL.Query()
+	id := q.Get("paste")
+
+	var revs [2]*Paste
+	for i, name := range []string{"from", "to"} {
+		n, err := strconv.Atoi(q.Get(name))
+		if err != nil || n < 1 {
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("invalid %s revision %q", name, q.Get(name)))
+			return
+		}
+		revs[i], err = getRevision(request.Context(), store, id, n, requestPassword(request))
+		if err != nil {
+			sugar.Warnw("failed_to_get_paste_revision", "id", id, "revision", n, "error", err)
+			writeStoreError(writer, err, "paste")
+			return
+		}
+	}
 
-	default:
-		sugar.Warnw("unsupported_method", "method", request.Method)
-		writer.WriteHeader(http.StatusMethodNotAllowed)
+	resp := map[string]interface{}{
+		"id":       id,
+		"oldText":  revs[0].Text,
+		"newText":  revs[1].Text,
+		"language": revs[1].Language,
 	}
+	// both texts are ciphertext for the client to decrypt
+	if revs[1].Kind != "" {
+		resp["kind"] = revs[1].Kind
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(resp)
+}
+
+// deletePaste handles DELETE for the owner of a paste
+func deletePaste(store DataStore, writer http.ResponseWriter, request *http.Request, sugar *zap.SugaredLogger) {
+	paste := getOwnedPaste(store, writer, request, sugar)
+	if paste == nil {
+		return
+	}
+
+	if err := store.DeletePaste(request.Context(), paste.PK); err != nil {
+		sugar.Errorw("failed_to_delete_paste", "id", paste.PK, "error", err)
+		writeStoreError(writer, err, "paste")
+		return
+	}
+
+	sugar.Infow("paste_successfully_deleted", "id", paste.PK)
+	writer.WriteHeader(http.StatusNoContent)
 }
 
 type fm struct {
@@ -338,76 +672,139 @@ func mdToHTML(md []byte) ([]byte, error) {
 
 }
 
-func getPaste(id string) (*Paste, error) {
-	paste, err := dataStore.GetPaste(id)
+// openPaste reads the current revision of a paste, without burning it,
+// once password opens it
+func openPaste(ctx context.Context, store DataStore, id, password string) (*Paste, error) {
+	paste, err := store.GetPaste(ctx, id)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkPassword(id, paste.PasswordHash, password); err != nil {
+		return nil, err
+	}
 	return paste, nil
 }
 
-func handleHtml(writer http.ResponseWriter, request *http.Request) {
-	switch request.Method {
-	case "GET":
-		id := request.URL.Query().Get("id")
-		if id == "" {
-			// redirect to index
+// getPaste reads a paste for display once password opens it, burning it if
+// it is burn-after-reading
+func getPaste(ctx context.Context, store DataStore, id, password string) (*Paste, error) {
+	paste, err := openPaste(ctx, store, id, password)
+	if err != nil || !paste.BurnAfterReading {
+		return paste, err
+	}
+	return store.TakePaste(ctx, id)
+}
+
+// getPlainPaste reads a paste like getPaste where the server needs its
+// text, returning errEncryptedPaste for one encrypted by its client before
+// it would be burned
+func getPlainPaste(ctx context.Context, store DataStore, id, password string) (*Paste, error) {
+	paste, err := openPaste(ctx, store, id, password)
+	if err != nil {
+		return nil, err
+	}
+	if paste.Kind == pasteKindEncrypted {
+		return nil, errEncryptedPaste
+	}
+	if !paste.BurnAfterReading {
+		return paste, nil
+	}
+	return store.TakePaste(ctx, id)
+}
+
+// errBurnRevisions is returned for the revisions of a burn-after-reading
+// paste, which would otherwise be readable without burning it
+var errBurnRevisions = &invalidRequestError{"a burn-after-reading paste can only be read once, as a whole"}
+
+// getRevision reads one revision of a paste once password opens its
+// current revision
+func getRevision(ctx context.Context, store DataStore, id string, rev int, password string) (*Paste, error) {
+	paste, err := openPaste(ctx, store, id, password)
+	if err != nil {
+		return nil, err
+	}
+	if paste.BurnAfterReading {
+		return nil, errBurnRevisions
+	}
+	return store.GetRevision(ctx, id, rev)
+}
+
+func handleHtml(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case "GET":
+			id := request.URL.Query().Get("id")
+			if id == "" {
+				// redirect to index
+				http.Redirect(writer, request, PBIN_URL, http.StatusMovedPermanently)
+				return
+			}
+			paste, err := getPlainPaste(request.Context(), store, id, requestPassword(request))
+			if err != nil {
+				log.Printf("Failed to get paste: %v", err)
+				writeStoreError(writer, err, "paste")
+				return
+			}
+
+			text := paste.Text
+			textBuffer := []byte(text)
+			html, err := mdToHTML(textBuffer)
+			if err != nil {
+				log.Printf("error converting markdown to html, stacktrace: %+v", err)
+				writeStoreError(writer, err, "paste")
+				return
+			}
+			_, err = writer.Write(html)
+			if err != nil {
+				log.Println(err)
+			}
+		default:
 			http.Redirect(writer, request, PBIN_URL, http.StatusMovedPermanently)
-			return
-		}
-		paste, err := getPaste(id)
-		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
 		}
+	}
+}
 
-		text := paste.Text
-		textBuffer := []byte(text)
-		html, err := mdToHTML(textBuffer)
-		if err != nil {
-			log.Printf("error converting markdown to html, stacktrace: %+v", err)
-			writer.WriteHeader(http.StatusInternalServerError)
+func handleIndex(rawPaste http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// `some-cmd | curl --data-binary @- $PBIN_URL` creates a paste
+		if r.Method == "POST" && r.URL.Path == "/" {
+			rawPaste.ServeHTTP(w, r)
 			return
 		}
-		_, err = writer.Write(html)
-		if err != nil {
-			log.Println(err)
+
+		// Serve the React app for all routes except API endpoints
+		if strings.HasPrefix(r.URL.Path, "/api/") ||
+			strings.HasPrefix(r.URL.Path, "/html") ||
+			strings.HasPrefix(r.URL.Path, "/raw/") ||
+			strings.HasPrefix(r.URL.Path, "/download/") ||
+			strings.HasPrefix(r.URL.Path, "/p/") ||
+			strings.HasPrefix(r.URL.Path, "/complete") ||
+			strings.HasPrefix(r.URL.Path, "/health") {
+			return // Let other handlers handle these
 		}
-	default:
-		http.Redirect(writer, request, PBIN_URL, http.StatusMovedPermanently)
-	}
-}
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	// Serve the React app for all routes except API endpoints
-	if strings.HasPrefix(r.URL.Path, "/api/") ||
-		strings.HasPrefix(r.URL.Path, "/html") ||
-		strings.HasPrefix(r.URL.Path, "/complete") ||
-		strings.HasPrefix(r.URL.Path, "/health") {
-		return // Let other handlers handle these
-	}
+		// Try to serve static files first
+		staticFS, err := fs.Sub(staticFiles, "static")
+		if err == nil {
+			fileServer := http.FileServer(http.FS(staticFS))
 
-	// Try to serve static files first
-	staticFS, err := fs.Sub(staticFiles, "static")
-	if err == nil {
-		fileServer := http.FileServer(http.FS(staticFS))
+			// Check if the requested file exists
+			if _, err := staticFS.Open(strings.TrimPrefix(r.URL.Path, "/")); err == nil {
+				fileServer.ServeHTTP(w, r)
+				return
+			}
+		}
 
-		// Check if the requested file exists
-		if _, err := staticFS.Open(strings.TrimPrefix(r.URL.Path, "/")); err == nil {
-			fileServer.ServeHTTP(w, r)
+		// For all other routes, serve the index.html (React app)
+		indexFile, err := staticFiles.ReadFile("static/index.html")
+		if err != nil {
+			http.Error(w, "Failed to load application", http.StatusInternalServerError)
 			return
 		}
-	}
 
-	// For all other routes, serve the index.html (React app)
-	indexFile, err := staticFiles.ReadFile("static/index.html")
-	if err != nil {
-		http.Error(w, "Failed to load application", http.StatusInternalServerError)
-		return
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(indexFile)
 	}
-
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(indexFile)
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -417,105 +814,185 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleDiff(writer http.ResponseWriter, request *http.Request) {
-	sugar := zap.L().Sugar()
+func handleDiff(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sugar := zap.L().Sugar()
 
-	switch request.Method {
-	case "POST":
-		sugar.Infow("diff_write_request_started", "method", request.Method, "content_length", request.ContentLength)
+		switch request.Method {
+		case "POST":
+			sugar.Infow("diff_write_request_started", "method", request.Method, "content_length", request.ContentLength)
 
-		if err := request.ParseForm(); err != nil {
-			sugar.Errorw("failed_to_parse_form", "error", err)
-			fmt.Fprintf(writer, "ParseForm() err: %v", err)
-			return
-		}
+			req, err := parseDiffRequest(writer, request)
+			if err != nil {
+				sugar.Errorw("failed_to_parse_diff_request", "error", err)
+				writeBodyError(writer, err, "diff")
+				return
+			}
 
-		original := request.FormValue("original")
-		modified := request.FormValue("modified")
+			original := req.Original
+			modified := req.Modified
+			expiry := req.Expiry
 
-		sugar.Infow("diff_data_received",
-			"original_length", len(original),
-			"modified_length", len(modified),
-			"has_original", original != "",
-			"has_modified", modified != "",
-		)
+			sugar.Infow("diff_data_received",
+				"original_length", len(original),
+				"modified_length", len(modified),
+				"has_original", original != "",
+				"has_modified", modified != "",
+				"expiry", expiry,
+			)
 
-		sugar.Infow("attempting_to_add_diff",
-			"original_length", len(original),
-			"modified_length", len(modified),
-		)
+			expiresAt, err := parseExpiry(expiry, time.Now())
+			if err != nil {
+				sugar.Warnw("invalid_diff_expiry", "expiry", expiry, "error", err)
+				writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+				return
+			}
+			passwordHash, err := hashPassword(req.Password)
+			if err != nil {
+				sugar.Warnw("failed_to_hash_diff_password", "error", err)
+				writeStoreError(writer, err, "diff")
+				return
+			}
+			if err := checkSlug(req.Slug); err != nil {
+				sugar.Warnw("invalid_diff_slug", "slug", req.Slug, "error", err)
+				writeStoreError(writer, err, "diff")
+				return
+			}
+
+			sugar.Infow("attempting_to_add_diff",
+				"original_length", len(original),
+				"modified_length", len(modified),
+			)
 
-		id, err := dataStore.AddDiff(original, modified)
+			token, tokenHash, err := newOwnerToken()
+			if err != nil {
+				sugar.Errorw("failed_to_generate_owner_token", "error", err)
+				writeStoreError(writer, err, "diff")
+				return
+			}
 
-		if err != nil {
-			sugar.Errorw("failed_to_add_diff",
-				"error", err,
+			id, err := store.AddDiff(request.Context(), &Diff{
+				PK:             req.Slug,
+				OldText:        original,
+				NewText:        modified,
+				ExpiresAt:      expiresAt,
+				OwnerTokenHash: tokenHash,
+				PasswordHash:   passwordHash,
+			})
+
+			if err != nil {
+				sugar.Errorw("failed_to_add_diff",
+					"error", err,
+					"original_length", len(original),
+					"modified_length", len(modified),
+				)
+				log.Printf("Failed to add diff: %v", err)
+				writeStoreError(writer, slugError(req.Slug, err), "diff")
+				return
+			}
+
+			sugar.Infow("diff_successfully_added",
+				"id", id,
 				"original_length", len(original),
 				"modified_length", len(modified),
 			)
-			log.Printf("Failed to add diff: %v", err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
 
-		sugar.Infow("diff_successfully_added",
-			"id", id,
-			"original_length", len(original),
-			"modified_length", len(modified),
-		)
+			q := request.URL.Query()
+			q.Del("original")
+			q.Del("modified")
+			q.Del("expiry")
+			q.Del("password")
+			q.Del("slug")
+			q.Set("id", id)
+			request.URL.RawQuery = q.Encode()
+			writer.Header().Set(ownerTokenHeader, token)
+			if wantsJSON(request) {
+				url := fmt.Sprintf("%s/diff?id=%s", baseURL(request), id)
+				writeCreated(writer, request.URL.String(), id, url, token)
+				return
+			}
+			http.Redirect(writer, request, request.URL.String(), http.StatusMovedPermanently)
+		case "GET":
+			if request.URL.Query().Get("paste") != "" {
+				handleRevisionDiff(store, writer, request, sugar)
+				return
+			}
 
-		q := request.URL.Query()
-		q.Del("original")
-		q.Del("modified")
-		q.Set("id", id)
-		request.URL.RawQuery = q.Encode()
-		http.Redirect(writer, request, request.URL.String(), http.StatusMovedPermanently)
-	case "GET":
-		id := request.URL.Query().Get("id")
-		sugar.Infow("diff_read_request", "id", id, "has_id", id != "")
+			id := request.URL.Query().Get("id")
+			sugar.Infow("diff_read_request", "id", id, "has_id", id != "")
 
-		if id == "" {
-			sugar.Warnw("diff_read_request_without_id")
-			// For React app, return empty response for API calls without ID
-			writer.WriteHeader(http.StatusBadRequest)
-			return
-		}
+			if id == "" {
+				sugar.Warnw("diff_read_request_without_id")
+				writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "id is required")
+				return
+			}
 
-		sugar.Infow("attempting_to_get_diff", "id", id)
-		diff, err := dataStore.GetDiff(id)
+			sugar.Infow("attempting_to_get_diff", "id", id)
+			diff, err := getDiff(request.Context(), store, id, requestPassword(request))
 
-		if err != nil {
-			sugar.Errorw("failed_to_get_diff", "id", id, "error", err)
-			log.Printf("Failed to get diff: %v", err)
-			writer.WriteHeader(http.StatusNotFound)
-			return
-		}
+			if err != nil {
+				sugar.Errorw("failed_to_get_diff", "id", id, "error", err)
+				log.Printf("Failed to get diff: %v", err)
+				writeStoreError(writer, err, "diff")
+				return
+			}
 
-		sugar.Infow("diff_successfully_retrieved",
-			"id", id,
-			"old_text_length", len(diff.OldText),
-			"new_text_length", len(diff.NewText),
-		)
+			sugar.Infow("diff_successfully_retrieved",
+				"id", id,
+				"old_text_length", len(diff.OldText),
+				"new_text_length", len(diff.NewText),
+			)
 
-		// Return JSON for API requests
-		writer.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(writer).Encode(map[string]interface{}{
-			"id":      id,
-			"oldText": diff.OldText,
-			"newText": diff.NewText,
-		})
+			// Return JSON for API requests
+			resp := map[string]interface{}{
+				"id":      id,
+				"oldText": diff.OldText,
+				"newText": diff.NewText,
+			}
+			if diff.ExpiresAt != 0 {
+				resp["expiresAt"] = diff.ExpiresAt
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(writer).Encode(resp)
+		case "DELETE":
+			id := request.URL.Query().Get("id")
+			if id == "" {
+				writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "id is required")
+				return
+			}
+
+			diff, err := store.GetDiff(request.Context(), id)
+			if err != nil {
+				sugar.Warnw("failed_to_get_owned_diff", "id", id, "error", err)
+				writeStoreError(writer, err, "diff")
+				return
+			}
+			if !checkOwnerToken(writer, request, diff.OwnerTokenHash) {
+				sugar.Warnw("diff_owner_token_rejected", "id", id)
+				return
+			}
 
-	default:
-		sugar.Warnw("unsupported_method", "method", request.Method)
-		writer.WriteHeader(http.StatusMethodNotAllowed)
+			if err := store.DeleteDiff(request.Context(), id); err != nil {
+				sugar.Errorw("failed_to_delete_diff", "id", id, "error", err)
+				writeStoreError(writer, err, "diff")
+				return
+			}
+
+			sugar.Infow("diff_successfully_deleted", "id", id)
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			sugar.Warnw("unsupported_method", "method", request.Method)
+			writeMethodNotAllowed(writer, request)
+		}
 	}
 }
 
-func getCompletion(text, openapikey string) ([]string, error) {
+func getCompletion(ctx context.Context, text, openapikey string) ([]string, error) {
 	// get completion from  openai
 
 	c := openai.NewClient(openapikey)
-	ctx := context.Background()
+	ctx, cancel := withTimeout(ctx, openAITimeout)
+	defer cancel()
 
 	req := openai.ChatCompletionRequest{
 		Model: openai.GPT3Dot5Turbo,
@@ -569,7 +1046,7 @@ func handleCompletion(sugar *zap.SugaredLogger) func(writer http.ResponseWriter,
 				return
 			}
 			text := request.FormValue("text")
-			completion, err := getCompletion(text, openapikey)
+			completion, err := getCompletion(request.Context(), text, openapikey)
 			sugar.Infow("completion_request", "text", text, "completion", completion, "completion_request", 1)
 			if err != nil {
 				log.Println(err)
@@ -596,30 +1073,89 @@ func handleCompletion(sugar *zap.SugaredLogger) func(writer http.ResponseWriter,
 	}
 }
 
-func handleWithDefaultRateLimiter(p string, h http.HandlerFunc) {
-	http.Handle(p, tollbooth.LimitFuncHandler(tollbooth.NewLimiter(2, nil), h))
+// newDefaultLimiter allows each client two requests a second. Rejected
+// requests get the JSON error body of the rest of the API rather than
+// tollbooth's plain text.
+func newDefaultLimiter() *limiter.Limiter {
+	body, _ := json.Marshal(map[string]apiError{
+		"error": {Code: errCodeRateLimited, Message: rateLimitedMessage},
+	})
+	return tollbooth.NewLimiter(2, nil).
+		SetMessage(string(body) + "\n").
+		SetMessageContentType("application/json").
+		SetOnLimitReached(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			zap.L().Sugar().Warnw("http_rate_limited", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+		})
+}
+
+func handleWithDefaultRateLimiter(mux *http.ServeMux, p string, h http.HandlerFunc) {
+	mux.Handle(p, tollbooth.LimitFuncHandler(newDefaultLimiter(), h))
+}
+
+// newServeMux routes the HTTP API and the React app to handlers backed by
+// store. Raw pastes posted to / are limited by rawLimiter, which the netcat
+// and gRPC listeners share.
+func newServeMux(store DataStore, rawLimiter *limiter.Limiter, sugar *zap.SugaredLogger) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// API endpoints
+	handleWithDefaultRateLimiter(mux, "/api/admin/export", handleExport(store))
+	handleWithDefaultRateLimiter(mux, "/api/body", handleBody(store))
+	handleWithDefaultRateLimiter(mux, "/api/complete", handleCompletion(sugar))
+	handleWithDefaultRateLimiter(mux, "/api/diff", handleDiff(store))
+	handleWithDefaultRateLimiter(mux, "/api/paste", handlePaste(store))
+	handleWithDefaultRateLimiter(mux, "/api/paste/revisions", handleRevisions(store))
+	handleWithDefaultRateLimiter(mux, "/health", handleHealth)
+	handleWithDefaultRateLimiter(mux, "/html", handleHtml(store))
+	handleWithDefaultRateLimiter(mux, "/raw/", handleRaw(store))
+	handleWithDefaultRateLimiter(mux, "/download/", handleDownload(store))
+	handleWithDefaultRateLimiter(mux, "/p/", handleShortLink)
+
+	// Serve static files and React app for all other routes, with POST /
+	// behind the same rate limit as the API
+	mux.HandleFunc("/", handleIndex(tollbooth.LimitFuncHandler(rawLimiter, handleRawPaste(store))))
+	return mux
 }
 
 func main() {
+	// any argument other than serve makes pbin a command line client
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	logger, _ := zap.NewProduction()
 	defer logger.Sync() // flushes buffer, if any
+	// the stores and handlers log through zap.L()
+	zap.ReplaceGlobals(logger)
 	sugar := logger.Sugar()
-
-	// API endpoints
-	handleWithDefaultRateLimiter("/api/complete", handleCompletion(sugar))
-	handleWithDefaultRateLimiter("/api/diff", handleDiff)
-	handleWithDefaultRateLimiter("/api/paste", handlePaste)
-	handleWithDefaultRateLimiter("/health", handleHealth)
-	handleWithDefaultRateLimiter("/html", handleHtml)
-
-	// Serve static files and React app for all other routes
-	http.HandleFunc("/", handleIndex)
+	loadIDGenerator()
+	store := initDataStore(sugar)
 
 	// get port from env PORT
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
 	}
+
+	// raw pastes over HTTP, netcat and gRPC draw on one per-IP limit
+	rawLimiter := newDefaultLimiter()
+
+	// the gRPC PastebinService is opt in and runs alongside the HTTP mux on
+	// its own port
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		go func() {
+			sugar.Fatal(serveGRPC(grpcPort, store, rawLimiter, sugar))
+		}()
+	}
+
+	// the netcat listener is opt in, `some-cmd | nc host $NC_PORT`
+	if ncPort := os.Getenv("NC_PORT"); ncPort != "" {
+		go func() {
+			sugar.Fatal(serveNetcat(ncPort, port, store, rawLimiter, sugar))
+		}()
+	}
+
 	sugar.Infow("starting_server", "port", port)
-	sugar.Fatal(http.ListenAndServe(":"+port, nil))
+	sugar.Fatal(http.ListenAndServe(":"+port, newServeMux(store, rawLimiter, sugar)))
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// clearStoreEnv unsets the encryption keys, blob storage and title
+// generation for the rest of the test
+func clearStoreEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"PBIN_ENCRYPTION_KEYS", "PBIN_ENCRYPTION_KEYFILE", "PBIN_BLOB_STORE", "OPENAPIKEY"} {
+		t.Setenv(name, "")
+	}
+}
+
+// newTestStore returns a memory store behind the layers NewDataStore adds,
+// with no encryption keys, blob storage or title generation configured
+func newTestStore(t *testing.T) DataStore {
+	t.Helper()
+	clearStoreEnv(t)
+	store, err := wrapStore(NewMemoryStore())
+	if err != nil {
+		t.Fatalf("wrapStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return newTimeoutStore(store)
+}
+
+// serve runs one request through h and returns the response
+func serve(h http.Handler, method, target, body string) *http.Response {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, target, r)
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return serveRequest(h, request)
+}
+
+// serveRequest runs request through h and returns the response
+func serveRequest(h http.Handler, request *http.Request) *http.Response {
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	return recorder.Result()
+}
+
+// createTestPaste posts body as JSON to /api/paste and returns the id and
+// owner token of the paste it creates
+func createTestPaste(t *testing.T, store DataStore, body string) (id, token string) {
+	t.Helper()
+	resp := serve(handlePaste(store), "POST", "/api/paste", body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api/paste = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	var created struct{ ID, Token string }
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding created paste: %v", err)
+	}
+	return created.ID, created.Token
+}
+
+// readBody returns the body of resp as a string
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return string(b)
+}
+
+func TestPasteHandlers(t *testing.T) {
+	store := newTestStore(t)
+	h := handlePaste(store)
+	id, token := createTestPaste(t, store, `{"text":"hello world","lang":"text"}`)
+
+	resp := serve(h, "GET", "/api/paste?id="+id, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var paste struct{ ID, Text string }
+	if err := json.NewDecoder(resp.Body).Decode(&paste); err != nil {
+		t.Fatalf("decoding paste: %v", err)
+	}
+	if paste.Text != "hello world" || paste.ID != id {
+		t.Errorf("GET = %q with id %q, want %q with id %q", paste.Text, paste.ID, "hello world", id)
+	}
+
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusForbidden},
+		{token, http.StatusNoContent},
+	} {
+		request := httptest.NewRequest("DELETE", "/api/paste?id="+id, nil)
+		if tc.token != "" {
+			request.Header.Set(ownerTokenHeader, tc.token)
+		}
+		if resp := serveRequest(h, request); resp.StatusCode != tc.want {
+			t.Errorf("DELETE with token %q = %d, want %d", tc.token, resp.StatusCode, tc.want)
+		}
+	}
+
+	resp = serve(h, "GET", "/api/paste?id="+id, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	var body struct{ Error struct{ Code string } }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error.Code != errCodeNotFound {
+		t.Errorf("GET after DELETE error code = %q, %v, want %q", body.Error.Code, err, errCodeNotFound)
+	}
+}
+
+func TestPasteHandlersRejectBadRequests(t *testing.T) {
+	store := newTestStore(t)
+	h := handlePaste(store)
+	for _, tc := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"GET", "/api/paste", "", http.StatusBadRequest},
+		{"GET", "/api/paste?id=missing", "", http.StatusNotFound},
+		{"POST", "/api/paste", `{"text":`, http.StatusBadRequest},
+		{"DELETE", "/api/paste?id=missing", "", http.StatusNotFound},
+	} {
+		if resp := serve(h, tc.method, tc.target, tc.body); resp.StatusCode != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.target, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestBurnPasteRevisionsAreRefused(t *testing.T) {
+	store := newTestStore(t)
+	id, _ := createTestPaste(t, store, `{"text":"burn secret","burn":true}`)
+
+	for _, tc := range []struct {
+		name   string
+		h      http.Handler
+		target string
+	}{
+		{"paste revision", handlePaste(store), "/api/paste?id=" + id + "&rev=1"},
+		{"raw revision", handleRaw(store), "/raw/" + id + "?rev=1"},
+		{"revision diff", handleDiff(store), "/api/diff?paste=" + id + "&from=1&to=1"},
+		{"revision list", handleRevisions(store), "/api/paste/revisions?id=" + id},
+	} {
+		resp := serve(tc.h, "GET", tc.target, "")
+		body := readBody(t, resp)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, http.StatusBadRequest)
+		}
+		if strings.Contains(body, "burn secret") {
+			t.Errorf("%s: answered the text of a burn-after-reading paste", tc.name)
+		}
+	}
+
+	// the refused reads left the paste to be read, and burned, exactly once
+	resp := serve(handlePaste(store), "GET", "/api/paste?id="+id, "")
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, "burn secret") {
+		t.Fatalf("first read = %d %q, want the paste", resp.StatusCode, body)
+	}
+	resp = serve(handlePaste(store), "GET", "/api/paste?id="+id, "")
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("second read = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+}
+
+func TestRateLimitAnswersWithJSONError(t *testing.T) {
+	mux := newServeMux(newTestStore(t), newDefaultLimiter(), zap.L().Sugar())
+
+	var resp *http.Response
+	for i := 0; i < 3; i++ {
+		resp = serve(mux, "GET", "/health", "")
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third request in a second = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body struct{ Error apiError }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding 429 body: %v", err)
+	}
+	if body.Error.Code != errCodeRateLimited || body.Error.Message == "" {
+		t.Errorf("429 body = %+v, want code %q", body.Error, errCodeRateLimited)
+	}
+}
+
+func TestHeadDoesNotBurnPastes(t *testing.T) {
+	store := newTestStore(t)
+	for _, tc := range []struct {
+		name, prefix string
+		h            http.Handler
+	}{
+		{"raw", "/raw/", handleRaw(store)},
+		{"download", "/download/", handleDownload(store)},
+	} {
+		id, _ := createTestPaste(t, store, `{"text":"burn secret","burn":true}`)
+		if resp := serve(tc.h, "HEAD", tc.prefix+id, ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: HEAD = %d, want %d", tc.name, resp.StatusCode, http.StatusOK)
+		}
+		resp := serve(tc.h, "GET", tc.prefix+id, "")
+		if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "burn secret" {
+			t.Errorf("%s: GET after HEAD = %d %q, want the paste", tc.name, resp.StatusCode, body)
+		}
+		if resp := serve(tc.h, "GET", tc.prefix+id, ""); resp.StatusCode != http.StatusGone {
+			t.Errorf("%s: second GET = %d, want %d", tc.name, resp.StatusCode, http.StatusGone)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements DataStore in process memory. Everything is lost
+// when the process exits, which suits tests and throwaway deployments.
+type MemoryStore struct {
+	mu     sync.Mutex
+	pastes map[string]*Paste
+	// revisions holds the earlier revisions of each paste, oldest first
+	revisions map[string][]*Paste
+	diffs     map[string]*Diff
+	bodies    map[string]*Body
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		pastes:    make(map[string]*Paste),
+		revisions: make(map[string][]*Paste),
+		diffs:     make(map[string]*Diff),
+		bodies:    make(map[string]*Body),
+	}
+}
+
+// copies are handed out and stored so callers never share a Paste or Diff
+// with the store
+
+func copyPaste(p *Paste) *Paste {
+	c := *p
+	return &c
+}
+
+func copyDiff(d *Diff) *Diff {
+	c := *d
+	return &c
+}
+
+// getPaste returns the stored current revision of a paste, dropping it if
+// it has expired. m.mu must be held.
+func (m *MemoryStore) getPaste(id string, now time.Time) (*Paste, error) {
+	paste, ok := m.pastes[id]
+	if !ok {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrNotFound)
+	}
+	if expired(paste.ExpiresAt, now) {
+		delete(m.pastes, id)
+		delete(m.revisions, id)
+		return nil, fmt.Errorf("paste %s: %w", id, ErrExpired)
+	}
+	if paste.Burned {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrAlreadyViewed)
+	}
+	return paste, nil
+}
+
+// GetPaste retrieves a paste from memory
+func (m *MemoryStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paste, err := m.getPaste(id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return copyPaste(paste), nil
+}
+
+// TakePaste retrieves a paste from memory, replacing a burn-after-reading
+// paste with its tombstone
+func (m *MemoryStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	paste, err := m.getPaste(id, now)
+	if err != nil {
+		return nil, err
+	}
+	if paste.BurnAfterReading {
+		m.pastes[id] = paste.tombstone(now)
+		delete(m.revisions, id)
+	}
+	return copyPaste(paste), nil
+}
+
+// AddPaste adds a new paste to memory
+func (m *MemoryStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, err := assignID(paste.PK, func(id string) error {
+		if _, ok := m.pastes[id]; ok {
+			return fmt.Errorf("paste %s: %w", id, ErrConflict)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	paste.PK = id
+	paste.SK = newSK(time.Now())
+	paste.Revision = 1
+	m.pastes[id] = copyPaste(paste)
+	return id, nil
+}
+
+// UpdatePaste stores paste as the new current revision, keeping the
+// previous one
+func (m *MemoryStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, err := m.getPaste(paste.PK, time.Now())
+	if err != nil {
+		return err
+	}
+	m.revisions[paste.PK] = append(m.revisions[paste.PK], current)
+
+	paste.SK = newSK(time.Now())
+	paste.Revision = current.revision() + 1
+	m.pastes[paste.PK] = copyPaste(paste)
+	return nil
+}
+
+// ListRevisions returns every revision of a paste in memory, oldest first
+func (m *MemoryStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, err := m.getPaste(id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]*Paste, 0, len(m.revisions[id])+1)
+	for _, p := range m.revisions[id] {
+		revisions = append(revisions, copyPaste(p))
+	}
+	return append(revisions, copyPaste(current)), nil
+}
+
+// GetRevision retrieves one revision of a paste from memory
+func (m *MemoryStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	revisions, err := m.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, rev)
+}
+
+// DeletePaste removes a paste and its revisions from memory
+func (m *MemoryStore) DeletePaste(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pastes[id]; !ok {
+		return fmt.Errorf("paste %s: %w", id, ErrNotFound)
+	}
+	delete(m.pastes, id)
+	delete(m.revisions, id)
+	return nil
+}
+
+// GetDiff retrieves a diff from memory
+func (m *MemoryStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	diff, ok := m.diffs[id]
+	if !ok {
+		return nil, fmt.Errorf("diff %s: %w", id, ErrNotFound)
+	}
+	if expired(diff.ExpiresAt, time.Now()) {
+		delete(m.diffs, id)
+		return nil, fmt.Errorf("diff %s: %w", id, ErrExpired)
+	}
+	return copyDiff(diff), nil
+}
+
+// AddDiff adds a new diff to memory
+func (m *MemoryStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, err := assignID(diff.PK, func(id string) error {
+		if _, ok := m.diffs[id]; ok {
+			return fmt.Errorf("diff %s: %w", id, ErrConflict)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	diff.PK = id
+	diff.SK = newSK(time.Now())
+	m.diffs[id] = copyDiff(diff)
+	return id, nil
+}
+
+// DeleteDiff removes a diff from memory
+func (m *MemoryStore) DeleteDiff(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.diffs[id]; !ok {
+		return fmt.Errorf("diff %s: %w", id, ErrNotFound)
+	}
+	delete(m.diffs, id)
+	return nil
+}
+
+// ScanPastes calls fn with the revisions of every paste in memory, oldest
+// first. The pastes are copied up front so fn may use the store.
+func (m *MemoryStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	m.mu.Lock()
+	all := make([][]*Paste, 0, len(m.pastes))
+	for id, current := range m.pastes {
+		revisions := make([]*Paste, 0, len(m.revisions[id])+1)
+		for _, p := range m.revisions[id] {
+			revisions = append(revisions, copyPaste(p))
+		}
+		all = append(all, append(revisions, copyPaste(current)))
+	}
+	m.mu.Unlock()
+
+	for _, revisions := range all {
+		if err := fn(revisions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanDiffs calls fn with every diff in memory
+func (m *MemoryStore) ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error {
+	m.mu.Lock()
+	all := make([]*Diff, 0, len(m.diffs))
+	for _, diff := range m.diffs {
+		all = append(all, copyDiff(diff))
+	}
+	m.mu.Unlock()
+
+	for _, diff := range all {
+		if err := fn(diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportPaste stores the revisions of a paste, oldest first, as they are.
+// It returns ErrConflict if the paste id is taken.
+func (m *MemoryStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := revisions[len(revisions)-1]
+	if _, ok := m.pastes[current.PK]; ok {
+		return fmt.Errorf("paste %s: %w", current.PK, ErrConflict)
+	}
+	older := make([]*Paste, 0, len(revisions)-1)
+	for _, p := range revisions[:len(revisions)-1] {
+		older = append(older, copyPaste(p))
+	}
+	if len(older) > 0 {
+		m.revisions[current.PK] = older
+	}
+	m.pastes[current.PK] = copyPaste(current)
+	return nil
+}
+
+// ImportDiff stores diff as it is. It returns ErrConflict if the diff id is
+// taken.
+func (m *MemoryStore) ImportDiff(ctx context.Context, diff *Diff) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.diffs[diff.PK]; ok {
+		return fmt.Errorf("diff %s: %w", diff.PK, ErrConflict)
+	}
+	m.diffs[diff.PK] = copyDiff(diff)
+	return nil
+}
+
+// AcquireBody stores body unless its hash is already there and counts one
+// more reference
+func (m *MemoryStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.bodies[body.Hash]; ok && !expired(stored.ExpiresAt, time.Now()) {
+		stored.acquire(body.ExpiresAt)
+		return false, nil
+	}
+	stored := *body
+	stored.Refs, stored.Expiries = 0, nil
+	stored.acquire(body.ExpiresAt)
+	m.bodies[body.Hash] = &stored
+	return true, nil
+}
+
+// GetBody retrieves the body stored under hash, dropping it if it has
+// expired
+func (m *MemoryStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	body, ok := m.bodies[hash]
+	if !ok {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrNotFound)
+	}
+	if expired(body.ExpiresAt, time.Now()) {
+		delete(m.bodies, hash)
+		return nil, fmt.Errorf("body %s: %w", hash, ErrExpired)
+	}
+	c := *body
+	c.Expiries = slices.Clone(body.Expiries)
+	return &c, nil
+}
+
+// ReleaseBody drops the reference expiring at expiresAt from the body
+// stored under hash, deleting it once none are left
+func (m *MemoryStore) ReleaseBody(ctx context.Context, hash string, expiresAt int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if body, ok := m.bodies[hash]; ok && !body.release(expiresAt) {
+		delete(m.bodies, hash)
+	}
+	return nil
+}
+
+// RewrapKeys rewrites the key fields of the stored records in place
+func (m *MemoryStore) RewrapKeys(ctx context.Context, rewrap rewrapFunc) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	apply := func(keyID, dataKey *string) error {
+		changed, err := rewrapFields(rewrap, keyID, dataKey)
+		if changed {
+			n++
+		}
+		return err
+	}
+	for id, paste := range m.pastes {
+		if err := apply(&paste.KeyID, &paste.DataKey); err != nil {
+			return n, fmt.Errorf("paste %s: %w", id, err)
+		}
+		for _, rev := range m.revisions[id] {
+			if err := apply(&rev.KeyID, &rev.DataKey); err != nil {
+				return n, fmt.Errorf("paste %s revision %d: %w", id, rev.revision(), err)
+			}
+		}
+	}
+	for id, diff := range m.diffs {
+		if err := apply(&diff.KeyID, &diff.DataKey); err != nil {
+			return n, fmt.Errorf("diff %s: %w", id, err)
+		}
+	}
+	for hash, body := range m.bodies {
+		if err := apply(&body.KeyID, &body.DataKey); err != nil {
+			return n, fmt.Errorf("body %s: %w", hash, err)
+		}
+	}
+	return n, nil
+}
+
+// Close is a no-op, there is nothing to release
+func (m *MemoryStore) Close() error {
+	return nil
+}
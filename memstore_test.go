@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryAddPasteConflictsWithAnyStoredID(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	if _, err := m.AddPaste(ctx, &Paste{PK: "stale", Text: "old", ExpiresAt: time.Now().Add(-time.Minute).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	// like Bolt, an expired paste keeps its id until it is swept
+	if _, err := m.AddPaste(ctx, &Paste{PK: "stale", Text: "new"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddPaste over an expired paste = %v, want ErrConflict", err)
+	}
+	if _, err := m.AddDiff(ctx, &Diff{PK: "taken"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddDiff(ctx, &Diff{PK: "taken"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddDiff over a stored diff = %v, want ErrConflict", err)
+	}
+}
+
+func TestMemoryDeleteMissing(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	err := m.DeletePaste(ctx, "nope")
+	if !errors.Is(err, ErrNotFound) || err.Error() != "paste nope: not found" {
+		t.Errorf("DeletePaste = %v, want paste nope: not found", err)
+	}
+	err = m.DeleteDiff(ctx, "nope")
+	if !errors.Is(err, ErrNotFound) || err.Error() != "diff nope: not found" {
+		t.Errorf("DeleteDiff = %v, want diff nope: not found", err)
+	}
+}
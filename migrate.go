@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// migrationStore is implemented by the backends pbin migrate copies
+// between. Items are copied as they are stored, keeping their ids,
+// timestamps, revisions and owner token hashes.
+type migrationStore interface {
+	DataStore
+	bodyStore
+	// ScanPastes calls fn with the revisions of every paste, oldest first,
+	// including expired pastes and the tombstones of burned ones
+	ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error
+	// ScanDiffs calls fn with every diff, including expired ones
+	ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error
+	// ImportPaste stores the revisions of a paste, oldest first, under their
+	// own id. It returns ErrConflict when the paste is already there, so an
+	// interrupted migration can simply be run again.
+	ImportPaste(ctx context.Context, revisions []*Paste) error
+	// ImportDiff stores diff under its own id, returning ErrConflict when it
+	// is already there
+	ImportDiff(ctx context.Context, diff *Diff) error
+	// RewrapKeys passes the key fields of every encrypted paste revision,
+	// diff and body to rewrap and stores what it returns in their place,
+	// leaving everything else as it is. It returns how many records
+	// changed.
+	RewrapKeys(ctx context.Context, rewrap rewrapFunc) (int, error)
+}
+
+const migrateUsage = `usage: pbin migrate -from <store> -to <store> [-dry-run]
+
+copies every paste and diff from one store to another, keeping ids and
+timestamps. Items already in the target are skipped, so an interrupted run
+can be repeated. A store is one of
+  bolt:<file>         default pbin.db
+  sqlite:<file>       default pbin.sqlite
+  postgres:<dsn>
+  dynamo:<table>      default PBIN_TABLE_NAME or pbin, using the usual AWS
+                      environment for credentials and region
+
+flags:
+`
+
+// migrationCounts tallies the items of one store, or of one run
+type migrationCounts struct {
+	pastes, revisions, diffs int
+}
+
+func (c migrationCounts) String() string {
+	return fmt.Sprintf("%d pastes (%d revisions), %d diffs", c.pastes, c.revisions, c.diffs)
+}
+
+// cliMigrate runs pbin migrate. Unlike the other subcommands it talks to
+// the stores directly rather than to a server.
+func cliMigrate(args []string) error {
+	fs := flag.NewFlagSet("pbin migrate", flag.ContinueOnError)
+	from := fs.String("from", "", "store to copy from")
+	to := fs.String("to", "", "store to copy to")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), migrateUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *from == *to {
+		return fmt.Errorf("-from and -to name the same store")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	src, err := openMigrationStore(*from)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", *from, err)
+	}
+	defer src.Close()
+	dst, err := openMigrationStore(*to)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", *to, err)
+	}
+	defer dst.Close()
+
+	copied, skipped, err := migrate(ctx, src, dst, *dryRun)
+	verb := "copied"
+	if *dryRun {
+		verb = "would copy"
+	}
+	fmt.Fprintf(os.Stderr, "%s %v; skipped %v already in %s\n", verb, copied, skipped, *to)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return nil
+	}
+
+	want, err := countStore(ctx, src)
+	if err != nil {
+		return fmt.Errorf("counting %s: %w", *from, err)
+	}
+	got, err := countStore(ctx, dst)
+	if err != nil {
+		return fmt.Errorf("counting %s: %w", *to, err)
+	}
+	fmt.Fprintf(os.Stderr, "%s holds %v\n%s holds %v\n", *from, want, *to, got)
+	// the target may hold items of its own, but never fewer
+	if got.pastes < want.pastes || got.revisions < want.revisions || got.diffs < want.diffs {
+		return fmt.Errorf("%s holds fewer items than %s", *to, *from)
+	}
+	return nil
+}
+
+// openMigrationStore opens the store named by a kind:argument spec. Texts
+// are read and written through the same layers as by the server.
+func openMigrationStore(spec string) (migrationStore, error) {
+	store, err := openBackendStore(spec)
+	if err != nil {
+		return nil, err
+	}
+	return wrapStore(store)
+}
+
+// openBackendStore opens the backend named by a kind:argument spec
+func openBackendStore(spec string) (migrationStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "bolt":
+		if arg == "" {
+			arg = "pbin.db"
+		}
+		return openBoltStore(arg)
+	case "sqlite":
+		if arg == "" {
+			arg = "pbin.sqlite"
+		}
+		return openSQLiteStore(arg)
+	case "postgres":
+		if arg == "" {
+			return nil, fmt.Errorf("postgres needs a DSN, as in postgres:postgres://user@host/db")
+		}
+		return openPostgresStore(arg)
+	case "dynamo":
+		if arg == "" {
+			arg = dynamoTableName()
+		}
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return newDynamoStore(dynamodb.New(sess), arg)
+	}
+	return nil, fmt.Errorf("unknown store %q, expected bolt, sqlite, postgres or dynamo", kind)
+}
+
+// migrate copies every paste and diff of src that has not expired into dst
+// and returns how many items were copied and how many were skipped as dst
+// already had them. With dryRun set dst is only read.
+func migrate(ctx context.Context, src, dst migrationStore, dryRun bool) (copied, skipped migrationCounts, err error) {
+	now := time.Now()
+
+	err = src.ScanPastes(ctx, func(revisions []*Paste) error {
+		current := revisions[len(revisions)-1]
+		if expired(current.ExpiresAt, now) {
+			return nil
+		}
+		var err error
+		if dryRun {
+			_, err = dst.GetPaste(ctx, current.PK)
+			switch {
+			case errors.Is(err, ErrNotFound) && !errors.Is(err, ErrExpired):
+				err = nil
+			case err == nil, errors.Is(err, ErrAlreadyViewed), errors.Is(err, ErrExpired):
+				err = ErrConflict
+			}
+		} else {
+			err = dst.ImportPaste(ctx, revisions)
+		}
+		if errors.Is(err, ErrConflict) {
+			skipped.pastes++
+			skipped.revisions += len(revisions)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("paste %s: %w", current.PK, err)
+		}
+		copied.pastes++
+		copied.revisions += len(revisions)
+		return nil
+	})
+	if err != nil {
+		return copied, skipped, err
+	}
+
+	err = src.ScanDiffs(ctx, func(diff *Diff) error {
+		if expired(diff.ExpiresAt, now) {
+			return nil
+		}
+		var err error
+		if dryRun {
+			_, err = dst.GetDiff(ctx, diff.PK)
+			switch {
+			case errors.Is(err, ErrNotFound) && !errors.Is(err, ErrExpired):
+				err = nil
+			case err == nil, errors.Is(err, ErrExpired):
+				err = ErrConflict
+			}
+		} else {
+			err = dst.ImportDiff(ctx, diff)
+		}
+		if errors.Is(err, ErrConflict) {
+			skipped.diffs++
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("diff %s: %w", diff.PK, err)
+		}
+		copied.diffs++
+		return nil
+	})
+	return copied, skipped, err
+}
+
+// countStore counts the pastes, revisions and diffs of store that have not
+// expired
+func countStore(ctx context.Context, store migrationStore) (migrationCounts, error) {
+	var c migrationCounts
+	now := time.Now()
+	err := store.ScanPastes(ctx, func(revisions []*Paste) error {
+		if !expired(revisions[len(revisions)-1].ExpiresAt, now) {
+			c.pastes++
+			c.revisions += len(revisions)
+		}
+		return nil
+	})
+	if err != nil {
+		return c, err
+	}
+	err = store.ScanDiffs(ctx, func(diff *Diff) error {
+		if !expired(diff.ExpiresAt, now) {
+			c.diffs++
+		}
+		return nil
+	})
+	return c, err
+}
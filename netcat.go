@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
+	"go.uber.org/zap"
+)
+
+// netcatReadTimeout bounds how long a netcat client may take to send its
+// paste, so idle connections are not held open
+var netcatReadTimeout = time.Duration(envInt64("PBIN_NC_TIMEOUT_SECONDS", 10)) * time.Second
+
+// serveNetcat accepts pastes on a raw TCP port, termbin style:
+//
+//	some-cmd | nc pbin.example.com 9999
+//
+// Everything sent until EOF, the size limit or the read timeout becomes a
+// paste. The link to it and, on a second line, its owner token are written
+// back before the connection closes. lmt is shared with the HTTP create
+// routes so a client cannot get around one by switching to the other.
+func serveNetcat(port, httpPort string, store DataStore, lmt *limiter.Limiter, sugar *zap.SugaredLogger) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	sugar.Infow("starting_netcat_server", "port", port)
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go handleNetcat(conn, store, lmt, httpPort, sugar)
+	}
+}
+
+// handleNetcat reads one paste from conn and replies with its link and
+// owner token
+func handleNetcat(conn net.Conn, store DataStore, lmt *limiter.Limiter, httpPort string, sugar *zap.SugaredLogger) {
+	defer conn.Close()
+
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if tollbooth.LimitByKeys(lmt, []string{ip}) != nil {
+		sugar.Warnw("netcat_rate_limited", "remote_addr", ip)
+		fmt.Fprintln(conn, rateLimitedMessage)
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(netcatReadTimeout))
+	// read one byte past the limit to tell a paste that fits exactly from
+	// one that is too large
+	body, err := io.ReadAll(io.LimitReader(conn, maxPasteBytes+1))
+	var ne net.Error
+	if err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+		sugar.Warnw("failed_to_read_netcat_paste", "remote_addr", ip, "error", err)
+		return
+	}
+	if int64(len(body)) > maxPasteBytes {
+		fmt.Fprintf(conn, "paste too large, the limit is %d bytes\n", maxPasteBytes)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		fmt.Fprintln(conn, "empty paste")
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(netcatReadTimeout))
+	// the client has nothing to cancel with, so the paste gets as long as a
+	// title and a store write may take
+	ctx, cancel := withTimeout(context.Background(), openAITimeout+storeWriteTimeout)
+	defer cancel()
+	id, token, err := createPaste(ctx, store, &createPasteRequest{
+		Text:     string(body),
+		Language: guessLanguage(string(body)),
+	}, sugar)
+	if err != nil {
+		fmt.Fprintln(conn, "failed to store paste")
+		return
+	}
+
+	sugar.Infow("netcat_paste_added", "id", id, "remote_addr", ip, "text_length", len(body))
+	fmt.Fprintln(conn, pasteLink(netcatBaseURL(conn, httpPort), id))
+	fmt.Fprintln(conn, token)
+}
+
+// netcatBaseURL is PBIN_URL, or when that is not set the HTTP server on the
+// host the connection was made to
+func netcatBaseURL(conn net.Conn, httpPort string) string {
+	if PBIN_URL != "" {
+		return strings.TrimSuffix(PBIN_URL, "/")
+	}
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return "http://" + net.JoinHostPort(host, httpPort)
+}
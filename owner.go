@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+)
+
+// ownerTokenHeader carries the owner token back to the creator of a paste
+// or diff, and from them on DELETE, PUT and PATCH requests
+const ownerTokenHeader = "X-Owner-Token"
+
+// newOwnerToken returns a random secret for the creator of a paste or diff
+// and the hash of it that is stored on the record
+func newOwnerToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOwnerToken(token), nil
+}
+
+// hashOwnerToken hashes a token for storage. The tokens are random, so a
+// plain SHA-256 is enough to keep a leaked database from granting access.
+func hashOwnerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ownerTokenMatches reports whether token belongs to a record stored with
+// hash. Records created before owner tokens existed have no hash and never
+// match.
+func ownerTokenMatches(hash, token string) bool {
+	if hash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashOwnerToken(token))) == 1
+}
+
+// requestOwnerToken returns the owner token sent with a request, either in
+// the X-Owner-Token header or the token form value
+func requestOwnerToken(request *http.Request) string {
+	if token := request.Header.Get(ownerTokenHeader); token != "" {
+		return token
+	}
+	return request.FormValue("token")
+}
+
+// checkOwnerToken writes the error response and returns false unless the
+// request carries the owner token for a record stored with hash
+func checkOwnerToken(writer http.ResponseWriter, request *http.Request, hash string) bool {
+	token := requestOwnerToken(request)
+	if token == "" {
+		writeError(writer, http.StatusUnauthorized, errCodeUnauthorized, "owner token required")
+		return false
+	}
+	if !ownerTokenMatches(hash, token) {
+		writeError(writer, http.StatusForbidden, errCodeForbidden, "invalid owner token")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/metadata"
+)
+
+// passwordHeader carries the password of a protected paste or diff, on
+// creation and on every read
+const passwordHeader = "X-Paste-Password"
+
+// errPasswordRequired is returned for a protected paste or diff read with
+// no password or a wrong one, which are not told apart
+var errPasswordRequired = errors.New("password required")
+
+// passwordThrottledError is returned for a paste or diff that has had too
+// many wrong passwords, until RetryAfter has passed
+type passwordThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *passwordThrottledError) Error() string {
+	return fmt.Sprintf("too many wrong passwords, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// hashPassword returns the bcrypt hash of password stored on the record, or
+// "" when there is none
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	// bcrypt ignores everything after 72 bytes
+	if len(password) > 72 {
+		return "", &invalidRequestError{"password must be at most 72 bytes"}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// passwordThrottle counts the wrong passwords tried on each id and locks
+// an id out once maxFailures have been tried within window of each other.
+// It only covers the replica it runs on.
+type passwordThrottle struct {
+	mu          sync.Mutex
+	maxFailures int64
+	window      time.Duration
+	ids         map[string]*passwordFailures
+}
+
+// passwordFailures are the wrong passwords tried on one id
+type passwordFailures struct {
+	count int64
+	last  time.Time
+}
+
+// passwords throttles every password check of the process
+var passwords = &passwordThrottle{
+	maxFailures: envInt64("PBIN_PASSWORD_MAX_FAILURES", 5),
+	window:      time.Duration(envInt64("PBIN_PASSWORD_LOCKOUT_SECONDS", 300)) * time.Second,
+	ids:         make(map[string]*passwordFailures),
+}
+
+// wait returns how long id is locked out for, zero if it is not
+func (t *passwordThrottle) wait(id string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.ids[id]
+	if !ok || f.count < t.maxFailures {
+		return 0
+	}
+	return f.last.Add(t.window).Sub(now)
+}
+
+// attempt counts a password tried on id as wrong until forgive says
+// otherwise, and returns how long id is locked out for instead when it is.
+// Counting before the password is compared keeps concurrent guesses from
+// all getting in ahead of the first failure. Failures further apart than
+// the window start counting afresh.
+func (t *passwordThrottle) attempt(id string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.ids[id]
+	if ok && f.count >= t.maxFailures {
+		if wait := f.last.Add(t.window).Sub(now); wait > 0 {
+			return wait
+		}
+	}
+	if !ok || now.Sub(f.last) > t.window {
+		f = &passwordFailures{}
+		t.ids[id] = f
+	}
+	f.count++
+	f.last = now
+
+	// drop ids nobody has tried for a while so the map does not grow
+	// without bound
+	if len(t.ids) > 10000 {
+		for id, f := range t.ids {
+			if now.Sub(f.last) > t.window {
+				delete(t.ids, id)
+			}
+		}
+	}
+	return 0
+}
+
+// forgive takes back the attempt counted on id for a password that turned
+// out to be right
+func (t *passwordThrottle) forgive(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.ids[id]; ok && f.count > 0 {
+		f.count--
+	}
+}
+
+// checkPassword returns nil if password opens a record stored with hash or
+// the record has none, errPasswordRequired if it does not and a
+// passwordThrottledError while id is locked out. Only wrong passwords
+// count towards the lockout, not missing ones.
+func checkPassword(id, hash, password string) error {
+	if hash == "" {
+		return nil
+	}
+	now := time.Now()
+	if password == "" {
+		if wait := passwords.wait(id, now); wait > 0 {
+			return &passwordThrottledError{RetryAfter: wait}
+		}
+		return errPasswordRequired
+	}
+	if wait := passwords.attempt(id, now); wait > 0 {
+		return &passwordThrottledError{RetryAfter: wait}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errPasswordRequired
+	}
+	passwords.forgive(id)
+	return nil
+}
+
+// requestPassword returns the password sent with a request, either in the
+// X-Paste-Password header or the password value of a form body. The query
+// string is never read, as it ends up in access logs, history and Referer
+// headers.
+func requestPassword(request *http.Request) string {
+	if password := request.Header.Get(passwordHeader); password != "" {
+		return password
+	}
+	return request.PostFormValue("password")
+}
+
+// grpcPassword returns the password sent in the x-paste-password metadata
+// of a gRPC call, as the proto requests have no field for it
+func grpcPassword(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(strings.ToLower(passwordHeader)); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// isPasswordError reports whether err is a rejected or throttled password
+func isPasswordError(err error) bool {
+	return errors.Is(err, errPasswordRequired) || errors.As(err, new(*passwordThrottledError))
+}
+
+// getDiff reads a diff once password opens it
+func getDiff(ctx context.Context, store DataStore, id, password string) (*Diff, error) {
+	diff, err := store.GetDiff(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPassword(id, diff.PasswordHash, password); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// stubPasswords gives the test a throttle of its own, locking an id out
+// after maxFailures wrong passwords
+func stubPasswords(t *testing.T, maxFailures int64) {
+	t.Helper()
+	saved := passwords
+	t.Cleanup(func() { passwords = saved })
+	passwords = &passwordThrottle{
+		maxFailures: maxFailures,
+		window:      time.Minute,
+		ids:         make(map[string]*passwordFailures),
+	}
+}
+
+// testPasswordHash hashes password at the lowest cost, to keep tests quick
+func testPasswordHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestCheckPasswordLocksOut(t *testing.T) {
+	stubPasswords(t, 3)
+	hash := testPasswordHash(t, "hunter2")
+
+	for i, tc := range []struct {
+		password  string
+		throttled bool
+	}{
+		{"", false},
+		{"wrong", false},
+		{"wrong", false},
+		// the right password, and a missing one, do not count
+		{"hunter2", false},
+		{"", false},
+		{"wrong", false},
+		{"hunter2", true},
+		{"", true},
+	} {
+		err := checkPassword("id", hash, tc.password)
+		if throttled := errors.As(err, new(*passwordThrottledError)); throttled != tc.throttled {
+			t.Errorf("check %d with %q = %v, want throttled %v", i, tc.password, err, tc.throttled)
+		}
+		if !tc.throttled && (err == nil) != (tc.password == "hunter2") {
+			t.Errorf("check %d with %q = %v", i, tc.password, err)
+		}
+	}
+	// other ids are not locked out
+	if err := checkPassword("other", hash, "hunter2"); err != nil {
+		t.Errorf("check of another id = %v, want nil", err)
+	}
+}
+
+func TestCheckPasswordLocksOutConcurrentGuesses(t *testing.T) {
+	stubPasswords(t, 3)
+	hash := testPasswordHash(t, "hunter2")
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		compared int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := checkPassword("id", hash, "wrong"); errors.Is(err, errPasswordRequired) {
+				mu.Lock()
+				compared++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if compared != 3 {
+		t.Errorf("%d concurrent guesses were compared, want 3", compared)
+	}
+}
+
+func TestRequestPasswordIgnoresQuery(t *testing.T) {
+	request := httptest.NewRequest("GET", "/api/paste?id=x&password=hunter2", nil)
+	if got := requestPassword(request); got != "" {
+		t.Errorf("password from the query string = %q, want none", got)
+	}
+
+	request = httptest.NewRequest("POST", "/api/paste?password=query", strings.NewReader("password=form"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if got := requestPassword(request); got != "form" {
+		t.Errorf("password from a form body = %q, want form", got)
+	}
+	request.Header.Set(passwordHeader, "header")
+	if got := requestPassword(request); got != "header" {
+		t.Errorf("password with the header set = %q, want header", got)
+	}
+}
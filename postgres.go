@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.uber.org/zap"
+)
+
+// postgresDialect is the schema of the PostgreSQL store. Every replica
+// runs the migrations on startup, serialised by an advisory lock.
+var postgresDialect = &sqlDialect{
+	name:           "postgres",
+	numberedParams: true,
+	// the key is arbitrary, it only has to be the same for every replica
+	migrationLock: `SELECT pg_advisory_xact_lock(7262348)`,
+	forUpdate:     ` FOR UPDATE`,
+	migrations: []string{
+		`CREATE TABLE pastes (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMPTZ NOT NULL,
+			language TEXT NOT NULL DEFAULT '',
+			title TEXT NOT NULL DEFAULT '',
+			text TEXT NOT NULL,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			burn_after_reading BOOLEAN NOT NULL DEFAULT FALSE,
+			burned BOOLEAN NOT NULL DEFAULT FALSE,
+			owner_token_hash TEXT NOT NULL DEFAULT '',
+			revision INTEGER NOT NULL DEFAULT 1
+		);
+		CREATE INDEX pastes_created_at ON pastes (created_at);
+		CREATE INDEX pastes_expires_at ON pastes (expires_at) WHERE expires_at <> 0;
+
+		CREATE TABLE paste_revisions (
+			id TEXT NOT NULL,
+			revision INTEGER NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			language TEXT NOT NULL DEFAULT '',
+			title TEXT NOT NULL DEFAULT '',
+			text TEXT NOT NULL,
+			PRIMARY KEY (id, revision)
+		);
+
+		CREATE TABLE diffs (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMPTZ NOT NULL,
+			old_text TEXT NOT NULL,
+			new_text TEXT NOT NULL,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			owner_token_hash TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX diffs_created_at ON diffs (created_at);
+		CREATE INDEX diffs_expires_at ON diffs (expires_at) WHERE expires_at <> 0;`,
+		// search is kept up to date by postgres itself, so pastes can be
+		// found with `WHERE search @@ websearch_to_tsquery('simple', $1)`
+		// without the store having to know about it
+		`ALTER TABLE pastes ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+			setweight(to_tsvector('simple', title), 'A') ||
+			setweight(to_tsvector('simple', text), 'B')
+		) STORED;
+		CREATE INDEX pastes_search ON pastes USING GIN (search);`,
+		// compressed texts are only searchable by their title
+		`ALTER TABLE pastes ADD COLUMN encoding TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN encoding TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN encoding TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pastes DROP COLUMN search;
+		ALTER TABLE pastes ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+			setweight(to_tsvector('simple', title), 'A') ||
+			setweight(to_tsvector('simple', CASE WHEN encoding = '' THEN text ELSE '' END), 'B')
+		) STORED;
+		CREATE INDEX pastes_search ON pastes USING GIN (search);`,
+		`ALTER TABLE pastes ADD COLUMN blob_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN blob_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN blob_key TEXT NOT NULL DEFAULT '';`,
+		// nor shared ones, which leave an empty text behind in pastes
+		`CREATE TABLE bodies (
+			hash TEXT PRIMARY KEY,
+			text TEXT NOT NULL,
+			refs INTEGER NOT NULL,
+			expires_at BIGINT NOT NULL DEFAULT 0,
+			encoding TEXT NOT NULL DEFAULT '',
+			blob_key TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX bodies_expires_at ON bodies (expires_at) WHERE expires_at <> 0;
+		ALTER TABLE pastes ADD COLUMN body_hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN body_hash TEXT NOT NULL DEFAULT '';`,
+		// neither are encrypted ones
+		`ALTER TABLE pastes ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pastes ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE bodies ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE bodies ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pastes DROP COLUMN search;
+		ALTER TABLE pastes ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+			setweight(to_tsvector('simple', title), 'A') ||
+			setweight(to_tsvector('simple', CASE WHEN encoding = '' AND key_id = '' THEN text ELSE '' END), 'B')
+		) STORED;
+		CREATE INDEX pastes_search ON pastes USING GIN (search);`,
+		// nor ones encrypted by their client
+		`ALTER TABLE pastes ADD COLUMN kind TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pastes DROP COLUMN search;
+		ALTER TABLE pastes ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (
+			setweight(to_tsvector('simple', title), 'A') ||
+			setweight(to_tsvector('simple', CASE WHEN encoding = '' AND key_id = '' AND kind = '' THEN text ELSE '' END), 'B')
+		) STORED;
+		CREATE INDEX pastes_search ON pastes USING GIN (search);`,
+		`ALTER TABLE pastes ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';`,
+		// the expiry of every reference to a body, as a JSON array
+		`ALTER TABLE bodies ADD COLUMN expiries TEXT NOT NULL DEFAULT '';`,
+	},
+}
+
+// NewPostgresStore connects to the PostgreSQL database at POSTGRES_DSN and
+// migrates it. POSTGRES_MAX_OPEN_CONNS and POSTGRES_MAX_IDLE_CONNS size the
+// connection pool of each replica.
+func NewPostgresStore() (*SQLStore, error) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		return nil, fmt.Errorf("POSTGRES_DSN not set")
+	}
+	return openPostgresStore(dsn)
+}
+
+// openPostgresStore connects to the PostgreSQL database at dsn and migrates
+// it
+func openPostgresStore(dsn string) (*SQLStore, error) {
+	sugar := zap.L().Sugar()
+
+	sugar.Info("initializing_postgres_store")
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		sugar.Errorw("failed_to_open_postgres_db", "error", err)
+		return nil, err
+	}
+	db.SetMaxOpenConns(int(envInt64("POSTGRES_MAX_OPEN_CONNS", 10)))
+	db.SetMaxIdleConns(int(envInt64("POSTGRES_MAX_IDLE_CONNS", 5)))
+	// recycle connections so replicas rebalance after a failover
+	db.SetConnMaxLifetime(30 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		sugar.Errorw("failed_to_connect_to_postgres", "error", err)
+		return nil, err
+	}
+
+	s, err := newSQLStore(db, postgresDialect)
+	if err != nil {
+		db.Close()
+		sugar.Errorw("failed_to_initialize_postgres_store", "error", err)
+		return nil, err
+	}
+	sugar.Info("postgres_store_initialized_successfully")
+	return s, nil
+}
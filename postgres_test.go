@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// newTestPostgresStore opens a SQLStore in a schema of its own on the
+// database at POSTGRES_DSN, dropping the schema when the test ends. Tests
+// using it are skipped when POSTGRES_DSN is not set.
+func newTestPostgresStore(t *testing.T) *SQLStore {
+	t.Helper()
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN not set")
+	}
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("pbin_test_%s", base62ID(12))
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+	})
+
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("parsing POSTGRES_DSN: %v", err)
+	}
+	config.RuntimeParams["search_path"] = schema
+	s, err := openPostgresStore(stdlib.RegisterConnConfig(config))
+	if err != nil {
+		t.Fatalf("openPostgresStore: %v", err)
+	}
+	// registered after the schema cleanup so it runs first
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestPostgresStore(t *testing.T) {
+	if os.Getenv("POSTGRES_DSN") == "" {
+		t.Skip("POSTGRES_DSN not set")
+	}
+	testSQLStore(t, newTestPostgresStore)
+}
+
+func TestPostgresSearchColumn(t *testing.T) {
+	s := newTestPostgresStore(t)
+	ctx := context.Background()
+
+	id, err := s.AddPaste(ctx, &Paste{Text: "a walrus in the code", Title: "zoo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found string
+	err = s.db.QueryRowContext(ctx, `SELECT id FROM pastes WHERE search @@ plainto_tsquery('simple', 'walrus')`).Scan(&found)
+	if err != nil || found != id {
+		t.Errorf("searching the paste text = %q, %v, want %q", found, err, id)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// languageExtensions maps the Monaco language ids stored in
+// Paste.Language to the file extension used for downloads
+var languageExtensions = map[string]string{
+	"bat":         ".bat",
+	"c":           ".c",
+	"clojure":     ".clj",
+	"coffee":      ".coffee",
+	"cpp":         ".cpp",
+	"csharp":      ".cs",
+	"css":         ".css",
+	"csv":         ".csv",
+	"dart":        ".dart",
+	"dockerfile":  ".dockerfile",
+	"elixir":      ".ex",
+	"erlang":      ".erl",
+	"fsharp":      ".fs",
+	"go":          ".go",
+	"graphql":     ".graphql",
+	"groovy":      ".groovy",
+	"haskell":     ".hs",
+	"hcl":         ".tf",
+	"html":        ".html",
+	"ini":         ".ini",
+	"java":        ".java",
+	"javascript":  ".js",
+	"json":        ".json",
+	"julia":       ".jl",
+	"kotlin":      ".kt",
+	"less":        ".less",
+	"lua":         ".lua",
+	"makefile":    ".mk",
+	"markdown":    ".md",
+	"mermaid":     ".mmd",
+	"mysql":       ".sql",
+	"objective-c": ".m",
+	"ocaml":       ".ml",
+	"pascal":      ".pas",
+	"perl":        ".pl",
+	"pgsql":       ".sql",
+	"php":         ".php",
+	"powershell":  ".ps1",
+	"python":      ".py",
+	"r":           ".r",
+	"ruby":        ".rb",
+	"rust":        ".rs",
+	"scala":       ".scala",
+	"scss":        ".scss",
+	"shell":       ".sh",
+	"sql":         ".sql",
+	"swift":       ".swift",
+	"toml":        ".toml",
+	"typescript":  ".ts",
+	"xml":         ".xml",
+	"yaml":        ".yaml",
+}
+
+// pasteFilename is the name a paste is downloaded as
+func pasteFilename(paste *Paste) string {
+	ext, ok := languageExtensions[strings.ToLower(paste.Language)]
+	if !ok {
+		ext = ".txt"
+	}
+	if paste.Kind == pasteKindEncrypted {
+		ext = ".bin"
+	}
+	return paste.PK + ext
+}
+
+// pasteFromPath loads the paste named by the last element of the request
+// path, honouring ?rev=N, and writes the error response if that fails. A
+// HEAD request, as sent by link checkers, never burns the paste.
+func pasteFromPath(store DataStore, writer http.ResponseWriter, request *http.Request, prefix string, sugar *zap.SugaredLogger) *Paste {
+	id := strings.TrimPrefix(request.URL.Path, prefix)
+	if id == "" || strings.Contains(id, "/") {
+		writeError(writer, http.StatusNotFound, errCodeNotFound, "paste not found")
+		return nil
+	}
+
+	var paste *Paste
+	var err error
+	if rev := request.URL.Query().Get("rev"); rev != "" {
+		n, convErr := strconv.Atoi(rev)
+		if convErr != nil || n < 1 {
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("invalid revision %q", rev))
+			return nil
+		}
+		paste, err = getRevision(request.Context(), store, id, n, requestPassword(request))
+	} else if request.Method == "HEAD" {
+		paste, err = openPaste(request.Context(), store, id, requestPassword(request))
+	} else {
+		paste, err = getPaste(request.Context(), store, id, requestPassword(request))
+	}
+	if err != nil {
+		sugar.Warnw("failed_to_get_raw_paste", "id", id, "error", err)
+		writeStoreError(writer, err, "paste")
+		return nil
+	}
+	return paste
+}
+
+// writeRawPaste writes the text of a paste as is. Text that is not valid
+// UTF-8 is served as an octet stream rather than with a wrong charset, as
+// is the binary nonce and ciphertext of an encrypted paste.
+func writeRawPaste(writer http.ResponseWriter, paste *Paste) {
+	body := []byte(paste.Text)
+	contentType := "text/plain; charset=utf-8"
+	if paste.Kind == pasteKindEncrypted {
+		// checked when it was stored
+		body, _ = base64.StdEncoding.DecodeString(paste.Text)
+		contentType = "application/octet-stream"
+	} else if !utf8.ValidString(paste.Text) {
+		contentType = "application/octet-stream"
+	}
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	// never let a browser render user content as anything but text
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := writer.Write(body); err != nil {
+		zap.L().Sugar().Warnw("failed_to_write_raw_paste", "id", paste.PK, "error", err)
+	}
+}
+
+// pasteLink is the short link to a paste, which handleShortLink sends on
+// to its page
+func pasteLink(base, id string) string {
+	return base + "/p/" + id
+}
+
+// handleShortLink redirects GET /p/{id} to the page of the paste, keeping
+// the query string. A URL fragment, such as the key of an encrypted paste,
+// is kept by the browser.
+func handleShortLink(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		writeMethodNotAllowed(writer, request)
+		return
+	}
+	id := strings.TrimPrefix(request.URL.Path, "/p/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(writer, http.StatusNotFound, errCodeNotFound, "paste not found")
+		return
+	}
+	q := request.URL.Query()
+	q.Set("id", id)
+	http.Redirect(writer, request, "/paste?"+q.Encode(), http.StatusFound)
+}
+
+// handleRaw serves GET /raw/{id} as plain text
+func handleRaw(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sugar := zap.L().Sugar()
+
+		if request.Method != "GET" && request.Method != "HEAD" {
+			writeMethodNotAllowed(writer, request)
+			return
+		}
+
+		paste := pasteFromPath(store, writer, request, "/raw/", sugar)
+		if paste == nil {
+			return
+		}
+		writeRawPaste(writer, paste)
+	}
+}
+
+// handleDownload serves GET /download/{id} as an attachment named after the
+// paste id with an extension for its language
+func handleDownload(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sugar := zap.L().Sugar()
+
+		if request.Method != "GET" && request.Method != "HEAD" {
+			writeMethodNotAllowed(writer, request)
+			return
+		}
+
+		paste := pasteFromPath(store, writer, request, "/download/", sugar)
+		if paste == nil {
+			return
+		}
+		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", pasteFilename(paste)))
+		writeRawPaste(writer, paste)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// createPasteRequest is the body of POST /api/paste. The JSON field names
+// follow CreatePasteRequest in proto/pastebin.proto; lang is accepted as
+// well since that is what the form uses.
+type createPasteRequest struct {
+	Text     string `json:"text"`
+	Language string `json:"language"`
+	Lang     string `json:"lang"`
+	Expiry   string `json:"expiry"`
+	Burn     bool   `json:"burn"`
+	// Hash names the stored text of another paste, as returned by GET
+	// /api/paste, to use when Text is empty
+	Hash string `json:"hash"`
+	// Kind is pasteKindEncrypted when Text is ciphertext
+	Kind string `json:"kind"`
+	// Password, when set, has to be sent to read the paste
+	Password string `json:"password"`
+	// Slug is the id the paste should have instead of a generated one
+	Slug string `json:"slug"`
+	// Raw is set when the whole body is the paste text, as sent by
+	// `curl --data-binary @-`, and the response is just the link
+	Raw bool `json:"-"`
+}
+
+// createDiffRequest is the body of POST /api/diff, following
+// CreateDiffRequest in proto/pastebin.proto
+type createDiffRequest struct {
+	Original string `json:"original"`
+	Modified string `json:"modified"`
+	Expiry   string `json:"expiry"`
+	Password string `json:"password"`
+	Slug     string `json:"slug"`
+}
+
+// isJSON reports whether the request body is JSON
+func isJSON(request *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// isRawBody reports whether the request body is the paste text itself
+func isRawBody(request *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return mediaType == "text/plain" || mediaType == "application/octet-stream"
+}
+
+// maxPasteBytes limits the size of a paste or diff request body
+var maxPasteBytes = envInt64("PBIN_MAX_PASTE_BYTES", 10<<20)
+
+// envInt64 reads an integer setting from the environment, falling back to
+// def when it is unset or malformed
+func envInt64(name string, def int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// wantsJSON reports whether the client asked for a JSON response rather
+// than a redirect, either by sending JSON or through its Accept header
+func wantsJSON(request *http.Request) bool {
+	return isJSON(request) || strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+// parsePasteRequest reads a paste from a JSON, form or raw text body. The
+// password may also come in the X-Paste-Password header, which is the only
+// way to send one with a raw body.
+func parsePasteRequest(writer http.ResponseWriter, request *http.Request) (*createPasteRequest, error) {
+	request.Body = http.MaxBytesReader(writer, request.Body, maxPasteBytes)
+	if isRawBody(request) {
+		return parseRawPasteRequest(request)
+	}
+
+	req := &createPasteRequest{}
+	if isJSON(request) {
+		if err := json.NewDecoder(request.Body).Decode(req); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		if req.Language == "" {
+			req.Language = req.Lang
+		}
+		if req.Password == "" {
+			req.Password = request.Header.Get(passwordHeader)
+		}
+		return req, nil
+	}
+
+	if err := request.ParseForm(); err != nil {
+		return nil, fmt.Errorf("ParseForm() err: %w", err)
+	}
+	req.Text = request.FormValue("text")
+	req.Language = request.FormValue("lang")
+	req.Expiry = request.FormValue("expiry")
+	req.Burn = formBool(request.FormValue("burn"))
+	req.Hash = request.FormValue("hash")
+	req.Kind = request.FormValue("kind")
+	req.Password = requestPassword(request)
+	req.Slug = request.FormValue("slug")
+	return req, nil
+}
+
+// parseRawPasteRequest reads a paste whose text is the whole request body.
+// The language, expiry, burn, kind and slug options come from the query string,
+// and the language is guessed when it is not given. The body of an
+// encrypted paste is the binary nonce and ciphertext. A password can only
+// come in the X-Paste-Password header, never in the URL.
+func parseRawPasteRequest(request *http.Request) (*createPasteRequest, error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	q := request.URL.Query()
+	req := &createPasteRequest{
+		Text:     string(body),
+		Language: q.Get("lang"),
+		Expiry:   q.Get("expiry"),
+		Burn:     formBool(q.Get("burn")),
+		Kind:     q.Get("kind"),
+		Password: request.Header.Get(passwordHeader),
+		Slug:     q.Get("slug"),
+		Raw:      true,
+	}
+	if req.Kind == pasteKindEncrypted {
+		req.Text = base64.StdEncoding.EncodeToString(body)
+	}
+	if req.Language == "" {
+		req.Language = q.Get("language")
+	}
+	if req.Language == "" && req.Kind != pasteKindEncrypted {
+		req.Language = guessLanguage(req.Text)
+	}
+	return req, nil
+}
+
+// errEncryptedPaste is returned for pastes encrypted by their client where
+// the server would need their text
+var errEncryptedPaste = &invalidRequestError{"paste is encrypted by its client and can only be read there"}
+
+// checkKind rejects unknown kinds and encrypted pastes whose text is not
+// base64 of at least a nonce and an authentication tag
+func checkKind(kind, text string) error {
+	switch kind {
+	case "":
+		return nil
+	case pasteKindEncrypted:
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || len(b) < 12+16 {
+			return &invalidRequestError{"text of an encrypted paste must be the base64 of its nonce and ciphertext"}
+		}
+		return nil
+	}
+	return &invalidRequestError{fmt.Sprintf("unknown kind %q", kind)}
+}
+
+// parseDiffRequest reads a diff from either a JSON or a form body
+func parseDiffRequest(writer http.ResponseWriter, request *http.Request) (*createDiffRequest, error) {
+	request.Body = http.MaxBytesReader(writer, request.Body, maxPasteBytes)
+	req := &createDiffRequest{}
+	if isJSON(request) {
+		if err := json.NewDecoder(request.Body).Decode(req); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		if req.Password == "" {
+			req.Password = request.Header.Get(passwordHeader)
+		}
+		return req, nil
+	}
+
+	if err := request.ParseForm(); err != nil {
+		return nil, fmt.Errorf("ParseForm() err: %w", err)
+	}
+	req.Original = request.FormValue("original")
+	req.Modified = request.FormValue("modified")
+	req.Expiry = request.FormValue("expiry")
+	req.Password = requestPassword(request)
+	req.Slug = request.FormValue("slug")
+	return req, nil
+}
+
+// baseURL is PBIN_URL, or when that is not set the scheme and host the
+// request was made to
+func baseURL(request *http.Request) string {
+	if PBIN_URL != "" {
+		return strings.TrimSuffix(PBIN_URL, "/")
+	}
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + request.Host
+}
+
+// writeCreated answers a create request with a JSON body holding the id,
+// the URL of the page showing it and the owner token
+func writeCreated(writer http.ResponseWriter, location, id, url, token string) {
+	writer.Header().Set("Location", location)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"id":    id,
+		"url":   url,
+		"token": token,
+	})
+}
+
+// writeRawCreated answers a raw create request with nothing but the link,
+// so `curl --data-binary @-` prints a single line
+func writeRawCreated(writer http.ResponseWriter, url, token string) {
+	writer.Header().Set(ownerTokenHeader, token)
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(writer, url)
+}
+
+// shebangLanguages maps interpreters named on a #! line to languages
+var shebangLanguages = map[string]string{
+	"bash":    "shell",
+	"sh":      "shell",
+	"zsh":     "shell",
+	"python":  "python",
+	"python3": "python",
+	"node":    "javascript",
+	"ruby":    "ruby",
+	"perl":    "perl",
+	"php":     "php",
+	"lua":     "lua",
+}
+
+// guessLanguage makes a cheap guess at the language of a raw paste from
+// its first line, falling back to plain text
+func guessLanguage(text string) string {
+	trimmed := strings.TrimSpace(text)
+	firstLine, _, _ := strings.Cut(trimmed, "\n")
+
+	switch {
+	case strings.HasPrefix(firstLine, "#!"):
+		fields := strings.Fields(strings.TrimPrefix(firstLine, "#!"))
+		if len(fields) == 0 {
+			return ""
+		}
+		interpreter := fields[0][strings.LastIndex(fields[0], "/")+1:]
+		if interpreter == "env" && len(fields) > 1 {
+			interpreter = fields[1]
+		}
+		return shebangLanguages[interpreter]
+	case strings.HasPrefix(firstLine, "package "):
+		return "go"
+	case strings.HasPrefix(firstLine, "<?xml"):
+		return "xml"
+	case strings.HasPrefix(strings.ToLower(firstLine), "<!doctype html"), strings.HasPrefix(firstLine, "<html"):
+		return "html"
+	case (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)):
+		return "json"
+	}
+	return ""
+}
+
+// handleRawPaste creates a paste from the whole body of a POST to /,
+// whatever content type the client claims, since curl sends
+// --data-binary as a form by default
+func handleRawPaste(store DataStore) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		sugar := zap.L().Sugar()
+
+		request.Body = http.MaxBytesReader(writer, request.Body, maxPasteBytes)
+		req, err := parseRawPasteRequest(request)
+		if err != nil {
+			sugar.Warnw("failed_to_read_raw_paste", "error", err)
+			writeBodyError(writer, err, "paste")
+			return
+		}
+
+		id, token, err := createPaste(request.Context(), store, req, sugar)
+		if err != nil {
+			writeStoreError(writer, err, "paste")
+			return
+		}
+		writeRawCreated(writer, pasteLink(baseURL(request), id), token)
+	}
+}
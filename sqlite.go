@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDialect is the schema of the SQLite store. created_at is stored as
+// SQLite's own date text and expires_at as unix seconds, zero meaning
+// never, so the file reads naturally in the sqlite3 shell.
+var sqliteDialect = &sqlDialect{
+	name: "sqlite",
+	migrations: []string{
+		`CREATE TABLE pastes (
+			id TEXT PRIMARY KEY,
+			created_at DATETIME NOT NULL,
+			language TEXT NOT NULL DEFAULT '',
+			title TEXT NOT NULL DEFAULT '',
+			text TEXT NOT NULL,
+			expires_at INTEGER NOT NULL DEFAULT 0,
+			burn_after_reading BOOLEAN NOT NULL DEFAULT 0,
+			burned BOOLEAN NOT NULL DEFAULT 0,
+			owner_token_hash TEXT NOT NULL DEFAULT '',
+			revision INTEGER NOT NULL DEFAULT 1
+		);
+		CREATE INDEX pastes_created_at ON pastes (created_at);
+		CREATE INDEX pastes_expires_at ON pastes (expires_at) WHERE expires_at <> 0;
+
+		CREATE TABLE paste_revisions (
+			id TEXT NOT NULL,
+			revision INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			language TEXT NOT NULL DEFAULT '',
+			title TEXT NOT NULL DEFAULT '',
+			text TEXT NOT NULL,
+			PRIMARY KEY (id, revision)
+		);
+
+		CREATE TABLE diffs (
+			id TEXT PRIMARY KEY,
+			created_at DATETIME NOT NULL,
+			old_text TEXT NOT NULL,
+			new_text TEXT NOT NULL,
+			expires_at INTEGER NOT NULL DEFAULT 0,
+			owner_token_hash TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX diffs_created_at ON diffs (created_at);
+		CREATE INDEX diffs_expires_at ON diffs (expires_at) WHERE expires_at <> 0;`,
+		`ALTER TABLE pastes ADD COLUMN encoding TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN encoding TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN encoding TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE pastes ADD COLUMN blob_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN blob_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN blob_key TEXT NOT NULL DEFAULT '';`,
+		`CREATE TABLE bodies (
+			hash TEXT PRIMARY KEY,
+			text TEXT NOT NULL,
+			refs INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL DEFAULT 0,
+			encoding TEXT NOT NULL DEFAULT '',
+			blob_key TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX bodies_expires_at ON bodies (expires_at) WHERE expires_at <> 0;
+		ALTER TABLE pastes ADD COLUMN body_hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN body_hash TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE pastes ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE pastes ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE paste_revisions ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN data_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE bodies ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE bodies ADD COLUMN data_key TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE pastes ADD COLUMN kind TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE pastes ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE diffs ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';`,
+		// the expiry of every reference to a body, as a JSON array
+		`ALTER TABLE bodies ADD COLUMN expiries TEXT NOT NULL DEFAULT '';`,
+	},
+}
+
+// NewSQLiteStore opens the SQLite database at SQLITE_PATH, creating and
+// migrating it as needed
+func NewSQLiteStore() (*SQLStore, error) {
+	path := os.Getenv("SQLITE_PATH")
+	if path == "" {
+		path = "pbin.sqlite"
+	}
+	return openSQLiteStore(path)
+}
+
+// openSQLiteStore opens the SQLite database at path, creating and
+// migrating it as needed
+func openSQLiteStore(path string) (*SQLStore, error) {
+	sugar := zap.L().Sugar()
+
+	sugar.Infow("initializing_sqlite_store", "sqlite_path", path)
+
+	// WAL lets other processes, like the sqlite3 shell, read while the
+	// server writes, and the busy timeout makes them wait on a lock rather
+	// than fail
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"journal_mode(WAL)", "busy_timeout(5000)"},
+		// store times in the format SQLite's date functions understand
+		"_time_format": {"sqlite"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		sugar.Errorw("failed_to_open_sqlite_db", "sqlite_path", path, "error", err)
+		return nil, err
+	}
+	// SQLite allows a single writer, queueing in the pool is cheaper than
+	// retrying on SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	s, err := newSQLStore(db, sqliteDialect)
+	if err != nil {
+		db.Close()
+		sugar.Errorw("failed_to_initialize_sqlite_store", "sqlite_path", path, "error", err)
+		return nil, err
+	}
+	sugar.Info("sqlite_store_initialized_successfully")
+	return s, nil
+}
@@ -0,0 +1,850 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sqlDialect holds what differs between the SQL databases SQLStore runs on
+type sqlDialect struct {
+	name string
+	// numberedParams is set for databases that want $1, $2, ... rather
+	// than ? as placeholders
+	numberedParams bool
+	// migrations are applied in order, each exactly once. Append new
+	// steps, never edit ones that have shipped.
+	migrations []string
+	// migrationLock, when set, is run at the start of every migration
+	// transaction to keep replicas starting together from racing
+	migrationLock string
+	// forUpdate is appended to a SELECT to lock the rows it reads until the
+	// transaction ends, on databases that lock rows rather than the whole
+	// database
+	forUpdate string
+}
+
+// rebind rewrites the ? placeholders of query for the dialect
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// SQLStore implements DataStore on a SQL database. Earlier revisions of a
+// paste live in paste_revisions, the current one in pastes.
+type SQLStore struct {
+	db      *sql.DB
+	dialect *sqlDialect
+	done    chan struct{}
+}
+
+// newSQLStore migrates db to the latest schema and starts the expiry
+// sweeper
+func newSQLStore(db *sql.DB, dialect *sqlDialect) (*SQLStore, error) {
+	s := &SQLStore{db: db, dialect: dialect, done: make(chan struct{})}
+	if err := s.migrate(context.Background()); err != nil {
+		return nil, fmt.Errorf("migrate %s schema: %w", dialect.name, err)
+	}
+	go s.sweepExpired(sweepInterval)
+	return s, nil
+}
+
+// migrate applies the migrations that have not run yet, recording each in
+// schema_migrations
+func (s *SQLStore) migrate(ctx context.Context) error {
+	sugar := zap.L().Sugar()
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.lockMigrations(ctx, tx); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL
+		)`)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range s.dialect.migrations {
+		version := i + 1
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			if err := s.lockMigrations(ctx, tx); err != nil {
+				return err
+			}
+			// read under the lock, another replica may just have applied it
+			var applied int
+			if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+				return err
+			}
+			if applied >= version {
+				return nil
+			}
+
+			sugar.Infow("applying_sql_migration", "dialect", s.dialect.name, "version", version)
+			if _, err := tx.ExecContext(ctx, s.dialect.migrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), version, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// lockMigrations takes the dialect's migration lock for the rest of tx
+func (s *SQLStore) lockMigrations(ctx context.Context, tx *sql.Tx) error {
+	if s.dialect.migrationLock == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, s.dialect.migrationLock)
+	return err
+}
+
+// inTx runs fn in a transaction, committing when it returns nil
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlQuerier is what *sql.DB and *sql.Tx have in common
+type sqlQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+const pasteColumns = `id, created_at, language, title, text, expires_at, burn_after_reading, burned, owner_token_hash, revision, encoding, blob_key, body_hash, key_id, data_key, kind, password_hash`
+
+// scanPaste reads a row selected with pasteColumns
+func scanPaste(row interface{ Scan(...interface{}) error }) (*Paste, error) {
+	var p Paste
+	var createdAt time.Time
+	err := row.Scan(&p.PK, &createdAt, &p.Language, &p.Title, &p.Text, &p.ExpiresAt,
+		&p.BurnAfterReading, &p.Burned, &p.OwnerTokenHash, &p.Revision, &p.Encoding, &p.BlobKey, &p.BodyHash, &p.KeyID, &p.DataKey, &p.Kind, &p.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	p.SK = newSK(createdAt)
+	return &p, nil
+}
+
+// pasteArgs are the values of pasteColumns for p
+func pasteArgs(p *Paste, createdAt time.Time) []interface{} {
+	return []interface{}{p.PK, createdAt, p.Language, p.Title, p.Text, p.ExpiresAt,
+		p.BurnAfterReading, p.Burned, p.OwnerTokenHash, p.revision(), p.Encoding, p.BlobKey, p.BodyHash, p.KeyID, p.DataKey, p.Kind, p.PasswordHash}
+}
+
+// placeholders returns n comma separated ? placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// getPaste reads the current revision of a paste, applying expiry and
+// burn-after-reading. With lock set the row stays locked until the
+// transaction q ends.
+func (s *SQLStore) getPaste(ctx context.Context, q sqlQuerier, id string, now time.Time, lock bool) (*Paste, error) {
+	query := `SELECT ` + pasteColumns + ` FROM pastes WHERE id = ?`
+	if lock {
+		query += s.dialect.forUpdate
+	}
+	paste, err := scanPaste(q.QueryRowContext(ctx, s.dialect.rebind(query), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expired(paste.ExpiresAt, now) {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrExpired)
+	}
+	if paste.Burned {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrAlreadyViewed)
+	}
+	return paste, nil
+}
+
+// GetPaste retrieves a paste from the database
+func (s *SQLStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := s.getPaste(ctx, s.db, id, time.Now(), false)
+	if err != nil {
+		zap.L().Sugar().Warnw("failed_to_get_paste_from_sql", "dialect", s.dialect.name, "id", id, "error", err)
+		return nil, err
+	}
+	return paste, nil
+}
+
+// TakePaste retrieves a paste, replacing a burn-after-reading paste with
+// its tombstone. The update only succeeds for the reader that still sees
+// the paste unburned, so concurrent readers cannot both get the text.
+func (s *SQLStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
+	now := time.Now()
+	paste, err := s.getPaste(ctx, s.db, id, now, false)
+	if err != nil {
+		return nil, err
+	}
+	if !paste.BurnAfterReading {
+		return paste, nil
+	}
+
+	tomb := paste.tombstone(now)
+	err = s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE pastes
+			SET burned = ?, language = '', title = '', text = '', encoding = '', blob_key = '', body_hash = '', key_id = '', data_key = '', expires_at = ?
+			WHERE id = ? AND burned = ?`), true, tomb.ExpiresAt, id, false)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("paste %s: %w", id, ErrAlreadyViewed)
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM paste_revisions WHERE id = ?`), id)
+		return err
+	})
+	if err != nil {
+		zap.L().Sugar().Warnw("failed_to_take_paste_from_sql", "dialect", s.dialect.name, "id", id, "error", err)
+		return nil, err
+	}
+	zap.L().Sugar().Infow("burned_paste_in_sql", "dialect", s.dialect.name, "id", id)
+	return paste, nil
+}
+
+// AddPaste adds a new paste to the database
+func (s *SQLStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	sugar := zap.L().Sugar()
+
+	now := time.Now().UTC()
+	paste.SK = newSK(now)
+	paste.Revision = 1
+
+	_, err := assignID(paste.PK, func(id string) error {
+		paste.PK = id
+		res, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO pastes (`+pasteColumns+`) VALUES (`+placeholders(17)+`)
+			ON CONFLICT (id) DO NOTHING`), pasteArgs(paste, now)...)
+		return insertedNew(res, err, "paste", id)
+	})
+	if err != nil {
+		sugar.Errorw("failed_to_add_paste_to_sql", "dialect", s.dialect.name, "error", err)
+		return "", err
+	}
+
+	sugar.Infow("paste_added_to_sql",
+		"dialect", s.dialect.name,
+		"id", paste.PK,
+		"text_length", len(paste.Text),
+		"language", paste.Language,
+	)
+	return paste.PK, nil
+}
+
+// UpdatePaste moves the current revision of a paste to paste_revisions and
+// stores paste in its place. Concurrent edits queue on the row lock where
+// the database has one; the update is also conditional on the revision
+// read, so should two edits still overlap one fails with ErrConflict
+// instead of both claiming the same revision number.
+func (s *SQLStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	sugar := zap.L().Sugar()
+
+	now := time.Now().UTC()
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		current, err := s.getPaste(ctx, tx, paste.PK, now, true)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO paste_revisions (id, revision, created_at, language, title, text, encoding, blob_key, body_hash, key_id, data_key)
+			SELECT id, revision, created_at, language, title, text, encoding, blob_key, body_hash, key_id, data_key FROM pastes WHERE id = ?`), paste.PK)
+		if err != nil {
+			return err
+		}
+
+		paste.SK = newSK(now)
+		paste.Revision = current.revision() + 1
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE pastes
+			SET created_at = ?, language = ?, title = ?, text = ?, encoding = ?, blob_key = ?, body_hash = ?, key_id = ?, data_key = ?, revision = ?
+			WHERE id = ? AND revision = ?`),
+			now, paste.Language, paste.Title, paste.Text, paste.Encoding, paste.BlobKey, paste.BodyHash, paste.KeyID, paste.DataKey, paste.Revision, paste.PK, current.revision())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("paste %s was updated concurrently: %w", paste.PK, ErrConflict)
+		}
+		return nil
+	})
+	if err != nil {
+		sugar.Errorw("failed_to_update_paste_in_sql", "dialect", s.dialect.name, "id", paste.PK, "error", err)
+		return err
+	}
+
+	sugar.Infow("paste_updated_in_sql",
+		"dialect", s.dialect.name,
+		"id", paste.PK,
+		"revision", paste.Revision,
+	)
+	return nil
+}
+
+// ListRevisions returns every revision of a paste, oldest first
+func (s *SQLStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	current, err := s.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.revisions(ctx, current)
+}
+
+// revisions returns the revisions in paste_revisions of the paste current,
+// oldest first, followed by current itself
+func (s *SQLStore) revisions(ctx context.Context, current *Paste) ([]*Paste, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT revision, created_at, language, title, text, encoding, blob_key, body_hash, key_id, data_key
+		FROM paste_revisions WHERE id = ? ORDER BY revision`), current.PK)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*Paste
+	for rows.Next() {
+		p := &Paste{PK: current.PK, ExpiresAt: current.ExpiresAt, OwnerTokenHash: current.OwnerTokenHash,
+			Kind: current.Kind, PasswordHash: current.PasswordHash}
+		var createdAt time.Time
+		if err := rows.Scan(&p.Revision, &createdAt, &p.Language, &p.Title, &p.Text, &p.Encoding, &p.BlobKey, &p.BodyHash, &p.KeyID, &p.DataKey); err != nil {
+			return nil, err
+		}
+		p.SK = newSK(createdAt)
+		revisions = append(revisions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return append(revisions, current), nil
+}
+
+// GetRevision retrieves one revision of a paste
+func (s *SQLStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	revisions, err := s.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, rev)
+}
+
+// DeletePaste removes a paste and its revisions
+func (s *SQLStore) DeletePaste(ctx context.Context, id string) error {
+	return s.delete(ctx, "pastes", id)
+}
+
+const diffColumns = `id, created_at, old_text, new_text, expires_at, owner_token_hash, encoding, blob_key, key_id, data_key, password_hash`
+
+// scanDiff reads a row selected with diffColumns
+func scanDiff(row interface{ Scan(...interface{}) error }) (*Diff, error) {
+	var d Diff
+	var createdAt time.Time
+	if err := row.Scan(&d.PK, &createdAt, &d.OldText, &d.NewText, &d.ExpiresAt, &d.OwnerTokenHash, &d.Encoding, &d.BlobKey, &d.KeyID, &d.DataKey, &d.PasswordHash); err != nil {
+		return nil, err
+	}
+	d.SK = newSK(createdAt)
+	return &d, nil
+}
+
+// GetDiff retrieves a diff from the database
+func (s *SQLStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	d, err := scanDiff(s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+diffColumns+` FROM diffs WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("diff %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		zap.L().Sugar().Errorw("failed_to_get_diff_from_sql", "dialect", s.dialect.name, "id", id, "error", err)
+		return nil, err
+	}
+	if expired(d.ExpiresAt, time.Now()) {
+		return nil, fmt.Errorf("diff %s: %w", id, ErrExpired)
+	}
+	return d, nil
+}
+
+// AddDiff adds a new diff to the database
+func (s *SQLStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
+	now := time.Now().UTC()
+	diff.SK = newSK(now)
+
+	_, err := assignID(diff.PK, func(id string) error {
+		diff.PK = id
+		res, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO diffs (`+diffColumns+`) VALUES (`+placeholders(11)+`)
+			ON CONFLICT (id) DO NOTHING`), diff.PK, now, diff.OldText, diff.NewText, diff.ExpiresAt, diff.OwnerTokenHash, diff.Encoding, diff.BlobKey, diff.KeyID, diff.DataKey, diff.PasswordHash)
+		return insertedNew(res, err, "diff", id)
+	})
+	if err != nil {
+		zap.L().Sugar().Errorw("failed_to_add_diff_to_sql", "dialect", s.dialect.name, "error", err)
+		return "", err
+	}
+	zap.L().Sugar().Infow("diff_added_to_sql", "dialect", s.dialect.name, "id", diff.PK)
+	return diff.PK, nil
+}
+
+// insertedNew turns an INSERT ... ON CONFLICT DO NOTHING that inserted
+// nothing into ErrConflict, as the id of the row was taken
+func insertedNew(res sql.Result, err error, kind, id string) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%s %s: %w", kind, id, ErrConflict)
+	}
+	return nil
+}
+
+// DeleteDiff removes a diff from the database
+func (s *SQLStore) DeleteDiff(ctx context.Context, id string) error {
+	return s.delete(ctx, "diffs", id)
+}
+
+// delete removes the row with the given id from table, along with the
+// revisions of a paste
+func (s *SQLStore) delete(ctx context.Context, table, id string) error {
+	sugar := zap.L().Sugar()
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if table == "pastes" {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM paste_revisions WHERE id = ?`), id); err != nil {
+				return err
+			}
+		}
+		// table is one of our own constants, never user input
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM `+table+` WHERE id = ?`), id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%s %s: %w", table, id, ErrNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		sugar.Warnw("failed_to_delete_from_sql", "dialect", s.dialect.name, "table", table, "id", id, "error", err)
+		return err
+	}
+
+	sugar.Infow("deleted_from_sql", "dialect", s.dialect.name, "table", table, "id", id)
+	return nil
+}
+
+// scanPageSize is how many rows ScanPastes and ScanDiffs read per query
+const scanPageSize = 100
+
+// ScanPastes calls fn with the revisions of every paste, oldest first. The
+// table is read a page at a time in id order, so no cursor is held open
+// while fn runs.
+func (s *SQLStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	after := ""
+	for {
+		var page []*Paste
+		err := func() error {
+			rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT `+pasteColumns+` FROM pastes
+				WHERE id > ? ORDER BY id LIMIT ?`), after, scanPageSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				paste, err := scanPaste(rows)
+				if err != nil {
+					return err
+				}
+				page = append(page, paste)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return err
+		}
+
+		for _, current := range page {
+			revisions, err := s.revisions(ctx, current)
+			if err != nil {
+				return err
+			}
+			if err := fn(revisions); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1].PK
+	}
+}
+
+// ScanDiffs calls fn with every diff, a page at a time in id order
+func (s *SQLStore) ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error {
+	after := ""
+	for {
+		var page []*Diff
+		err := func() error {
+			rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT `+diffColumns+` FROM diffs
+				WHERE id > ? ORDER BY id LIMIT ?`), after, scanPageSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				diff, err := scanDiff(rows)
+				if err != nil {
+					return err
+				}
+				page = append(page, diff)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return err
+		}
+
+		for _, diff := range page {
+			if err := fn(diff); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		after = page[len(page)-1].PK
+	}
+}
+
+// ImportPaste writes the revisions of a paste, oldest first, as they are
+// in one transaction. It returns ErrConflict if the paste id is taken.
+func (s *SQLStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	current := revisions[len(revisions)-1]
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT COUNT(*) FROM pastes WHERE id = ?`), current.PK).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return fmt.Errorf("paste %s: %w", current.PK, ErrConflict)
+		}
+
+		for _, paste := range revisions[:len(revisions)-1] {
+			createdAt, err := parseSK(paste.SK)
+			if err != nil {
+				return fmt.Errorf("paste %s revision %d: %w", paste.PK, paste.revision(), err)
+			}
+			_, err = tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO paste_revisions (id, revision, created_at, language, title, text, encoding, blob_key, body_hash, key_id, data_key)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`), paste.PK, paste.revision(), createdAt.UTC(), paste.Language, paste.Title, paste.Text, paste.Encoding, paste.BlobKey, paste.BodyHash, paste.KeyID, paste.DataKey)
+			if err != nil {
+				return err
+			}
+		}
+		createdAt, err := parseSK(current.SK)
+		if err != nil {
+			return fmt.Errorf("paste %s: %w", current.PK, err)
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO pastes (`+pasteColumns+`) VALUES (`+placeholders(17)+`)`),
+			pasteArgs(current, createdAt.UTC())...)
+		return err
+	})
+}
+
+// ImportDiff writes diff as it is. It returns ErrConflict if the diff id is
+// taken.
+func (s *SQLStore) ImportDiff(ctx context.Context, diff *Diff) error {
+	createdAt, err := parseSK(diff.SK)
+	if err != nil {
+		return fmt.Errorf("diff %s: %w", diff.PK, err)
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT COUNT(*) FROM diffs WHERE id = ?`), diff.PK).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return fmt.Errorf("diff %s: %w", diff.PK, ErrConflict)
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO diffs (`+diffColumns+`) VALUES (`+placeholders(11)+`)`),
+			diff.PK, createdAt.UTC(), diff.OldText, diff.NewText, diff.ExpiresAt, diff.OwnerTokenHash, diff.Encoding, diff.BlobKey, diff.KeyID, diff.DataKey, diff.PasswordHash)
+		return err
+	})
+}
+
+// keyedTables are the tables holding encrypted texts, with the columns
+// that pick out a row
+var keyedTables = []struct {
+	name string
+	keys []string
+}{
+	{"pastes", []string{"id"}},
+	{"paste_revisions", []string{"id", "revision"}},
+	{"diffs", []string{"id"}},
+	{"bodies", []string{"hash"}},
+}
+
+// RewrapKeys rewrites key_id and data_key of every encrypted row, table by
+// table. A row is only updated if its data key is still the one read, so
+// one written in between, under the current key, is left alone.
+func (s *SQLStore) RewrapKeys(ctx context.Context, rewrap rewrapFunc) (int, error) {
+	n := 0
+	for _, table := range keyedTables {
+		changed, err := s.rewrapTable(ctx, table.name, table.keys, rewrap)
+		n += changed
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", table.name, err)
+		}
+	}
+	return n, nil
+}
+
+// rewrapTable rewrites the key fields of the encrypted rows of one table
+func (s *SQLStore) rewrapTable(ctx context.Context, table string, keys []string, rewrap rewrapFunc) (int, error) {
+	type row struct {
+		keyID, dataKey string
+		key            []interface{}
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT key_id, data_key, `+strings.Join(keys, ", ")+` FROM `+table+` WHERE key_id <> ''`)
+	if err != nil {
+		return 0, err
+	}
+	var stale []row
+	for rows.Next() {
+		r := row{key: make([]interface{}, len(keys))}
+		dest := []interface{}{&r.keyID, &r.dataKey}
+		for i := range r.key {
+			dest = append(dest, &r.key[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	where := make([]string, len(keys))
+	for i, k := range keys {
+		where[i] = k + " = ?"
+	}
+	update := s.dialect.rebind(`UPDATE ` + table + ` SET key_id = ?, data_key = ? WHERE ` + strings.Join(where, " AND ") + ` AND data_key = ?`)
+	n := 0
+	for _, r := range stale {
+		keyID, dataKey := r.keyID, r.dataKey
+		changed, err := rewrapFields(rewrap, &keyID, &dataKey)
+		if err != nil {
+			return n, fmt.Errorf("%v: %w", r.key, err)
+		}
+		if !changed {
+			continue
+		}
+		args := append([]interface{}{keyID, dataKey}, r.key...)
+		res, err := s.db.ExecContext(ctx, update, append(args, r.dataKey)...)
+		if err != nil {
+			return n, err
+		}
+		if affected, err := res.RowsAffected(); err == nil {
+			n += int(affected)
+		}
+	}
+	return n, nil
+}
+
+// AcquireBody stores body unless its hash is already there, then counts
+// one more reference and its expiry on the locked row. Inserting first
+// keeps two acquirers of a new body from both storing it.
+func (s *SQLStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	created := false
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO bodies (`+bodyColumns+`)
+			VALUES (?, ?, 0, ?, '', ?, ?, ?, ?)
+			ON CONFLICT (hash) DO NOTHING`), body.Hash, body.Text, body.ExpiresAt, body.Encoding, body.BlobKey, body.KeyID, body.DataKey)
+		if err != nil {
+			return err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		created = inserted == 1
+
+		stored, err := s.lockBody(ctx, tx, body.Hash)
+		if err != nil {
+			return err
+		}
+		stored.acquire(body.ExpiresAt)
+		return s.putBodyRefs(ctx, tx, stored)
+	})
+	return created, err
+}
+
+const bodyColumns = `hash, text, refs, expires_at, expiries, encoding, blob_key, key_id, data_key`
+
+// scanBody reads a row selected with bodyColumns
+func scanBody(row interface{ Scan(...interface{}) error }) (*Body, error) {
+	var b Body
+	var expiries string
+	if err := row.Scan(&b.Hash, &b.Text, &b.Refs, &b.ExpiresAt, &expiries, &b.Encoding, &b.BlobKey, &b.KeyID, &b.DataKey); err != nil {
+		return nil, err
+	}
+	// empty for bodies stored before expiries were kept
+	if expiries != "" {
+		if err := json.Unmarshal([]byte(expiries), &b.Expiries); err != nil {
+			return nil, fmt.Errorf("body %s: %w", b.Hash, err)
+		}
+	}
+	return &b, nil
+}
+
+// lockBody reads the body stored under hash in tx, locking its row where
+// the database locks rows
+func (s *SQLStore) lockBody(ctx context.Context, tx *sql.Tx, hash string) (*Body, error) {
+	body, err := scanBody(tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+bodyColumns+` FROM bodies WHERE hash = ?`+s.dialect.forUpdate), hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrNotFound)
+	}
+	return body, err
+}
+
+// putBodyRefs writes the references of body and the expiry they add up to
+func (s *SQLStore) putBodyRefs(ctx context.Context, tx *sql.Tx, body *Body) error {
+	expiries, err := json.Marshal(body.Expiries)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(`UPDATE bodies SET refs = ?, expires_at = ?, expiries = ? WHERE hash = ?`),
+		body.Refs, body.ExpiresAt, string(expiries), body.Hash)
+	return err
+}
+
+// GetBody retrieves the body stored under hash
+func (s *SQLStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	b, err := scanBody(s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT `+bodyColumns+` FROM bodies WHERE hash = ?`), hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expired(b.ExpiresAt, time.Now()) {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrExpired)
+	}
+	return b, nil
+}
+
+// ReleaseBody drops the reference expiring at expiresAt from the body
+// stored under hash, deleting it once none are left
+func (s *SQLStore) ReleaseBody(ctx context.Context, hash string, expiresAt int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		body, err := s.lockBody(ctx, tx, hash)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if body.release(expiresAt) {
+			return s.putBodyRefs(ctx, tx, body)
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM bodies WHERE hash = ?`), hash)
+		return err
+	})
+}
+
+// sweepExpired deletes expired pastes and diffs every interval until the
+// store is closed
+func (s *SQLStore) sweepExpired(interval time.Duration) {
+	sugar := zap.L().Sugar()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			n, err := s.deleteExpired(context.Background(), now)
+			if err != nil {
+				sugar.Errorw("failed_to_sweep_expired_items", "dialect", s.dialect.name, "error", err)
+				continue
+			}
+			if n > 0 {
+				sugar.Infow("swept_expired_items", "dialect", s.dialect.name, "count", n)
+			}
+		}
+	}
+}
+
+// deleteExpired removes every paste, diff and body that has expired at now
+// and returns how many were removed. The expires_at indexes keep this
+// cheap.
+func (s *SQLStore) deleteExpired(ctx context.Context, now time.Time) (int, error) {
+	var n int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM paste_revisions WHERE id IN
+			(SELECT id FROM pastes WHERE expires_at <> 0 AND expires_at <= ?)`), now.Unix())
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"pastes", "diffs", "bodies"} {
+			res, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM `+table+` WHERE expires_at <> 0 AND expires_at <= ?`), now.Unix())
+			if err != nil {
+				return err
+			}
+			deleted, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			n += deleted
+		}
+		return nil
+	})
+	return int(n), err
+}
+
+// Close stops the expiry sweeper and closes the database
+func (s *SQLStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
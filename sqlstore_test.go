@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSQLiteStore opens a SQLStore on a SQLite file in a temporary
+// directory that is closed when the test ends
+func newTestSQLiteStore(t *testing.T) *SQLStore {
+	t.Helper()
+	s, err := openSQLiteStore(filepath.Join(t.TempDir(), "pbin.sqlite"))
+	if err != nil {
+		t.Fatalf("openSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testSQLStore(t, newTestSQLiteStore)
+}
+
+// testSQLStore runs the SQLStore tests against stores from open, each of
+// which must start out empty
+func testSQLStore(t *testing.T, open func(t *testing.T) *SQLStore) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, s *SQLStore)
+	}{
+		{"Migrations", testSQLMigrations},
+		{"PasteCRUD", testSQLPasteCRUD},
+		{"DiffCRUD", testSQLDiffCRUD},
+		{"UpdateConflict", testSQLUpdateConflict},
+		{"ConcurrentUpdates", testSQLConcurrentUpdates},
+		{"TakePasteBurnsOnce", testSQLTakePasteBurnsOnce},
+		{"DeleteExpired", testSQLDeleteExpired},
+		{"BodyRefs", testSQLBodyRefs},
+	} {
+		t.Run(tc.name, func(t *testing.T) { tc.fn(t, open(t)) })
+	}
+}
+
+func testSQLMigrations(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	version := func() int {
+		var v, n int
+		err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0), COUNT(*) FROM schema_migrations`).Scan(&v, &n)
+		if err != nil {
+			t.Fatalf("reading schema_migrations: %v", err)
+		}
+		if v != n {
+			t.Errorf("schema_migrations holds %d rows up to version %d", n, v)
+		}
+		return v
+	}
+	if v := version(); v != len(s.dialect.migrations) {
+		t.Fatalf("schema version %d, want %d", v, len(s.dialect.migrations))
+	}
+	// a restart finds nothing left to apply
+	if err := s.migrate(ctx); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	if v := version(); v != len(s.dialect.migrations) {
+		t.Errorf("schema version after migrating again %d, want %d", v, len(s.dialect.migrations))
+	}
+}
+
+func testSQLPasteCRUD(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	id, err := s.AddPaste(ctx, &Paste{Text: "one", Language: "go", Title: "first", OwnerTokenHash: "owner"})
+	if err != nil {
+		t.Fatalf("AddPaste: %v", err)
+	}
+	got, err := s.GetPaste(ctx, id)
+	if err != nil {
+		t.Fatalf("GetPaste: %v", err)
+	}
+	if got.PK != id || got.Text != "one" || got.Language != "go" || got.Title != "first" || got.OwnerTokenHash != "owner" || got.Revision != 1 {
+		t.Errorf("GetPaste = %+v", got)
+	}
+	if _, err := s.AddPaste(ctx, &Paste{PK: id, Text: "two"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddPaste with a taken id = %v, want ErrConflict", err)
+	}
+
+	if err := s.UpdatePaste(ctx, &Paste{PK: id, Text: "two", Language: "go"}); err != nil {
+		t.Fatalf("UpdatePaste: %v", err)
+	}
+	revisions, err := s.ListRevisions(ctx, id)
+	if err != nil {
+		t.Fatalf("ListRevisions: %v", err)
+	}
+	if len(revisions) != 2 || revisions[0].Text != "one" || revisions[1].Text != "two" || revisions[1].Revision != 2 {
+		t.Errorf("ListRevisions = %+v", revisions)
+	}
+	if rev, err := s.GetRevision(ctx, id, 1); err != nil || rev.Text != "one" {
+		t.Errorf("GetRevision(1) = %+v, %v", rev, err)
+	}
+	if err := s.UpdatePaste(ctx, &Paste{PK: "missing", Text: "x"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdatePaste of a missing paste = %v, want ErrNotFound", err)
+	}
+
+	if err := s.DeletePaste(ctx, id); err != nil {
+		t.Fatalf("DeletePaste: %v", err)
+	}
+	if _, err := s.GetPaste(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetPaste after delete = %v, want ErrNotFound", err)
+	}
+	var n int
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT COUNT(*) FROM paste_revisions WHERE id = ?`), id).Scan(&n); err != nil || n != 0 {
+		t.Errorf("revisions left after delete = %d, %v", n, err)
+	}
+	if err := s.DeletePaste(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeletePaste again = %v, want ErrNotFound", err)
+	}
+}
+
+func testSQLDiffCRUD(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	id, err := s.AddDiff(ctx, &Diff{OldText: "a", NewText: "b", OwnerTokenHash: "owner"})
+	if err != nil {
+		t.Fatalf("AddDiff: %v", err)
+	}
+	got, err := s.GetDiff(ctx, id)
+	if err != nil || got.OldText != "a" || got.NewText != "b" || got.OwnerTokenHash != "owner" {
+		t.Errorf("GetDiff = %+v, %v", got, err)
+	}
+	if _, err := s.AddDiff(ctx, &Diff{PK: id}); !errors.Is(err, ErrConflict) {
+		t.Errorf("AddDiff with a taken id = %v, want ErrConflict", err)
+	}
+	if err := s.DeleteDiff(ctx, id); err != nil {
+		t.Fatalf("DeleteDiff: %v", err)
+	}
+	if _, err := s.GetDiff(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetDiff after delete = %v, want ErrNotFound", err)
+	}
+}
+
+// raceEditTrigger bumps the revision of a paste as UpdatePaste archives it,
+// standing in for an edit that commits between its read and its write
+var raceEditTrigger = map[string]string{
+	"sqlite": `CREATE TRIGGER race_edit BEFORE INSERT ON paste_revisions BEGIN
+		UPDATE pastes SET revision = revision + 1 WHERE id = NEW.id;
+	END`,
+	"postgres": `CREATE FUNCTION race_edit() RETURNS trigger AS $$ BEGIN
+		UPDATE pastes SET revision = revision + 1 WHERE id = NEW.id;
+		RETURN NEW;
+	END $$ LANGUAGE plpgsql;
+	CREATE TRIGGER race_edit BEFORE INSERT ON paste_revisions
+		FOR EACH ROW EXECUTE FUNCTION race_edit()`,
+}
+
+func testSQLUpdateConflict(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	id, err := s.AddPaste(ctx, &Paste{Text: "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.ExecContext(ctx, raceEditTrigger[s.dialect.name]); err != nil {
+		t.Fatalf("creating trigger: %v", err)
+	}
+
+	if err := s.UpdatePaste(ctx, &Paste{PK: id, Text: "lost"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("UpdatePaste racing another edit = %v, want ErrConflict", err)
+	}
+	// the failed edit leaves nothing behind
+	revisions, err := s.ListRevisions(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Text != "base" || revisions[0].Revision != 1 {
+		t.Errorf("ListRevisions after the conflict = %+v, want the base revision alone", revisions)
+	}
+}
+
+// testSQLConcurrentUpdates checks that overlapping edits either queue or
+// fail with ErrConflict, never both claiming a revision
+func testSQLConcurrentUpdates(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	id, err := s.AddPaste(ctx, &Paste{Text: "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const editors = 8
+	var wg sync.WaitGroup
+	errs := make([]error, editors)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.UpdatePaste(ctx, &Paste{PK: id, Text: "edit"})
+		}(i)
+	}
+	wg.Wait()
+
+	applied := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			applied++
+		case !errors.Is(err, ErrConflict):
+			t.Errorf("concurrent UpdatePaste = %v, want nil or ErrConflict", err)
+		}
+	}
+	revisions, err := s.ListRevisions(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != applied+1 {
+		t.Fatalf("%d revisions after %d applied edits, want %d", len(revisions), applied, applied+1)
+	}
+	numbers := make([]int, len(revisions))
+	for i, p := range revisions {
+		numbers[i] = p.Revision
+	}
+	sort.Ints(numbers)
+	for i, n := range numbers {
+		if n != i+1 {
+			t.Fatalf("revision numbers %v, want 1 to %d", numbers, len(numbers))
+		}
+	}
+}
+
+func testSQLTakePasteBurnsOnce(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	id, err := s.AddPaste(ctx, &Paste{Text: "secret", BurnAfterReading: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdatePaste(ctx, &Paste{PK: id, Text: "secret 2", BurnAfterReading: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	const readers = 8
+	var wg sync.WaitGroup
+	texts := make([]string, readers)
+	errs := make([]error, readers)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var p *Paste
+			if p, errs[i] = s.TakePaste(ctx, id); p != nil {
+				texts[i] = p.Text
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	taken := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			taken++
+			if texts[i] != "secret 2" {
+				t.Errorf("TakePaste = %q, want the current revision", texts[i])
+			}
+		case !errors.Is(err, ErrAlreadyViewed):
+			t.Errorf("TakePaste = %v, want nil or ErrAlreadyViewed", err)
+		}
+	}
+	if taken != 1 {
+		t.Errorf("%d readers got the paste, want 1", taken)
+	}
+	if _, err := s.GetRevision(ctx, id, 1); !errors.Is(err, ErrAlreadyViewed) {
+		t.Errorf("GetRevision after burning = %v, want ErrAlreadyViewed", err)
+	}
+	var n int
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT COUNT(*) FROM paste_revisions WHERE id = ?`), id).Scan(&n); err != nil || n != 0 {
+		t.Errorf("revisions left after burning = %d, %v", n, err)
+	}
+}
+
+func testSQLDeleteExpired(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	now := time.Now()
+	past := now.Add(-time.Minute).Unix()
+
+	old, err := s.AddPaste(ctx, &Paste{Text: "old", ExpiresAt: past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write a revision directly, as UpdatePaste refuses an expired paste
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO paste_revisions (id, revision, created_at, text) VALUES (?, 0, ?, 'older')`), old, now.UTC()); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := s.AddPaste(ctx, &Paste{Text: "kept", ExpiresAt: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := s.AddDiff(ctx, &Diff{OldText: "a", NewText: "b", ExpiresAt: past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AcquireBody(ctx, &Body{Hash: "expired", Text: "body", ExpiresAt: past}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AcquireBody(ctx, &Body{Hash: "forever", Text: "body"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetPaste(ctx, old); !errors.Is(err, ErrExpired) {
+		t.Errorf("GetPaste of an expired paste = %v, want ErrExpired", err)
+	}
+	n, err := s.deleteExpired(ctx, now)
+	if err != nil {
+		t.Fatalf("deleteExpired: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("deleteExpired removed %d rows, want 3", n)
+	}
+	if _, err := s.GetPaste(ctx, old); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+		t.Errorf("GetPaste after sweep = %v, want ErrNotFound", err)
+	}
+	var revs int
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT COUNT(*) FROM paste_revisions WHERE id = ?`), old).Scan(&revs); err != nil || revs != 0 {
+		t.Errorf("revisions left after sweep = %d, %v", revs, err)
+	}
+	if _, err := s.GetDiff(ctx, diff); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+		t.Errorf("GetDiff after sweep = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetBody(ctx, "expired"); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+		t.Errorf("GetBody after sweep = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetPaste(ctx, kept); err != nil {
+		t.Errorf("GetPaste of an unexpired paste after sweep: %v", err)
+	}
+	if _, err := s.GetBody(ctx, "forever"); err != nil {
+		t.Errorf("GetBody of an unexpired body after sweep: %v", err)
+	}
+	if n, err := s.deleteExpired(ctx, now); err != nil || n != 0 {
+		t.Errorf("second deleteExpired = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func testSQLBodyRefs(t *testing.T, s *SQLStore) {
+	ctx := context.Background()
+	soon := time.Now().Add(time.Hour).Unix()
+	later := time.Now().Add(2 * time.Hour).Unix()
+
+	if created, err := s.AcquireBody(ctx, &Body{Hash: "h", Text: "shared", ExpiresAt: soon}); err != nil || !created {
+		t.Fatalf("first AcquireBody = %v, %v, want true, nil", created, err)
+	}
+	if created, err := s.AcquireBody(ctx, &Body{Hash: "h", Text: "shared", ExpiresAt: later}); err != nil || created {
+		t.Fatalf("second AcquireBody = %v, %v, want false, nil", created, err)
+	}
+	body, err := s.GetBody(ctx, "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Refs != 2 || body.ExpiresAt != later || body.Text != "shared" {
+		t.Errorf("GetBody = %+v, want 2 refs expiring at %d", body, later)
+	}
+	// a reference that never expires keeps the body forever
+	if _, err := s.AcquireBody(ctx, &Body{Hash: "h", Text: "shared"}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := s.GetBody(ctx, "h"); err != nil || body.Refs != 3 || body.ExpiresAt != 0 {
+		t.Errorf("GetBody = %+v, %v, want 3 refs never expiring", body, err)
+	}
+
+	// releasing a reference leaves the body to expire with those left
+	for _, tc := range []struct {
+		release, want int64
+		refs          int
+	}{
+		{0, later, 2},
+		{later, soon, 1},
+	} {
+		if err := s.ReleaseBody(ctx, "h", tc.release); err != nil {
+			t.Fatal(err)
+		}
+		if body, err := s.GetBody(ctx, "h"); err != nil || body.Refs != tc.refs || body.ExpiresAt != tc.want {
+			t.Errorf("GetBody after releasing %d = %+v, %v, want %d refs expiring at %d", tc.release, body, err, tc.refs, tc.want)
+		}
+	}
+	if err := s.ReleaseBody(ctx, "h", soon); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetBody(ctx, "h"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetBody after the last release = %v, want ErrNotFound", err)
+	}
+}
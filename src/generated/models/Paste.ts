@@ -19,5 +19,9 @@ export type Paste = {
      * The paste title (optional)
      */
     title?: string;
+    /**
+     * "encrypted" when text is ciphertext encrypted by the client
+     */
+    kind?: string;
 };
 
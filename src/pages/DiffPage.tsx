@@ -9,7 +9,11 @@ import type { Diff } from '../generated'
 export default function DiffPage() {
   const navigate = useNavigate()
   const [searchParams] = useSearchParams()
-  const id = searchParams.get('id')
+  const pasteId = searchParams.get('paste')
+  const from = searchParams.get('from')
+  const to = searchParams.get('to')
+  // comparing two revisions of a paste reuses the stored diff view
+  const id = searchParams.get('id') || (pasteId && from && to ? `${pasteId}@${from}..${to}` : null)
   
   const [original, setOriginal] = useState('')
   const [modified, setModified] = useState('')
@@ -18,6 +22,7 @@ export default function DiffPage() {
   const { data: diffData, isLoading, error } = useQuery({
     queryKey: ['diff', id],
     queryFn: async (): Promise<Diff> => {
+      if (pasteId && from && to) return diffService.compareRevisions(pasteId, from, to)
       if (!id) throw new Error('No diff ID provided')
       return diffService.get(id)
     },
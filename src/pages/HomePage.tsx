@@ -31,15 +31,25 @@ export default function HomePage() {
   const [output, setOutput] = useState('')
   const [showOutput, setShowOutput] = useState(true)
   const [autoRun, setAutoRun] = useState(false)
-
+  const [encrypt, setEncrypt] = useState(false)
+  const [password, setPassword] = useState('')
+  const [slug, setSlug] = useState('')
 
   const createPasteMutation = useMutation({
     mutationFn: async () => {
       const lang = language === 'detect' ? await detectLanguage(code) : language
-      return pasteService.create(code, lang)
+      if (encrypt) {
+        const { id, key } = await pasteService.createEncrypted(code, lang, password, slug)
+        return `/paste?id=${id}#${key}`
+      }
+      return `/paste?id=${await pasteService.create(code, lang, undefined, password, slug)}`
     },
-    onSuccess: (id) => {
-      navigate(`/paste?id=${id}`)
+    onSuccess: (path) => {
+      navigate(path)
+    },
+    onError: (err: Error) => {
+      // such as a custom link that is already taken
+      window.alert(`Failed to save: ${err.message}`)
     },
   })
 
@@ -209,6 +219,35 @@ export default function HomePage() {
           />
           Auto Run
         </label>
+        <label className="ml-2 font-medium text-gray-700" title="Encrypt in the browser, the key is only in the link">
+          <input
+            type="checkbox"
+            id="encryptCheckbox"
+            className="mr-1 align-middle"
+            checked={encrypt}
+            onChange={(e) => setEncrypt(e.target.checked)}
+          />
+          Encrypt
+        </label>
+        <input
+          type="password"
+          id="passwordInput"
+          className="ml-2 py-2 px-2 rounded-lg border border-gray-300"
+          placeholder="Password (optional)"
+          autoComplete="new-password"
+          value={password}
+          onChange={(e) => setPassword(e.target.value)}
+        />
+        <input
+          type="text"
+          id="slugInput"
+          className="ml-2 py-2 px-2 rounded-lg border border-gray-300"
+          placeholder="Custom link (optional)"
+          pattern="[A-Za-z0-9][A-Za-z0-9_\-]{2,63}"
+          title="3 to 64 letters, digits, dashes or underscores"
+          value={slug}
+          onChange={(e) => setSlug(e.target.value.trim())}
+        />
       </Header>
       <div className="flex-grow overflow-auto">
         <div className="grid" id="panelContainer">
@@ -1,22 +1,39 @@
-import { useSearchParams, Link } from 'react-router-dom'
+import { useState } from 'react'
+import { useSearchParams, useLocation, Link } from 'react-router-dom'
 import { useQuery } from '@tanstack/react-query'
 import Header from '../components/Header'
 import MonacoEditor from '../components/MonacoEditor'
-import { pasteService } from '../services/api'
+import { pasteService, HttpError } from '../services/api'
+import { decryptText } from '../services/e2ee'
 import type { Paste } from '../generated'
 
 export default function PastePage() {
   const [searchParams] = useSearchParams()
   const id = searchParams.get('id')
+  // the key of an encrypted paste never leaves the browser
+  const key = useLocation().hash.slice(1)
+  // the password of a protected paste, asked for once the server wants it
+  const [password, setPassword] = useState('')
+  const [passwordInput, setPasswordInput] = useState('')
 
   // Use the auto-generated OpenAPI client
-  const { data: pasteData, isLoading, error } = useQuery({
-    queryKey: ['paste', id],
+  const { data: pasteData, isLoading, error, refetch } = useQuery({
+    queryKey: ['paste', id, key, password],
     queryFn: async (): Promise<Paste> => {
       if (!id) throw new Error('No paste ID provided')
-      return pasteService.get(id)
+      const paste = await pasteService.get(id, password)
+      if (paste.kind !== 'encrypted') return paste
+      if (!key) throw new Error('This paste is encrypted and the link has no key')
+      try {
+        return { ...paste, text: await decryptText(paste.text, key) }
+      } catch {
+        throw new Error('This paste is encrypted and the key in the link does not open it')
+      }
     },
     enabled: !!id,
+    // every retry of a wrong password counts towards the lockout
+    retry: (count, err) =>
+      !(err instanceof HttpError && (err.status === 401 || err.status === 429)) && count < 3,
   })
 
   const copyText = () => {
@@ -49,6 +66,41 @@ export default function PastePage() {
     )
   }
 
+  if (error instanceof HttpError && error.status === 401) {
+    return (
+      <div className="container-xl h-screen overflow-y-hidden">
+        <Header />
+        <form
+          className="p-4"
+          onSubmit={(e) => {
+            e.preventDefault()
+            // the same password again would be answered from the cache
+            if (passwordInput === password) refetch()
+            else setPassword(passwordInput)
+          }}
+        >
+          <p className="mb-2">
+            {password ? 'Wrong password, try again.' : 'This paste is password protected.'}
+          </p>
+          <input
+            type="password"
+            className="py-2 px-2 rounded-lg border border-gray-300"
+            placeholder="Password"
+            autoFocus
+            value={passwordInput}
+            onChange={(e) => setPasswordInput(e.target.value)}
+          />
+          <button
+            type="submit"
+            className="py-2 px-4 font-semibold rounded-lg shadow-md text-white bg-green-500 hover:bg-green-700 ml-2"
+          >
+            Open
+          </button>
+        </form>
+      </div>
+    )
+  }
+
   if (error) {
     return (
       <div className="container-xl h-screen overflow-y-hidden">
@@ -90,7 +142,8 @@ export default function PastePage() {
         >
           <i className="far fa-share-square"></i> Share Link to Text
         </button>
-        {pasteData.language === 'markdown' && (
+        {/* the HTML view has no way to send the password */}
+        {pasteData.language === 'markdown' && pasteData.kind !== 'encrypted' && !password && (
           <Link
             className="py-2 px-4 font-semibold rounded-lg shadow-md text-white bg-green-500 hover:bg-grey-700 ml-2 inline-block"
             to={`/html?id=${id}`}
@@ -1,16 +1,28 @@
 import { DefaultService, OpenAPI } from '../generated'
 import { Paste, Diff, CompletionResponse } from '../types'
+import { encryptText } from './e2ee'
 
 // Configure the OpenAPI client
 OpenAPI.BASE = 'http://localhost:8000'
 
+// HttpError carries the status of a failed request, so a page can ask for
+// the password of a protected paste on 401
+export class HttpError extends Error {
+  constructor(public status: number, message: string) {
+    super(message)
+  }
+}
+
 export const pasteService = {
-  create: async (text: string, lang: string): Promise<string> => {
+  create: async (text: string, lang: string, kind?: string, password?: string, slug?: string): Promise<string> => {
     // The response is a redirect, we need to extract the ID from the Location header
     // For now, we'll use the old implementation until we fix the redirect handling
     const formData = new URLSearchParams()
     formData.append('text', text)
     formData.append('lang', lang)
+    if (kind) formData.append('kind', kind)
+    if (password) formData.append('password', password)
+    if (slug) formData.append('slug', slug)
     
     const fetchResponse = await fetch('/api/paste', {
       method: 'POST',
@@ -19,6 +31,11 @@ export const pasteService = {
       },
       body: formData,
     })
+    if (!fetchResponse.ok) {
+      // such as a slug that is already taken
+      const body = await fetchResponse.json().catch(() => null)
+      throw new HttpError(fetchResponse.status, body?.error?.message || fetchResponse.statusText)
+    }
     
     const redirectUrl = fetchResponse.headers.get('location') || fetchResponse.url
     const url = new URL(redirectUrl)
@@ -28,8 +45,24 @@ export const pasteService = {
     return id
   },
 
-  get: async (id: string): Promise<Paste> => {
-    return DefaultService.getPaste(id)
+  // createEncrypted encrypts text in the browser and returns the paste id
+  // together with the key, which belongs in the URL fragment
+  createEncrypted: async (text: string, lang: string, password?: string, slug?: string): Promise<{ id: string; key: string }> => {
+    const { ciphertext, key } = await encryptText(text)
+    const id = await pasteService.create(ciphertext, lang, 'encrypted', password, slug)
+    return { id, key }
+  },
+
+  // get fetches a paste, sending password for a protected one
+  get: async (id: string, password?: string): Promise<Paste> => {
+    const response = await fetch(`/api/paste?id=${encodeURIComponent(id)}`, {
+      headers: password ? { 'X-Paste-Password': password } : {},
+    })
+    if (!response.ok) {
+      const body = await response.json().catch(() => null)
+      throw new HttpError(response.status, body?.error?.message || response.statusText)
+    }
+    return response.json()
   },
 
   getCompletion: async (text: string): Promise<CompletionResponse> => {
@@ -52,6 +85,11 @@ export const diffService = {
       },
       body: formData,
     })
+    if (!fetchResponse.ok) {
+      // such as a slug that is already taken
+      const body = await fetchResponse.json().catch(() => null)
+      throw new HttpError(fetchResponse.status, body?.error?.message || fetchResponse.statusText)
+    }
     
     const redirectUrl = fetchResponse.headers.get('location') || fetchResponse.url
     const url = new URL(redirectUrl)
@@ -64,4 +102,12 @@ export const diffService = {
   get: async (id: string): Promise<Diff> => {
     return DefaultService.getDiff(id)
   },
+
+  // compareRevisions returns two revisions of a paste as a diff
+  compareRevisions: async (pasteId: string, from: string, to: string): Promise<Diff> => {
+    const params = new URLSearchParams({ paste: pasteId, from, to })
+    const response = await fetch(`/api/diff?${params}`)
+    if (!response.ok) throw new Error(`Failed to compare revisions: ${response.statusText}`)
+    return response.json()
+  },
 }
\ No newline at end of file
@@ -0,0 +1,43 @@
+// Client side encryption for encrypted pastes. The server only ever sees
+// the ciphertext; the key lives in the fragment of the paste URL, which
+// browsers never send. The scheme matches EncryptText in pbin/client:
+// AES-256-GCM, text = base64(nonce || ciphertext), key = base64url(key).
+
+const toBase64 = (bytes: Uint8Array): string => {
+  let binary = ''
+  bytes.forEach((b) => (binary += String.fromCharCode(b)))
+  return btoa(binary)
+}
+
+const fromBase64 = (text: string): Uint8Array =>
+  Uint8Array.from(atob(text), (c) => c.charCodeAt(0))
+
+const toBase64Url = (bytes: Uint8Array): string =>
+  toBase64(bytes).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+
+const fromBase64Url = (text: string): Uint8Array =>
+  fromBase64(text.replace(/-/g, '+').replace(/_/g, '/').padEnd(Math.ceil(text.length / 4) * 4, '='))
+
+export const encryptText = async (text: string): Promise<{ ciphertext: string; key: string }> => {
+  const raw = crypto.getRandomValues(new Uint8Array(32))
+  const key = await crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['encrypt'])
+  const nonce = crypto.getRandomValues(new Uint8Array(12))
+  const sealed = new Uint8Array(
+    await crypto.subtle.encrypt({ name: 'AES-GCM', iv: nonce }, key, new TextEncoder().encode(text))
+  )
+  const out = new Uint8Array(nonce.length + sealed.length)
+  out.set(nonce)
+  out.set(sealed, nonce.length)
+  return { ciphertext: toBase64(out), key: toBase64Url(raw) }
+}
+
+export const decryptText = async (ciphertext: string, keyText: string): Promise<string> => {
+  const key = await crypto.subtle.importKey('raw', fromBase64Url(keyText), 'AES-GCM', false, ['decrypt'])
+  const sealed = fromBase64(ciphertext)
+  const plain = await crypto.subtle.decrypt(
+    { name: 'AES-GCM', iv: sealed.slice(0, 12) },
+    key,
+    sealed.slice(12)
+  )
+  return new TextDecoder().decode(plain)
+}
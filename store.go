@@ -1,28 +1,77 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/boltdb/bolt"
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+var (
+	// ErrNotFound is returned by a DataStore when the requested item does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyViewed is returned for a burn-after-reading paste that has
+	// already been read once
+	ErrAlreadyViewed = errors.New("already viewed")
+	// ErrExpired is returned for an item that is past its expiry but has not
+	// been deleted yet. It matches ErrNotFound as well, so callers that only
+	// care whether an item can be read need not check both.
+	ErrExpired error = expiredError{}
+	// ErrTooLarge is returned for an item bigger than the store or the
+	// configured limit allows
+	ErrTooLarge = errors.New("too large")
+	// ErrConflict is returned when a write lost a race with another write to
+	// the same item
+	ErrConflict = errors.New("conflict")
+)
+
+// expiredError is the type of ErrExpired
+type expiredError struct{}
+
+func (expiredError) Error() string { return "expired" }
+func (expiredError) Unwrap() error { return ErrNotFound }
+
 // DataStore is the interface for our database operations
 type DataStore interface {
-	GetPaste(id string) (*Paste, error)
-	AddPaste(text, lang, title string) (string, error)
-	GetDiff(id string) (*Diff, error)
-	AddDiff(oldText, newText string) (string, error)
+	GetPaste(ctx context.Context, id string) (*Paste, error)
+	// TakePaste reads a paste and, if it is burn-after-reading, deletes it in
+	// the same atomic operation so only one reader ever sees it
+	TakePaste(ctx context.Context, id string) (*Paste, error)
+	// AddPaste stores paste under a freshly generated id, or under paste.PK
+	// when the caller chose one, filling in PK and SK, and returns the id.
+	// A chosen id that is already taken fails with ErrConflict.
+	AddPaste(ctx context.Context, paste *Paste) (string, error)
+	// UpdatePaste stores paste as the new current revision of the existing
+	// paste paste.PK, keeping the previous revision, and fills in SK and
+	// Revision
+	UpdatePaste(ctx context.Context, paste *Paste) error
+	// ListRevisions returns every revision of a paste, oldest first
+	ListRevisions(ctx context.Context, id string) ([]*Paste, error)
+	GetRevision(ctx context.Context, id string, rev int) (*Paste, error)
+	// DeletePaste removes a paste along with all of its revisions
+	DeletePaste(ctx context.Context, id string) error
+	GetDiff(ctx context.Context, id string) (*Diff, error)
+	// AddDiff stores diff under a freshly generated id, or under diff.PK
+	// when the caller chose one, filling in PK and SK, and returns the id.
+	// A chosen id that is already taken fails with ErrConflict.
+	AddDiff(ctx context.Context, diff *Diff) (string, error)
+	DeleteDiff(ctx context.Context, id string) error
 	Close() error
 }
 
@@ -33,29 +82,261 @@ type Paste struct {
 	Language string
 	Text     string
 	Title    string
+	// ExpiresAt is the unix time after which the paste is gone, zero means
+	// never. DynamoDB's TTL attribute points at it.
+	ExpiresAt int64 `json:",omitempty" dynamodbav:",omitempty"`
+	// BurnAfterReading pastes are deleted by the first TakePaste
+	BurnAfterReading bool `json:",omitempty" dynamodbav:",omitempty"`
+	// Burned marks the tombstone left behind once a burn-after-reading paste
+	// has been read, so later readers can be told it was already viewed
+	Burned bool `json:",omitempty" dynamodbav:",omitempty"`
+	// OwnerTokenHash is the SHA-256 of the token that allows editing and
+	// deleting the paste
+	OwnerTokenHash string `json:",omitempty" dynamodbav:",omitempty"`
+	// PasswordHash is the bcrypt hash of the password needed to read the
+	// paste, empty when it has none
+	PasswordHash string `json:",omitempty" dynamodbav:",omitempty"`
+	// Revision counts edits starting at 1. SK holds the time the revision
+	// was written.
+	Revision int `json:",omitempty" dynamodbav:",omitempty"`
+	// Encoding is how Text is stored, empty for plain text. Only
+	// compressStore sets and reads it.
+	Encoding string `json:",omitempty" dynamodbav:",omitempty"`
+	// BlobKey is set, and Text empty, when blobStore keeps the text in
+	// blob storage
+	BlobKey string `json:",omitempty" dynamodbav:",omitempty"`
+	// BodyHash is set, and Text empty, when dedupStore keeps the text as a
+	// shared Body
+	BodyHash string `json:",omitempty" dynamodbav:",omitempty"`
+	// KeyID names the key that DataKey, the key Text is encrypted with, is
+	// wrapped in. Both are empty for plain text. See cryptStore.
+	KeyID   string `json:",omitempty" dynamodbav:",omitempty"`
+	DataKey string `json:",omitempty" dynamodbav:",omitempty"`
+	// Kind is empty for ordinary pastes and pasteKindEncrypted for pastes
+	// encrypted by their client. It is the same for every revision.
+	Kind string `json:",omitempty" dynamodbav:",omitempty"`
+}
+
+// pasteKindEncrypted marks a paste encrypted by its client with a key the
+// server never sees, kept in the fragment of the paste URL. Its Text is
+// the base64 of a 12 byte AES-GCM nonce followed by the ciphertext.
+const pasteKindEncrypted = "encrypted"
+
+// revision returns the revision number of p. Pastes written before
+// revisions were tracked are revision 1.
+func (p *Paste) revision() int {
+	if p.Revision == 0 {
+		return 1
+	}
+	return p.Revision
+}
+
+// findRevision picks revision rev out of revisions
+func findRevision(revisions []*Paste, rev int) (*Paste, error) {
+	for _, p := range revisions {
+		if p.revision() == rev {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("revision %d: %w", rev, ErrNotFound)
+}
+
+// skFormat is RFC 3339 with fixed width nanoseconds, so SKs written in the
+// same second still sort in the order they were written
+const skFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// newSK returns the sort key for an item written at t
+func newSK(t time.Time) string {
+	return t.UTC().Format(skFormat)
+}
+
+// parseSK returns the time an item was written from its sort key. Items
+// from before skFormat have plain RFC 3339 keys, which parse the same way.
+func parseSK(sk string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, sk)
+}
+
+// tombstoneTTL is how long the tombstone of a burned paste is kept when the
+// paste itself had no expiry
+const tombstoneTTL = 7 * 24 * time.Hour
+
+// tombstone returns the record that replaces a burned paste
+func (p *Paste) tombstone(now time.Time) *Paste {
+	expiresAt := p.ExpiresAt
+	if expiresAt == 0 {
+		expiresAt = now.Add(tombstoneTTL).Unix()
+	}
+	return &Paste{PK: p.PK, SK: p.SK, Burned: true, ExpiresAt: expiresAt}
 }
 
 // Diff represents a diff item
 type Diff struct {
-	PK      string
-	SK      string
-	OldText string
-	NewText string
+	PK        string
+	SK        string
+	OldText   string
+	NewText   string
+	ExpiresAt int64 `json:",omitempty" dynamodbav:",omitempty"`
+	// OwnerTokenHash is the SHA-256 of the token that allows deleting the
+	// diff
+	OwnerTokenHash string `json:",omitempty" dynamodbav:",omitempty"`
+	// PasswordHash is as for Paste
+	PasswordHash string `json:",omitempty" dynamodbav:",omitempty"`
+	// Encoding is how OldText and NewText are stored, as for Paste
+	Encoding string `json:",omitempty" dynamodbav:",omitempty"`
+	// BlobKey is set, and both texts empty, when blobStore keeps them in
+	// blob storage
+	BlobKey string `json:",omitempty" dynamodbav:",omitempty"`
+	// KeyID and DataKey encrypt both texts, as for Paste
+	KeyID   string `json:",omitempty" dynamodbav:",omitempty"`
+	DataKey string `json:",omitempty" dynamodbav:",omitempty"`
+}
+
+// Body is a paste text kept once for every revision holding it, under its
+// SHA-256. See dedupStore.
+type Body struct {
+	Hash string
+	Text string
+	// Refs counts the revisions pointing at the body
+	Refs int
+	// Expiries holds the expiry of each revision pointing at the body, so
+	// that releasing one that never expires leaves the body to expire
+	// with the others, rather than an expired one holding it for good.
+	// Bodies stored before it was kept have fewer than Refs, the rest
+	// expiring at ExpiresAt.
+	Expiries []int64 `json:",omitempty" dynamodbav:",omitempty"`
+	// ExpiresAt is the latest of Expiries, zero meaning never. Zero is
+	// stored too, as DynamoDB leaves items with a TTL that far in the past
+	// alone.
+	ExpiresAt int64
+	Encoding  string `json:",omitempty" dynamodbav:",omitempty"`
+	BlobKey   string `json:",omitempty" dynamodbav:",omitempty"`
+	KeyID     string `json:",omitempty" dynamodbav:",omitempty"`
+	DataKey   string `json:",omitempty" dynamodbav:",omitempty"`
+}
+
+// acquire counts one more reference to the body, expiring at expiresAt
+func (b *Body) acquire(expiresAt int64) {
+	b.fillExpiries()
+	b.Expiries = append(b.Expiries, expiresAt)
+	b.Refs, b.ExpiresAt = len(b.Expiries), latestExpiry(b.Expiries)
+}
+
+// release drops the reference expiring at expiresAt and reports whether
+// any are left. Without one at expiresAt, as for bodies stored before
+// Expiries was kept, the earliest goes, so the body never expires sooner
+// than a revision holding it.
+func (b *Body) release(expiresAt int64) bool {
+	b.fillExpiries()
+	i := slices.Index(b.Expiries, expiresAt)
+	if i < 0 {
+		i = earliestExpiry(b.Expiries)
+	}
+	if i >= 0 {
+		b.Expiries = slices.Delete(b.Expiries, i, i+1)
+	}
+	b.Refs, b.ExpiresAt = len(b.Expiries), latestExpiry(b.Expiries)
+	return b.Refs > 0
+}
+
+// fillExpiries gives the references of a body stored before Expiries was
+// kept the one expiry it had
+func (b *Body) fillExpiries() {
+	for len(b.Expiries) < b.Refs {
+		b.Expiries = append(b.Expiries, b.ExpiresAt)
+	}
 }
 
+// latestExpiry is the expiry that covers all of expiries, zero meaning
+// never
+func latestExpiry(expiries []int64) int64 {
+	var latest int64
+	for _, at := range expiries {
+		if at == 0 {
+			return 0
+		}
+		latest = max(latest, at)
+	}
+	return latest
+}
+
+// earliestExpiry is the index of the first expiry to pass, -1 for none
+func earliestExpiry(expiries []int64) int {
+	earliest := -1
+	for i, at := range expiries {
+		if earliest < 0 || at != 0 && (expiries[earliest] == 0 || at < expiries[earliest]) {
+			earliest = i
+		}
+	}
+	return earliest
+}
+
+// expired reports whether an item with the given ExpiresAt is past its
+// expiry at now
+func expired(expiresAt int64, now time.Time) bool {
+	return expiresAt != 0 && now.Unix() >= expiresAt
+}
+
+// sweepInterval is how often BoltStore deletes expired pastes and diffs
+const sweepInterval = time.Minute
+
 // BoltStore implements DataStore using BoltDB
 type BoltStore struct {
-	db *bolt.DB
+	db   *bolt.DB
+	done chan struct{}
 }
 
-// DynamoStore implements DataStore using DynamoDB
+// DynamoStore implements DataStore using DynamoDB. Pastes and diffs share
+// one table: a paste is stored as one item per revision under
+// PK=PASTE#<id>, SK=REV#<revision>, a diff as a single item under
+// PK=DIFF#<id>, SK=META and a body under PK=BODY#<hash>, SK=META.
 type DynamoStore struct {
-	svc       *dynamodb.DynamoDB
+	svc       dynamodbiface.DynamoDBAPI
 	tableName string
 }
 
-// NewDataStore creates a new DataStore based on the configuration
+// NewDataStore creates a new DataStore based on the configuration, with
+// every call bounded by the store deadlines
 func NewDataStore() (DataStore, error) {
+	backend, err := newBackendStore()
+	if err != nil {
+		return nil, err
+	}
+	store, err := wrapStore(backend)
+	if err != nil {
+		return nil, err
+	}
+	return newTimeoutStore(store), nil
+}
+
+// wrapStore adds to a backend the layers that change how texts are kept:
+// deduplication, compression, encryption and, with PBIN_BLOB_STORE set,
+// blob storage for large ones
+func wrapStore(store migrationStore) (migrationStore, error) {
+	keys, err := loadKeyring()
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("loading encryption keys: %w", err)
+	}
+	if spec := os.Getenv("PBIN_BLOB_STORE"); spec != "" {
+		blobs, err := newBlobStorage(spec)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("opening blob storage %s: %w", spec, err)
+		}
+		store = newBlobStore(store, blobs)
+	}
+	dedup := newDedupStore(newCompressStore(newCryptStore(store, keys)))
+	if keys != nil && dedup.minBytes > 0 {
+		// body hashes are plain SHA-256s of the texts, which encryption
+		// at rest should not leave readable
+		zap.L().Sugar().Infow("deduplication_disabled", "reason", "encryption_keys_configured")
+		dedup.minBytes = 0
+	}
+	return dedup, nil
+}
+
+// newBackendStore creates the DataStore named by DB_TYPE
+func newBackendStore() (migrationStore, error) {
 	sugar := zap.L().Sugar()
 
 	dbType := os.Getenv("DB_TYPE")
@@ -71,27 +352,41 @@ func NewDataStore() (DataStore, error) {
 	case "dynamo":
 		sugar.Info("creating_dynamo_store")
 		return NewDynamoStore()
+	case "memory":
+		sugar.Info("creating_memory_store")
+		return NewMemoryStore(), nil
+	case "sqlite":
+		sugar.Info("creating_sqlite_store")
+		return NewSQLiteStore()
+	case "postgres":
+		sugar.Info("creating_postgres_store")
+		return NewPostgresStore()
 	default:
 		sugar.Infow("using_default_bolt_store", "defaulted_db_type", "bolt")
 		return NewBoltStore()
 	}
 }
 
-// NewBoltStore creates a new BoltStore
+// NewBoltStore creates a new BoltStore on the file at DB_PATH
 func NewBoltStore() (*BoltStore, error) {
-	sugar := zap.L().Sugar()
-
 	dbPath := os.Getenv("DB_PATH")
 	if dbPath == "" {
 		dbPath = "pbin.db"
 	}
+	return openBoltStore(dbPath)
+}
+
+// openBoltStore opens or creates the BoltDB file at dbPath
+func openBoltStore(dbPath string) (*BoltStore, error) {
+	sugar := zap.L().Sugar()
 
 	sugar.Infow("initializing_bolt_store",
 		"db_path", dbPath,
 		"db_path_from_env", os.Getenv("DB_PATH") != "",
 	)
 
-	db, err := bolt.Open(dbPath, 0600, nil)
+	// fail rather than hang when another process has the file open
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		sugar.Errorw("failed_to_open_bolt_db",
 			"db_path", dbPath,
@@ -117,6 +412,28 @@ func NewBoltStore() (*BoltStore, error) {
 			return fmt.Errorf("create diffs bucket: %s", err)
 		}
 
+		// revisions holds a bucket per paste id with its earlier
+		// revisions keyed by SK
+		sugar.Info("creating_revisions_bucket")
+		_, err = tx.CreateBucketIfNotExists([]byte("revisions"))
+		if err != nil {
+			sugar.Errorw("failed_to_create_revisions_bucket", "error", err)
+			return fmt.Errorf("create revisions bucket: %s", err)
+		}
+
+		sugar.Info("creating_bodies_bucket")
+		_, err = tx.CreateBucketIfNotExists([]byte("bodies"))
+		if err != nil {
+			sugar.Errorw("failed_to_create_bodies_bucket", "error", err)
+			return fmt.Errorf("create bodies bucket: %s", err)
+		}
+
+		sugar.Info("creating_expiry_bucket")
+		if err := createExpiryIndex(tx); err != nil {
+			sugar.Errorw("failed_to_create_expiry_bucket", "error", err)
+			return fmt.Errorf("create expiry bucket: %s", err)
+		}
+
 		sugar.Info("bolt_buckets_created_successfully")
 		return nil
 	})
@@ -127,32 +444,219 @@ func NewBoltStore() (*BoltStore, error) {
 	}
 
 	sugar.Info("bolt_store_initialized_successfully")
-	return &BoltStore{db: db}, nil
+	b := &BoltStore{db: db, done: make(chan struct{})}
+	go b.sweepExpired(sweepInterval)
+	return b, nil
 }
 
-// NewDynamoStore creates a new DynamoStore
-func NewDynamoStore() (*DynamoStore, error) {
-	sess := session.Must(session.NewSession())
-	limit := int64(10)
-	tables, err := GetTables(sess, aws.Int64(limit))
+// sweepExpired deletes expired pastes and diffs every interval until the
+// store is closed
+func (b *BoltStore) sweepExpired(interval time.Duration) {
+	sugar := zap.L().Sugar()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			n, err := b.deleteExpired(now)
+			if err != nil {
+				sugar.Errorw("failed_to_sweep_expired_items", "error", err)
+				continue
+			}
+			if n > 0 {
+				sugar.Infow("swept_expired_items", "count", n)
+			}
+		}
+	}
+}
+
+// deleteExpired removes every paste, diff and body that has expired at now
+// and returns how many were removed. Only the expired start of the expiry
+// index is read, so the writer lock is held for as long as there is work.
+func (b *BoltStore) deleteExpired(now time.Time) (int, error) {
+	n := 0
+	// keys below this are of records that expired at or before now
+	end := expiryKey(now.Unix()+1, nil)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range expiringBuckets {
+			index := tx.Bucket([]byte(expiryBucket)).Bucket([]byte(name))
+			bucket := tx.Bucket([]byte(name))
+
+			// a bucket must not change while a cursor walks it
+			var keys [][]byte
+			c := index.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+
+			for _, k := range keys {
+				id := k[8:]
+				if err := index.Delete(k); err != nil {
+					return err
+				}
+				if err := bucket.Delete(id); err != nil {
+					return err
+				}
+				if name == "pastes" {
+					if err := deleteRevisions(tx, id); err != nil {
+						return err
+					}
+				}
+			}
+			n += len(keys)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// expiryBucket indexes the records that expire, with a bucket for each of
+// expiringBuckets keyed by expiryKey. putRecord and deleteRecord keep it in
+// step with the records.
+const expiryBucket = "expiry"
+
+// expiringBuckets hold records with an ExpiresAt
+var expiringBuckets = []string{"pastes", "diffs", "bodies"}
+
+// expiryKey is the big-endian expiry followed by the id, so the index
+// sorts by expiry
+func expiryKey(expiresAt int64, id []byte) []byte {
+	k := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(expiresAt))
+	return append(k, id...)
+}
+
+// createExpiryIndex creates the expiry index, filling it from the records
+// of a database written before there was one
+func createExpiryIndex(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(expiryBucket)) != nil {
+		return nil
+	}
+	expiry, err := tx.CreateBucket([]byte(expiryBucket))
 	if err != nil {
-		fmt.Println("Got an error retrieving table names:")
-		fmt.Println(err)
-		return nil, err
+		return err
+	}
+	for _, name := range expiringBuckets {
+		index, err := expiry.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+			expiresAt, err := recordExpiry(v)
+			if err != nil || expiresAt == 0 {
+				return err
+			}
+			return index.Put(expiryKey(expiresAt, k), []byte{})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordExpiry is the ExpiresAt of an encoded paste, diff or body, or zero
+// when there is none
+func recordExpiry(v []byte) (int64, error) {
+	if v == nil {
+		return 0, nil
 	}
+	var item struct{ ExpiresAt int64 }
+	err := json.Unmarshal(v, &item)
+	return item.ExpiresAt, err
+}
+
+// putRecord stores value under key in the named bucket, moving its entry
+// in the expiry index along with its expiry
+func putRecord(tx *bolt.Tx, name string, key, value []byte) error {
+	bucket := tx.Bucket([]byte(name))
+	if err := reindexExpiry(tx, name, key, bucket.Get(key), value); err != nil {
+		return err
+	}
+	return bucket.Put(key, value)
+}
 
-	// create dynamodb table if it doesn't exist
-	createTable := true
-	for _, n := range tables {
-		if strings.Compare(*n, PBIN_TABLE_NAME) == 0 {
-			createTable = false
-			break
+// deleteRecord removes key from the named bucket and the expiry index
+func deleteRecord(tx *bolt.Tx, name string, key []byte) error {
+	bucket := tx.Bucket([]byte(name))
+	if err := reindexExpiry(tx, name, key, bucket.Get(key), nil); err != nil {
+		return err
+	}
+	return bucket.Delete(key)
+}
+
+// reindexExpiry replaces the index entry of key for the old record with
+// one for the new, either of which may be nil
+func reindexExpiry(tx *bolt.Tx, name string, key, old, new []byte) error {
+	oldAt, err := recordExpiry(old)
+	if err != nil {
+		return err
+	}
+	newAt, err := recordExpiry(new)
+	if err != nil {
+		return err
+	}
+	if oldAt == newAt {
+		return nil
+	}
+	index := tx.Bucket([]byte(expiryBucket)).Bucket([]byte(name))
+	if oldAt != 0 {
+		if err := index.Delete(expiryKey(oldAt, key)); err != nil {
+			return err
 		}
 	}
-	svc := dynamodb.New(sess)
-	tableName := os.Getenv("DYNAMO_TABLE_NAME")
-	if createTable {
+	if newAt != 0 {
+		return index.Put(expiryKey(newAt, key), []byte{})
+	}
+	return nil
+}
+
+// NewDynamoStore creates a new DynamoStore on the table named by
+// PBIN_TABLE_NAME, creating the table if it does not exist yet
+func NewDynamoStore() (*DynamoStore, error) {
+	sess := session.Must(session.NewSession())
+	return newDynamoStore(dynamodb.New(sess), dynamoTableName())
+}
+
+// dynamoTableName is PBIN_TABLE_NAME, falling back to DYNAMO_TABLE_NAME
+// which older deployments set, and then to "pbin"
+func dynamoTableName() string {
+	if PBIN_TABLE_NAME != "" {
+		return PBIN_TABLE_NAME
+	}
+	if name := os.Getenv("DYNAMO_TABLE_NAME"); name != "" {
+		return name
+	}
+	return "pbin"
+}
+
+// newDynamoStore returns a DynamoStore on tableName once the table is
+// ACTIVE, so the server never starts serving against a table that is still
+// being created. svc can be any DynamoDBAPI, such as a local stand-in.
+func newDynamoStore(svc dynamodbiface.DynamoDBAPI, tableName string) (*DynamoStore, error) {
+	sugar := zap.L().Sugar()
+	sugar.Infow("initializing_dynamo_store", "table_name", tableName)
+
+	if err := ensureTable(context.Background(), svc, tableName); err != nil {
+		sugar.Errorw("failed_to_prepare_dynamo_table", "table_name", tableName, "error", err)
+		return nil, err
+	}
+
+	sugar.Infow("dynamo_store_initialized_successfully", "table_name", tableName)
+	return &DynamoStore{svc: svc, tableName: tableName}, nil
+}
+
+// ensureTable creates the table with the PK/SK key schema if it does not
+// exist, waits for it to become ACTIVE and turns on TTL
+func ensureTable(ctx context.Context, svc dynamodbiface.DynamoDBAPI, tableName string) error {
+	sugar := zap.L().Sugar()
 
+	_, err := svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if awsErrorCode(err) == dynamodb.ErrCodeResourceNotFoundException {
+		sugar.Infow("creating_dynamo_table", "table_name", tableName)
 		attributeDefinitions := []*dynamodb.AttributeDefinition{
 			{
 				AttributeName: aws.String("PK"),
@@ -175,32 +679,47 @@ func NewDynamoStore() (*DynamoStore, error) {
 			},
 		}
 
-		go MakeTable(svc, attributeDefinitions, keySchema, aws.String(PBIN_TABLE_NAME))
+		err = MakeTable(ctx, svc, attributeDefinitions, keySchema, aws.String(tableName))
+		// another replica may be creating it at the same time
+		if awsErrorCode(err) == dynamodb.ErrCodeResourceInUseException {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("create table %s: %w", tableName, err)
 	}
-	return &DynamoStore{svc: svc, tableName: tableName}, nil
-}
 
-// GetTables retrieves a list of your Amazon DynamoDB tables
-// Inputs:
-//
-//	sess is the current session, which provides configuration for the SDK's service clients
-//	limit is the maximum number of tables to return
-//
-// Output:
-//
-//	If success, a list of the tables and nil
-//	Otherwise, nil and an error from the call to ListTables
-func GetTables(sess *session.Session, limit *int64) ([]*string, error) {
-	svc := dynamodb.New(sess)
+	// returns once the table status is ACTIVE
+	err = svc.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return fmt.Errorf("wait for table %s: %w", tableName, err)
+	}
 
-	result, err := svc.ListTables(&dynamodb.ListTablesInput{
-		Limit: limit,
-	})
+	ttl, err := svc.DescribeTimeToLiveWithContext(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(tableName)})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("describe TTL of table %s: %w", tableName, err)
+	}
+	// UpdateTimeToLive fails when TTL is already on
+	if status := aws.StringValue(ttl.TimeToLiveDescription.TimeToLiveStatus); status == dynamodb.TimeToLiveStatusEnabled || status == dynamodb.TimeToLiveStatusEnabling {
+		return nil
 	}
+	if err := EnableTTL(ctx, svc, aws.String(tableName)); err != nil {
+		return fmt.Errorf("enable TTL on table %s: %w", tableName, err)
+	}
+	return nil
+}
 
-	return result.TableNames, nil
+// EnableTTL turns on DynamoDB's native time to live for the ExpiresAt
+// attribute, so expired pastes and diffs are deleted by DynamoDB itself
+func EnableTTL(ctx context.Context, svc dynamodbiface.DynamoDBAPI, tableName *string) error {
+	_, err := svc.UpdateTimeToLiveWithContext(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: tableName,
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err
 }
 
 // MakeTable creates an Amazon DynamoDB table
@@ -215,8 +734,8 @@ func GetTables(sess *session.Session, limit *int64) ([]*string, error) {
 //
 //	If success, nil
 //	Otherwise, an error from the call to CreateTable
-func MakeTable(svc dynamodbiface.DynamoDBAPI, attributeDefinitions []*dynamodb.AttributeDefinition, keySchema []*dynamodb.KeySchemaElement, tableName *string) error {
-	_, err := svc.CreateTable(&dynamodb.CreateTableInput{
+func MakeTable(ctx context.Context, svc dynamodbiface.DynamoDBAPI, attributeDefinitions []*dynamodb.AttributeDefinition, keySchema []*dynamodb.KeySchemaElement, tableName *string) error {
+	_, err := svc.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
 		AttributeDefinitions: attributeDefinitions,
 		KeySchema:            keySchema,
 		TableName:            tableName,
@@ -226,7 +745,7 @@ func MakeTable(svc dynamodbiface.DynamoDBAPI, attributeDefinitions []*dynamodb.A
 }
 
 // GetPaste retrieves a paste from BoltDB
-func (b *BoltStore) GetPaste(id string) (*Paste, error) {
+func (b *BoltStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
 	sugar := zap.L().Sugar()
 
 	sugar.Infow("attempting_to_get_paste", "id", id)
@@ -244,7 +763,7 @@ func (b *BoltStore) GetPaste(id string) (*Paste, error) {
 		v := bucket.Get([]byte(id))
 		if v == nil {
 			sugar.Warnw("paste_not_found_in_bolt", "id", id)
-			return fmt.Errorf("paste not found")
+			return fmt.Errorf("paste %s: %w", id, ErrNotFound)
 		}
 
 		sugar.Infow("paste_found_in_bolt",
@@ -261,6 +780,15 @@ func (b *BoltStore) GetPaste(id string) (*Paste, error) {
 			return err
 		}
 
+		if expired(paste.ExpiresAt, time.Now()) {
+			sugar.Infow("paste_expired_in_bolt", "id", id, "expires_at", paste.ExpiresAt)
+			return fmt.Errorf("paste %s: %w", id, ErrExpired)
+		}
+		if paste.Burned {
+			sugar.Infow("paste_already_viewed_in_bolt", "id", id)
+			return fmt.Errorf("paste %s: %w", id, ErrAlreadyViewed)
+		}
+
 		sugar.Infow("paste_unmarshaled_successfully",
 			"id", id,
 			"text_length", len(paste.Text),
@@ -287,83 +815,146 @@ func (b *BoltStore) GetPaste(id string) (*Paste, error) {
 	return &paste, nil
 }
 
-// AddPaste adds a new paste to BoltDB
-func (b *BoltStore) AddPaste(text, lang, title string) (string, error) {
+// TakePaste retrieves a paste from BoltDB, replacing a burn-after-reading
+// paste with its tombstone in the same transaction
+func (b *BoltStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
 	sugar := zap.L().Sugar()
 
-	id := uuid.New().String()
-	sugar.Infow("creating_paste",
-		"id", id,
-		"text_length", len(text),
-		"language", lang,
-		"title", title,
-		"has_text", text != "",
-	)
-
-	paste := Paste{
-		PK:       id,
-		SK:       time.Now().Format(time.RFC3339),
-		Language: lang,
-		Text:     text,
-		Title:    title,
-	}
-
-	sugar.Info("starting_bolt_transaction")
+	var paste Paste
 	err := b.db.Update(func(tx *bolt.Tx) error {
-		sugar.Info("getting_pastes_bucket")
+		// bolt has a single writer, give up if the wait for it outlasted
+		// the caller
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		bucket := tx.Bucket([]byte("pastes"))
 		if bucket == nil {
-			sugar.Error("pastes_bucket_not_found")
 			return fmt.Errorf("pastes bucket not found")
 		}
 
-		sugar.Info("marshaling_paste_to_json")
-		encoded, err := json.Marshal(paste)
-		if err != nil {
-			sugar.Errorw("failed_to_marshal_paste", "error", err)
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("paste %s: %w", id, ErrNotFound)
+		}
+		if err := json.Unmarshal(v, &paste); err != nil {
 			return err
 		}
 
-		sugar.Infow("writing_paste_to_bolt",
-			"id", id,
-			"encoded_size", len(encoded),
-		)
+		now := time.Now()
+		if expired(paste.ExpiresAt, now) {
+			return fmt.Errorf("paste %s: %w", id, ErrExpired)
+		}
+		if paste.Burned {
+			return fmt.Errorf("paste %s: %w", id, ErrAlreadyViewed)
+		}
+		if !paste.BurnAfterReading {
+			return nil
+		}
 
-		err = bucket.Put([]byte(id), encoded)
+		encoded, err := json.Marshal(paste.tombstone(now))
 		if err != nil {
-			sugar.Errorw("failed_to_write_paste_to_bolt",
-				"id", id,
-				"error", err,
-			)
 			return err
 		}
+		sugar.Infow("burning_paste_in_bolt", "id", id)
+		if err := deleteRevisions(tx, []byte(id)); err != nil {
+			return err
+		}
+		return putRecord(tx, "pastes", []byte(id), encoded)
+	})
+
+	if err != nil {
+		sugar.Warnw("failed_to_take_paste_from_bolt",
+			"id", id,
+			"error", err,
+		)
+		return nil, err
+	}
+	return &paste, nil
+}
+
+// AddPaste adds a new paste to BoltDB
+func (b *BoltStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	sugar := zap.L().Sugar()
 
-		sugar.Infow("paste_written_successfully",
+	paste.SK = newSK(time.Now())
+	paste.Revision = 1
+
+	// the id is checked and written in one transaction, and bolt has a
+	// single writer, so two pastes can not claim the same id
+	id, err := assignID(paste.PK, func(id string) error {
+		sugar.Infow("creating_paste",
 			"id", id,
-			"encoded_size", len(encoded),
+			"text_length", len(paste.Text),
+			"language", paste.Language,
+			"title", paste.Title,
+			"has_text", paste.Text != "",
+			"expires_at", paste.ExpiresAt,
 		)
-		return nil
+		paste.PK = id
+
+		sugar.Info("starting_bolt_transaction")
+		return b.db.Update(func(tx *bolt.Tx) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			sugar.Info("getting_pastes_bucket")
+			bucket := tx.Bucket([]byte("pastes"))
+			if bucket == nil {
+				sugar.Error("pastes_bucket_not_found")
+				return fmt.Errorf("pastes bucket not found")
+			}
+			if bucket.Get([]byte(id)) != nil {
+				return fmt.Errorf("paste %s: %w", id, ErrConflict)
+			}
+
+			sugar.Info("marshaling_paste_to_json")
+			encoded, err := json.Marshal(paste)
+			if err != nil {
+				sugar.Errorw("failed_to_marshal_paste", "error", err)
+				return err
+			}
+
+			sugar.Infow("writing_paste_to_bolt",
+				"id", id,
+				"encoded_size", len(encoded),
+			)
+
+			err = putRecord(tx, "pastes", []byte(id), encoded)
+			if err != nil {
+				sugar.Errorw("failed_to_write_paste_to_bolt",
+					"id", id,
+					"error", err,
+				)
+				return err
+			}
+
+			sugar.Infow("paste_written_successfully",
+				"id", id,
+				"encoded_size", len(encoded),
+			)
+			return nil
+		})
 	})
 
 	if err != nil {
 		sugar.Errorw("bolt_transaction_failed",
-			"id", id,
+			"id", paste.PK,
 			"error", err,
 		)
-		return "", err
+		return "", boltWriteError(err)
 	}
 
 	sugar.Infow("paste_added_successfully",
 		"id", id,
-		"text_length", len(text),
-		"language", lang,
-		"title", title,
+		"text_length", len(paste.Text),
+		"language", paste.Language,
+		"title", paste.Title,
 	)
 	return id, nil
 }
 
 // GetDiff retrieves a diff from BoltDB
-func (b *BoltStore) GetDiff(id string) (*Diff, error) {
+func (b *BoltStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
 	sugar := zap.L().Sugar()
 
 	sugar.Infow("attempting_to_get_diff", "id", id)
@@ -381,7 +972,7 @@ func (b *BoltStore) GetDiff(id string) (*Diff, error) {
 		v := bucket.Get([]byte(id))
 		if v == nil {
 			sugar.Warnw("diff_not_found_in_bolt", "id", id)
-			return fmt.Errorf("diff not found")
+			return fmt.Errorf("diff %s: %w", id, ErrNotFound)
 		}
 
 		sugar.Infow("diff_found_in_bolt",
@@ -398,6 +989,11 @@ func (b *BoltStore) GetDiff(id string) (*Diff, error) {
 			return err
 		}
 
+		if expired(diff.ExpiresAt, time.Now()) {
+			sugar.Infow("diff_expired_in_bolt", "id", id, "expires_at", diff.ExpiresAt)
+			return fmt.Errorf("diff %s: %w", id, ErrExpired)
+		}
+
 		sugar.Infow("diff_unmarshaled_successfully",
 			"id", id,
 			"old_text_length", len(diff.OldText),
@@ -423,146 +1019,731 @@ func (b *BoltStore) GetDiff(id string) (*Diff, error) {
 }
 
 // AddDiff adds a new diff to BoltDB
-func (b *BoltStore) AddDiff(oldText, newText string) (string, error) {
+func (b *BoltStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
 	sugar := zap.L().Sugar()
 
-	id := uuid.New().String()
-	sugar.Infow("creating_diff",
-		"id", id,
-		"old_text_length", len(oldText),
-		"new_text_length", len(newText),
-		"has_old_text", oldText != "",
-		"has_new_text", newText != "",
-	)
-
-	diff := Diff{
-		PK:      id,
-		SK:      time.Now().Format(time.RFC3339),
-		OldText: oldText,
-		NewText: newText,
-	}
-
-	sugar.Info("starting_bolt_transaction_for_diff")
-	err := b.db.Update(func(tx *bolt.Tx) error {
-		sugar.Info("getting_diffs_bucket")
-		bucket := tx.Bucket([]byte("diffs"))
-		if bucket == nil {
-			sugar.Error("diffs_bucket_not_found")
-			return fmt.Errorf("diffs bucket not found")
-		}
-
-		sugar.Info("marshaling_diff_to_json")
-		encoded, err := json.Marshal(diff)
-		if err != nil {
-			sugar.Errorw("failed_to_marshal_diff", "error", err)
-			return err
-		}
+	diff.SK = newSK(time.Now())
 
-		sugar.Infow("writing_diff_to_bolt",
+	id, err := assignID(diff.PK, func(id string) error {
+		sugar.Infow("creating_diff",
 			"id", id,
-			"encoded_size", len(encoded),
+			"old_text_length", len(diff.OldText),
+			"new_text_length", len(diff.NewText),
+			"has_old_text", diff.OldText != "",
+			"has_new_text", diff.NewText != "",
+			"expires_at", diff.ExpiresAt,
 		)
-
-		err = bucket.Put([]byte(id), encoded)
-		if err != nil {
-			sugar.Errorw("failed_to_write_diff_to_bolt",
+		diff.PK = id
+
+		sugar.Info("starting_bolt_transaction_for_diff")
+		return b.db.Update(func(tx *bolt.Tx) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			sugar.Info("getting_diffs_bucket")
+			bucket := tx.Bucket([]byte("diffs"))
+			if bucket == nil {
+				sugar.Error("diffs_bucket_not_found")
+				return fmt.Errorf("diffs bucket not found")
+			}
+			if bucket.Get([]byte(id)) != nil {
+				return fmt.Errorf("diff %s: %w", id, ErrConflict)
+			}
+
+			sugar.Info("marshaling_diff_to_json")
+			encoded, err := json.Marshal(diff)
+			if err != nil {
+				sugar.Errorw("failed_to_marshal_diff", "error", err)
+				return err
+			}
+
+			sugar.Infow("writing_diff_to_bolt",
 				"id", id,
-				"error", err,
+				"encoded_size", len(encoded),
 			)
-			return err
-		}
 
-		sugar.Infow("diff_written_successfully",
-			"id", id,
-			"encoded_size", len(encoded),
-		)
-		return nil
+			err = putRecord(tx, "diffs", []byte(id), encoded)
+			if err != nil {
+				sugar.Errorw("failed_to_write_diff_to_bolt",
+					"id", id,
+					"error", err,
+				)
+				return err
+			}
+
+			sugar.Infow("diff_written_successfully",
+				"id", id,
+				"encoded_size", len(encoded),
+			)
+			return nil
+		})
 	})
 
 	if err != nil {
 		sugar.Errorw("bolt_transaction_failed_for_diff",
-			"id", id,
+			"id", diff.PK,
 			"error", err,
 		)
-		return "", err
+		return "", boltWriteError(err)
 	}
 
 	sugar.Infow("diff_added_successfully",
 		"id", id,
-		"old_text_length", len(oldText),
-		"new_text_length", len(newText),
+		"old_text_length", len(diff.OldText),
+		"new_text_length", len(diff.NewText),
 	)
 	return id, nil
 }
 
-// Close closes the BoltDB connection
-func (b *BoltStore) Close() error {
-	return b.db.Close()
-}
+// UpdatePaste writes a new revision of an existing paste to BoltDB, moving
+// the current one into the paste's revisions bucket in the same transaction
+func (b *BoltStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	sugar := zap.L().Sugar()
 
-// GetPaste retrieves a paste from DynamoDB
-func (d *DynamoStore) GetPaste(id string) (*Paste, error) {
-	result, err := d.svc.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(d.tableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"PK": {S: aws.String(id)},
-		},
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte("pastes"))
+		if bucket == nil {
+			return fmt.Errorf("pastes bucket not found")
+		}
+		v := bucket.Get([]byte(paste.PK))
+		if v == nil {
+			return fmt.Errorf("paste %s: %w", paste.PK, ErrNotFound)
+		}
+
+		var current Paste
+		if err := json.Unmarshal(v, &current); err != nil {
+			return err
+		}
+		if current.Burned {
+			return fmt.Errorf("paste %s: %w", paste.PK, ErrAlreadyViewed)
+		}
+
+		revisions, err := tx.Bucket([]byte("revisions")).CreateBucketIfNotExists([]byte(paste.PK))
+		if err != nil {
+			return err
+		}
+		if err := revisions.Put([]byte(current.SK), v); err != nil {
+			return err
+		}
+
+		paste.SK = newSK(time.Now())
+		paste.Revision = current.revision() + 1
+		encoded, err := json.Marshal(paste)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx, "pastes", []byte(paste.PK), encoded)
+	})
+	if err != nil {
+		sugar.Errorw("failed_to_update_paste_in_bolt", "id", paste.PK, "error", err)
+		return boltWriteError(err)
+	}
+
+	sugar.Infow("paste_updated_in_bolt",
+		"id", paste.PK,
+		"revision", paste.Revision,
+		"text_length", len(paste.Text),
+		"language", paste.Language,
+		"title", paste.Title,
+	)
+	return nil
+}
+
+// ListRevisions returns every revision of a paste in BoltDB, oldest first
+func (b *BoltStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	current, err := b.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []*Paste
+	err = b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("revisions")).Bucket([]byte(id))
+		if bucket == nil {
+			return nil
+		}
+		// keys are SKs, so this walks the revisions in order
+		return bucket.ForEach(func(k, v []byte) error {
+			var paste Paste
+			if err := json.Unmarshal(v, &paste); err != nil {
+				return err
+			}
+			revisions = append(revisions, &paste)
+			return nil
+		})
 	})
 	if err != nil {
 		return nil, err
 	}
+	return append(revisions, current), nil
+}
 
+// GetRevision retrieves one revision of a paste from BoltDB
+func (b *BoltStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	revisions, err := b.ListRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, rev)
+}
+
+// ScanPastes calls fn with the revisions of every paste in BoltDB, oldest
+// first, in one read transaction
+func (b *BoltStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		revisionsBucket := tx.Bucket([]byte("revisions"))
+		return tx.Bucket([]byte("pastes")).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var revisions []*Paste
+			if bucket := revisionsBucket.Bucket(k); bucket != nil {
+				err := bucket.ForEach(func(_, rv []byte) error {
+					var paste Paste
+					if err := json.Unmarshal(rv, &paste); err != nil {
+						return err
+					}
+					revisions = append(revisions, &paste)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			var current Paste
+			if err := json.Unmarshal(v, &current); err != nil {
+				return fmt.Errorf("paste %s: %w", k, err)
+			}
+			return fn(append(revisions, &current))
+		})
+	})
+}
+
+// ScanDiffs calls fn with every diff in BoltDB
+func (b *BoltStore) ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("diffs")).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var diff Diff
+			if err := json.Unmarshal(v, &diff); err != nil {
+				return fmt.Errorf("diff %s: %w", k, err)
+			}
+			return fn(&diff)
+		})
+	})
+}
+
+// ImportPaste writes the revisions of a paste, oldest first, to BoltDB as
+// they are. It returns ErrConflict if the paste id is taken.
+func (b *BoltStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	current := revisions[len(revisions)-1]
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte("pastes"))
+		if bucket.Get([]byte(current.PK)) != nil {
+			return fmt.Errorf("paste %s: %w", current.PK, ErrConflict)
+		}
+		if len(revisions) > 1 {
+			older, err := tx.Bucket([]byte("revisions")).CreateBucketIfNotExists([]byte(current.PK))
+			if err != nil {
+				return err
+			}
+			for _, paste := range revisions[:len(revisions)-1] {
+				encoded, err := json.Marshal(paste)
+				if err != nil {
+					return err
+				}
+				if err := older.Put([]byte(paste.SK), encoded); err != nil {
+					return err
+				}
+			}
+		}
+		encoded, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx, "pastes", []byte(current.PK), encoded)
+	})
+	return boltWriteError(err)
+}
+
+// ImportDiff writes diff to BoltDB as it is. It returns ErrConflict if the
+// diff id is taken.
+func (b *BoltStore) ImportDiff(ctx context.Context, diff *Diff) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte("diffs"))
+		if bucket.Get([]byte(diff.PK)) != nil {
+			return fmt.Errorf("diff %s: %w", diff.PK, ErrConflict)
+		}
+		encoded, err := json.Marshal(diff)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx, "diffs", []byte(diff.PK), encoded)
+	})
+	return boltWriteError(err)
+}
+
+// RewrapKeys rewrites the key fields of every record in one transaction
+func (b *BoltStore) RewrapKeys(ctx context.Context, rewrap rewrapFunc) (int, error) {
+	n := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		buckets := []*bolt.Bucket{tx.Bucket([]byte("pastes")), tx.Bucket([]byte("diffs")), tx.Bucket([]byte("bodies"))}
+		revisions := tx.Bucket([]byte("revisions"))
+		err := revisions.ForEach(func(k, v []byte) error {
+			if v == nil {
+				buckets = append(buckets, revisions.Bucket(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, bucket := range buckets {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			changed, err := rewrapBucket(bucket, rewrap)
+			if err != nil {
+				return err
+			}
+			n += changed
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, boltWriteError(err)
+	}
+	return n, nil
+}
+
+// rewrapBucket rewrites the key fields of the records in bucket, editing
+// their JSON so that fields unknown to Paste, Diff or Body survive
+func rewrapBucket(bucket *bolt.Bucket, rewrap rewrapFunc) (int, error) {
+	// a bucket must not change while ForEach walks it
+	updates := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var keys struct{ KeyID, DataKey string }
+		if err := json.Unmarshal(v, &keys); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		changed, err := rewrapFields(rewrap, &keys.KeyID, &keys.DataKey)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		if !changed {
+			return nil
+		}
+		var record map[string]json.RawMessage
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		record["KeyID"], _ = json.Marshal(keys.KeyID)
+		record["DataKey"], _ = json.Marshal(keys.DataKey)
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		updates[string(k)] = encoded
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range updates {
+		if err := bucket.Put([]byte(k), v); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+// AcquireBody stores body unless its hash is already there, counting one
+// more reference and its expiry in the same transaction
+func (b *BoltStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	created := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte("bodies"))
+		stored := *body
+		stored.Refs, stored.Expiries = 0, nil
+		if v := bucket.Get([]byte(body.Hash)); v != nil {
+			// the stored body is kept as it is, fields absent from it
+			// included
+			stored = Body{}
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+		} else {
+			created = true
+		}
+		stored.acquire(body.ExpiresAt)
+		encoded, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx, "bodies", []byte(body.Hash), encoded)
+	})
+	return created, boltWriteError(err)
+}
+
+// GetBody retrieves the body stored under hash
+func (b *BoltStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	var body Body
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("bodies")).Get([]byte(hash))
+		if v == nil {
+			return fmt.Errorf("body %s: %w", hash, ErrNotFound)
+		}
+		return json.Unmarshal(v, &body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired(body.ExpiresAt, time.Now()) {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrExpired)
+	}
+	return &body, nil
+}
+
+// ReleaseBody drops the reference expiring at expiresAt from the body
+// stored under hash, deleting it once none are left
+func (b *BoltStore) ReleaseBody(ctx context.Context, hash string, expiresAt int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte("bodies"))
+		v := bucket.Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+		var body Body
+		if err := json.Unmarshal(v, &body); err != nil {
+			return err
+		}
+		if !body.release(expiresAt) {
+			return deleteRecord(tx, "bodies", []byte(hash))
+		}
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		return putRecord(tx, "bodies", []byte(hash), encoded)
+	})
+}
+
+// boltWriteError marks bolt refusing an oversized value as ErrTooLarge
+func boltWriteError(err error) error {
+	if errors.Is(err, bolt.ErrValueTooLarge) {
+		return fmt.Errorf("%w: %v", ErrTooLarge, err)
+	}
+	return err
+}
+
+// deleteRevisions drops the revisions bucket of the paste id, if it has one
+func deleteRevisions(tx *bolt.Tx, id []byte) error {
+	revisions := tx.Bucket([]byte("revisions"))
+	if revisions.Bucket(id) == nil {
+		return nil
+	}
+	return revisions.DeleteBucket(id)
+}
+
+// DeletePaste removes a paste and its revisions from BoltDB
+func (b *BoltStore) DeletePaste(ctx context.Context, id string) error {
+	return b.delete(ctx, "pastes", id)
+}
+
+// DeleteDiff removes a diff from BoltDB
+func (b *BoltStore) DeleteDiff(ctx context.Context, id string) error {
+	return b.delete(ctx, "diffs", id)
+}
+
+// delete removes the item stored under id in the named bucket
+func (b *BoltStore) delete(ctx context.Context, name, id string) error {
+	sugar := zap.L().Sugar()
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil {
+			return fmt.Errorf("%s bucket not found", name)
+		}
+		if bucket.Get([]byte(id)) == nil {
+			return fmt.Errorf("%s %s: %w", name, id, ErrNotFound)
+		}
+		if name == "pastes" {
+			if err := deleteRevisions(tx, []byte(id)); err != nil {
+				return err
+			}
+		}
+		return deleteRecord(tx, name, []byte(id))
+	})
+	if err != nil {
+		sugar.Warnw("failed_to_delete_from_bolt", "bucket", name, "id", id, "error", err)
+		return err
+	}
+
+	sugar.Infow("deleted_from_bolt", "bucket", name, "id", id)
+	return nil
+}
+
+// Close stops the expiry sweeper and closes the BoltDB connection
+func (b *BoltStore) Close() error {
+	close(b.done)
+	return b.db.Close()
+}
+
+// key prefixes that keep pastes, diffs and bodies apart in the shared table
+const (
+	dynamoPastePrefix = "PASTE#"
+	dynamoDiffPrefix  = "DIFF#"
+	dynamoBodyPrefix  = "BODY#"
+	dynamoRevPrefix   = "REV#"
+	dynamoDiffSK      = "META"
+	// dynamoClaimSK is the sort key of the item that reserves a paste id,
+	// next to its revisions
+	dynamoClaimSK = "ID"
+)
+
+// revisionSK is the sort key of revision rev of a paste. Zero padding
+// makes the keys sort in revision order.
+func revisionSK(rev int) string {
+	return fmt.Sprintf("%s%08d", dynamoRevPrefix, rev)
+}
+
+// itemKey is the primary key of an item
+func itemKey(pk, sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {S: aws.String(pk)},
+		"SK": {S: aws.String(sk)},
+	}
+}
+
+// marshalItem stores v under the given key. PK and SK of a Paste or Diff
+// hold the id and the time it was written, so the time is kept in
+// CreatedAt instead.
+func marshalItem(v interface{}, createdAt, pk, sk string) (map[string]*dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(v)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range itemKey(pk, sk) {
+		av[k] = v
+	}
+	av["CreatedAt"] = &dynamodb.AttributeValue{S: aws.String(createdAt)}
+	return av, nil
+}
+
+// unmarshalPaste is the reverse of marshalItem for pastes
+func unmarshalPaste(item map[string]*dynamodb.AttributeValue) (*Paste, error) {
 	paste := &Paste{}
-	err = dynamodbattribute.UnmarshalMap(result.Item, paste)
+	if err := dynamodbattribute.UnmarshalMap(item, paste); err != nil {
+		return nil, err
+	}
+	paste.PK = strings.TrimPrefix(paste.PK, dynamoPastePrefix)
+	paste.SK = itemCreatedAt(item)
+	return paste, nil
+}
+
+// itemCreatedAt is the CreatedAt attribute written by marshalItem
+func itemCreatedAt(item map[string]*dynamodb.AttributeValue) string {
+	if av, ok := item["CreatedAt"]; ok {
+		return aws.StringValue(av.S)
+	}
+	return ""
+}
+
+// query returns the revisions of the paste id, newest first. A limit of
+// zero returns all of them.
+func (d *DynamoStore) query(ctx context.Context, id string, limit int64) ([]map[string]*dynamodb.AttributeValue, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :rev)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk":  {S: aws.String(dynamoPastePrefix + id)},
+			":rev": {S: aws.String(dynamoRevPrefix)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		// a paste read straight after it was edited or burned must see that
+		ConsistentRead: aws.Bool(true),
+	}
+	if limit > 0 {
+		input.Limit = aws.Int64(limit)
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := d.svc.QueryPagesWithContext(ctx, input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return limit == 0 || int64(len(items)) < limit
+	})
 	if err != nil {
 		return nil, err
 	}
+	return items, nil
+}
+
+// latestPaste returns the current revision of a paste without checking
+// whether it expired or was burned
+func (d *DynamoStore) latestPaste(ctx context.Context, id string) (*Paste, error) {
+	items, err := d.query(ctx, id, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrNotFound)
+	}
+	return unmarshalPaste(items[0])
+}
+
+// GetPaste retrieves the current revision of a paste from DynamoDB
+func (d *DynamoStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	paste, err := d.latestPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// DynamoDB deletes expired items lazily, so they may still be read
+	if expired(paste.ExpiresAt, time.Now()) {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrExpired)
+	}
+	if paste.Burned {
+		return nil, fmt.Errorf("paste %s: %w", id, ErrAlreadyViewed)
+	}
 
 	return paste, nil
 }
 
-// AddPaste adds a new paste to DynamoDB
-func (d *DynamoStore) AddPaste(text, lang, title string) (string, error) {
+// TakePaste retrieves a paste from DynamoDB. A burn-after-reading paste is
+// overwritten by its tombstone in a transaction that also checks no newer
+// revision has been written, so only one reader can win and an edit racing
+// the read cannot leave an unburned revision behind.
+func (d *DynamoStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
 	sugar := zap.L().Sugar()
 
-	id := uuid.New().String()
-	sugar.Infow("creating_paste_in_dynamo",
-		"id", id,
-		"text_length", len(text),
-		"language", lang,
-		"title", title,
-		"table_name", d.tableName,
-		"has_text", text != "",
-	)
+	for {
+		current, err := d.GetPaste(ctx, id)
+		if err != nil || !current.BurnAfterReading {
+			return current, err
+		}
 
-	paste := Paste{
-		PK:       id,
-		SK:       time.Now().Format(time.RFC3339),
-		Language: lang,
-		Text:     text,
-		Title:    title,
+		sk := revisionSK(current.revision())
+		tomb := current.tombstone(time.Now())
+		err = d.burnRevision(ctx, id, sk, tomb, current.revision())
+		if errors.Is(err, errNewerRevision) {
+			// an edit landed after the read, burn that one instead
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// earlier revisions must not outlive the paste
+		if err := d.deleteRevisions(ctx, id, sk); err != nil {
+			sugar.Warnw("failed_to_delete_burned_revisions_from_dynamo", "id", id, "error", err)
+		}
+		// the id is free again once the tombstone is gone
+		if _, err := d.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			Item:      idClaimItem(id, tomb.ExpiresAt),
+			TableName: aws.String(d.tableName),
+		}); err != nil {
+			sugar.Warnw("failed_to_shorten_paste_id_claim_in_dynamo", "id", id, "error", err)
+		}
+
+		sugar.Infow("paste_burned_in_dynamo", "id", id)
+		return current, nil
 	}
+}
+
+// errNewerRevision is returned by burnRevision when the revision read is no
+// longer the current one
+var errNewerRevision = errors.New("a newer revision was written")
 
-	sugar.Info("marshaling_paste_for_dynamo")
-	av, err := dynamodbattribute.MarshalMap(paste)
+// burnRevision writes tomb over revision rev, stored under sk, provided it
+// is not burned yet and revision rev+1 does not exist
+func (d *DynamoStore) burnRevision(ctx context.Context, id, sk string, tomb *Paste, rev int) error {
+	av, err := marshalItem(tomb, tomb.SK, dynamoPastePrefix+id, sk)
 	if err != nil {
-		sugar.Errorw("failed_to_marshal_paste_for_dynamo", "error", err)
-		return "", err
+		return err
 	}
+	_, err = d.svc.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				Item:                                av,
+				TableName:                           aws.String(d.tableName),
+				ConditionExpression:                 aws.String("attribute_exists(PK) AND attribute_not_exists(Burned)"),
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+			}},
+			{ConditionCheck: &dynamodb.ConditionCheck{
+				Key:                 itemKey(dynamoPastePrefix+id, revisionSK(rev+1)),
+				TableName:           aws.String(d.tableName),
+				ConditionExpression: aws.String("attribute_not_exists(PK)"),
+			}},
+		},
+	})
+	reasons := cancellationReasons(err)
+	switch {
+	case checkFailed(reasons, 0) && reasons[0].Item == nil:
+		return fmt.Errorf("paste %s: %w", id, ErrNotFound)
+	case checkFailed(reasons, 0):
+		// another reader burned it first
+		return fmt.Errorf("paste %s: %w", id, ErrAlreadyViewed)
+	case checkFailed(reasons, 1):
+		return fmt.Errorf("paste %s revision %d: %w", id, rev+1, errNewerRevision)
+	}
+	return err
+}
 
-	sugar.Infow("writing_paste_to_dynamo",
-		"id", id,
-		"table_name", d.tableName,
-		"item_size", len(av),
-	)
+// AddPaste adds a new paste to DynamoDB. The id is claimed first with a
+// conditional put of its claim item, as a burned paste may have left only
+// its tombstone behind and so revision 1 can not vouch for the id.
+func (d *DynamoStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	sugar := zap.L().Sugar()
 
-	_, err = d.svc.PutItem(&dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(d.tableName),
+	paste.SK = newSK(time.Now())
+	paste.Revision = 1
+
+	id, err := assignID(paste.PK, func(id string) error {
+		sugar.Infow("creating_paste_in_dynamo",
+			"id", id,
+			"text_length", len(paste.Text),
+			"language", paste.Language,
+			"title", paste.Title,
+			"table_name", d.tableName,
+			"has_text", paste.Text != "",
+			"expires_at", paste.ExpiresAt,
+		)
+		paste.PK = id
+
+		if err := d.claimID(ctx, id, paste.ExpiresAt); err != nil {
+			return err
+		}
+		err := d.putRevision(ctx, paste)
+		if err != nil {
+			d.releaseID(id)
+		}
+		return err
 	})
 	if err != nil {
 		sugar.Errorw("failed_to_write_paste_to_dynamo",
-			"id", id,
+			"id", paste.PK,
 			"table_name", d.tableName,
 			"error", err,
 		)
@@ -571,59 +1752,678 @@ func (d *DynamoStore) AddPaste(text, lang, title string) (string, error) {
 
 	sugar.Infow("paste_added_successfully_to_dynamo",
 		"id", id,
-		"text_length", len(text),
-		"language", lang,
-		"title", title,
+		"text_length", len(paste.Text),
+		"language", paste.Language,
+		"title", paste.Title,
 		"table_name", d.tableName,
 	)
 	return id, nil
 }
 
-// GetDiff retrieves a diff from DynamoDB
-func (d *DynamoStore) GetDiff(id string) (*Diff, error) {
-	result, err := d.svc.GetItem(&dynamodb.GetItemInput{
+// claimID writes the claim item of the paste id, failing with ErrConflict
+// when another paste holds it. The claim expires along with the paste.
+func (d *DynamoStore) claimID(ctx context.Context, id string, expiresAt int64) error {
+	_, err := d.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                idClaimItem(id, expiresAt),
+		TableName:           aws.String(d.tableName),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("paste %s: %w", id, ErrConflict)
+	}
+	return err
+}
+
+// releaseID removes the claim item of the paste id. It runs on cleanup
+// paths, so a failure is only logged; the claim then lasts until it
+// expires.
+func (d *DynamoStore) releaseID(id string) {
+	_, err := d.svc.DeleteItemWithContext(context.Background(), &dynamodb.DeleteItemInput{
 		TableName: aws.String(d.tableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"PK": {S: aws.String(id)},
-		},
+		Key:       itemKey(dynamoPastePrefix+id, dynamoClaimSK),
+	})
+	if err != nil {
+		zap.L().Sugar().Warnw("failed_to_release_paste_id_in_dynamo", "id", id, "error", err)
+	}
+}
+
+// idClaimItem is the item that holds the paste id until expiresAt, or for
+// good when it is zero
+func idClaimItem(id string, expiresAt int64) map[string]*dynamodb.AttributeValue {
+	item := itemKey(dynamoPastePrefix+id, dynamoClaimSK)
+	if expiresAt != 0 {
+		item["ExpiresAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expiresAt, 10))}
+	}
+	return item
+}
+
+// putRevision writes paste as revision paste.Revision. The write fails if
+// that revision already exists, so two concurrent edits cannot both claim
+// the same revision number.
+func (d *DynamoStore) putRevision(ctx context.Context, paste *Paste) error {
+	av, err := marshalItem(paste, paste.SK, dynamoPastePrefix+paste.PK, revisionSK(paste.Revision))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(d.tableName),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("paste %s revision %d already exists: %w", paste.PK, paste.Revision, ErrConflict)
+	}
+	return dynamoWriteError(err)
+}
+
+// GetDiff retrieves a diff from DynamoDB
+func (d *DynamoStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	result, err := d.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            itemKey(dynamoDiffPrefix+id, dynamoDiffSK),
+		ConsistentRead: aws.Bool(true),
 	})
 	if err != nil {
 		return nil, err
 	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("diff %s: %w", id, ErrNotFound)
+	}
 
 	diff := &Diff{}
 	err = dynamodbattribute.UnmarshalMap(result.Item, diff)
 	if err != nil {
 		return nil, err
 	}
+	diff.PK = id
+	diff.SK = itemCreatedAt(result.Item)
+	if expired(diff.ExpiresAt, time.Now()) {
+		return nil, fmt.Errorf("diff %s: %w", id, ErrExpired)
+	}
 
 	return diff, nil
 }
 
+// AcquireBody stores body unless its hash is already there, then counts
+// one more reference and its expiry. DynamoDB cannot edit a list of
+// expiries in one update, so a stored body is read and written back on
+// condition that its Version has not moved, and a new one put on
+// condition that there is none; a writer that lost the race reads again.
+func (d *DynamoStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	key := itemKey(dynamoBodyPrefix+body.Hash, dynamoDiffSK)
+	for {
+		stored, version, err := d.getBodyVersion(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if stored != nil {
+			stored.acquire(body.ExpiresAt)
+			err = d.putBodyRefs(ctx, key, stored, version)
+		} else {
+			err = d.putNewBody(ctx, key, body)
+		}
+		if err == nil {
+			return stored == nil, nil
+		}
+		if !isConditionFailed(err) {
+			return false, dynamoWriteError(err)
+		}
+		// released, deleted or acquired in between
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// bodyVersion is the attribute counting the writes to a body item. Bodies
+// stored before it was kept have none, which counts as zero.
+const bodyVersion = "Version"
+
+// getBodyVersion reads the body under key and its version, returning a
+// nil body if there is none
+func (d *DynamoStore) getBodyVersion(ctx context.Context, key map[string]*dynamodb.AttributeValue) (*Body, int64, error) {
+	result, err := d.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || result.Item == nil {
+		return nil, 0, err
+	}
+	body := &Body{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, body); err != nil {
+		return nil, 0, err
+	}
+	var version int64
+	if v, ok := result.Item[bodyVersion]; ok {
+		if version, err = strconv.ParseInt(aws.StringValue(v.N), 10, 64); err != nil {
+			return nil, 0, err
+		}
+	}
+	return body, version, nil
+}
+
+// putNewBody stores body with a single reference, unless one is already
+// stored under key
+func (d *DynamoStore) putNewBody(ctx context.Context, key map[string]*dynamodb.AttributeValue, body *Body) error {
+	stored := *body
+	stored.Refs, stored.Expiries = 0, nil
+	stored.acquire(body.ExpiresAt)
+	av, err := dynamodbattribute.MarshalMap(&stored)
+	if err != nil {
+		return err
+	}
+	for k, v := range key {
+		av[k] = v
+	}
+	av[bodyVersion] = &dynamodb.AttributeValue{N: aws.String("1")}
+	_, err = d.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.tableName),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	return err
+}
+
+// putBodyRefs writes the references of body back under key, or deletes it
+// if none are left, on condition that it is still at version
+func (d *DynamoStore) putBodyRefs(ctx context.Context, key map[string]*dynamodb.AttributeValue, body *Body, version int64) error {
+	condition := "#version = :version"
+	if version == 0 {
+		condition = "attribute_exists(PK) AND attribute_not_exists(#version)"
+	}
+	names := map[string]*string{"#version": aws.String(bodyVersion)}
+	values := map[string]*dynamodb.AttributeValue{}
+	if version != 0 {
+		values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version, 10))}
+	}
+	if body.Refs == 0 {
+		if len(values) == 0 {
+			values = nil
+		}
+		_, err := d.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(d.tableName),
+			Key:                       key,
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		})
+		return err
+	}
+
+	expiries, err := dynamodbattribute.Marshal(body.Expiries)
+	if err != nil {
+		return err
+	}
+	names["#refs"] = aws.String("Refs")
+	names["#expiries"] = aws.String("Expiries")
+	names["#expires"] = aws.String("ExpiresAt")
+	values[":refs"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(body.Refs))}
+	values[":expiries"] = expiries
+	values[":expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(body.ExpiresAt, 10))}
+	values[":next"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version+1, 10))}
+	_, err = d.svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(d.tableName),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET #refs = :refs, #expiries = :expiries, #expires = :expires, #version = :next"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// GetBody retrieves the body stored under hash
+func (d *DynamoStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	result, err := d.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            itemKey(dynamoBodyPrefix+hash, dynamoDiffSK),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrNotFound)
+	}
+	body := &Body{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, body); err != nil {
+		return nil, err
+	}
+	if expired(body.ExpiresAt, time.Now()) {
+		return nil, fmt.Errorf("body %s: %w", hash, ErrExpired)
+	}
+	return body, nil
+}
+
+// ReleaseBody drops the reference expiring at expiresAt from the body
+// stored under hash, deleting it once none are left. Like AcquireBody it
+// writes on condition that the body has not moved, reading again if it has.
+func (d *DynamoStore) ReleaseBody(ctx context.Context, hash string, expiresAt int64) error {
+	key := itemKey(dynamoBodyPrefix+hash, dynamoDiffSK)
+	for {
+		body, version, err := d.getBodyVersion(ctx, key)
+		if err != nil || body == nil {
+			return err
+		}
+		body.release(expiresAt)
+		err = d.putBodyRefs(ctx, key, body, version)
+		if !isConditionFailed(err) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
 // AddDiff adds a new diff to DynamoDB
-func (d *DynamoStore) AddDiff(oldText, newText string) (string, error) {
-	id := uuid.New().String()
-	diff := Diff{
-		PK:      id,
-		SK:      time.Now().Format(time.RFC3339),
-		OldText: oldText,
-		NewText: newText,
+func (d *DynamoStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
+	diff.SK = newSK(time.Now())
+
+	// ImportDiff puts the diff on condition that its id is free
+	return assignID(diff.PK, func(id string) error {
+		diff.PK = id
+		return d.ImportDiff(ctx, diff)
+	})
+}
+
+// UpdatePaste writes a new revision of an existing paste to DynamoDB. The
+// previous revisions stay in place under their own SK. The new revision is
+// put in a transaction that checks the one it follows was not burned or
+// deleted in the meantime, and fails with ErrConflict if another edit
+// claimed its number first.
+func (d *DynamoStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	current, err := d.GetPaste(ctx, paste.PK)
+	if err != nil {
+		return err
 	}
 
-	av, err := dynamodbattribute.MarshalMap(diff)
+	paste.SK = newSK(time.Now())
+	paste.Revision = current.revision() + 1
+	av, err := marshalItem(paste, paste.SK, dynamoPastePrefix+paste.PK, revisionSK(paste.Revision))
 	if err != nil {
-		return "", err
+		return err
+	}
+	_, err = d.svc.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				Item:                av,
+				TableName:           aws.String(d.tableName),
+				ConditionExpression: aws.String("attribute_not_exists(PK)"),
+			}},
+			{ConditionCheck: &dynamodb.ConditionCheck{
+				Key:                                 itemKey(dynamoPastePrefix+paste.PK, revisionSK(current.revision())),
+				TableName:                           aws.String(d.tableName),
+				ConditionExpression:                 aws.String("attribute_exists(PK) AND attribute_not_exists(Burned)"),
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+			}},
+		},
+	})
+	reasons := cancellationReasons(err)
+	switch {
+	case checkFailed(reasons, 0):
+		return fmt.Errorf("paste %s revision %d already exists: %w", paste.PK, paste.Revision, ErrConflict)
+	case checkFailed(reasons, 1) && reasons[1].Item == nil:
+		return fmt.Errorf("paste %s: %w", paste.PK, ErrNotFound)
+	case checkFailed(reasons, 1):
+		return fmt.Errorf("paste %s: %w", paste.PK, ErrAlreadyViewed)
 	}
+	return dynamoWriteError(err)
+}
 
-	_, err = d.svc.PutItem(&dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(d.tableName),
+// ListRevisions returns every revision of a paste in DynamoDB, oldest first
+func (d *DynamoStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	current, err := d.GetPaste(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := d.revisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		// raced with a delete
+		revisions = append(revisions, current)
+	}
+	return revisions, nil
+}
+
+// revisions returns every stored revision of a paste, oldest first,
+// without checking whether it expired or was burned
+func (d *DynamoStore) revisions(ctx context.Context, id string) ([]*Paste, error) {
+	items, err := d.query(ctx, id, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]*Paste, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		paste, err := unmarshalPaste(items[i])
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, paste)
+	}
+	return revisions, nil
+}
+
+// GetRevision retrieves one revision of a paste from DynamoDB
+func (d *DynamoStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	// the current revision says whether the paste still exists at all
+	if _, err := d.GetPaste(ctx, id); err != nil {
+		return nil, err
+	}
+
+	result, err := d.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            itemKey(dynamoPastePrefix+id, revisionSK(rev)),
+		ConsistentRead: aws.Bool(true),
 	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("revision %d: %w", rev, ErrNotFound)
 	}
+	return unmarshalPaste(result.Item)
+}
 
-	return id, nil
+// DeletePaste removes a paste and all its revisions from DynamoDB
+func (d *DynamoStore) DeletePaste(ctx context.Context, id string) error {
+	items, err := d.query(ctx, id, 0)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("paste %s: %w", id, ErrNotFound)
+	}
+	if err := d.deleteItems(ctx, items); err != nil {
+		return err
+	}
+	d.releaseID(id)
+	return nil
+}
+
+// deleteRevisions removes every revision of the paste id except the one
+// stored under keep
+func (d *DynamoStore) deleteRevisions(ctx context.Context, id, keep string) error {
+	items, err := d.query(ctx, id, 0)
+	if err != nil {
+		return err
+	}
+	var stale []map[string]*dynamodb.AttributeValue
+	for _, item := range items {
+		if aws.StringValue(item["SK"].S) != keep {
+			stale = append(stale, item)
+		}
+	}
+	return d.deleteItems(ctx, stale)
+}
+
+// deleteItems removes the given items by their key
+func (d *DynamoStore) deleteItems(ctx context.Context, items []map[string]*dynamodb.AttributeValue) error {
+	for _, item := range items {
+		_, err := d.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"PK": item["PK"],
+				"SK": item["SK"],
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDiff removes a diff from DynamoDB
+func (d *DynamoStore) DeleteDiff(ctx context.Context, id string) error {
+	_, err := d.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.tableName),
+		Key:                 itemKey(dynamoDiffPrefix+id, dynamoDiffSK),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("diff %s: %w", id, ErrNotFound)
+	}
+	return err
+}
+
+// scan calls fn with every item whose PK starts with prefix
+func (d *DynamoStore) scan(ctx context.Context, prefix string, fn func(item map[string]*dynamodb.AttributeValue) error) error {
+	var fnErr error
+	err := d.svc.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(d.tableName),
+		FilterExpression: aws.String("begins_with(PK, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {S: aws.String(prefix)},
+		},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if fnErr = fn(item); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// ScanPastes calls fn with the revisions of every paste in DynamoDB, oldest
+// first. A scan does not promise to return the revisions of a paste
+// together, so they are queried by id the first time it comes up.
+func (d *DynamoStore) ScanPastes(ctx context.Context, fn func(revisions []*Paste) error) error {
+	seen := make(map[string]bool)
+	return d.scan(ctx, dynamoPastePrefix, func(item map[string]*dynamodb.AttributeValue) error {
+		id := strings.TrimPrefix(aws.StringValue(item["PK"].S), dynamoPastePrefix)
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+		revisions, err := d.revisions(ctx, id)
+		if err != nil {
+			return err
+		}
+		if len(revisions) == 0 {
+			// deleted since the scan read it
+			return nil
+		}
+		return fn(revisions)
+	})
+}
+
+// ScanDiffs calls fn with every diff in DynamoDB
+func (d *DynamoStore) ScanDiffs(ctx context.Context, fn func(diff *Diff) error) error {
+	return d.scan(ctx, dynamoDiffPrefix, func(item map[string]*dynamodb.AttributeValue) error {
+		diff := &Diff{}
+		if err := dynamodbattribute.UnmarshalMap(item, diff); err != nil {
+			return err
+		}
+		diff.PK = strings.TrimPrefix(diff.PK, dynamoDiffPrefix)
+		diff.SK = itemCreatedAt(item)
+		return fn(diff)
+	})
+}
+
+// ImportPaste writes the revisions of a paste to DynamoDB as they are. A
+// paste cut short by an interrupted migration, whose stored revisions are
+// the first of those imported, is completed by the next run. ErrConflict
+// is returned when every revision was there already or the id holds
+// another paste, as the other stores do.
+func (d *DynamoStore) ImportPaste(ctx context.Context, revisions []*Paste) error {
+	id := revisions[0].PK
+	stored, err := d.revisions(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(stored) >= len(revisions) || !startsWith(revisions, stored) {
+		return fmt.Errorf("paste %s: %w", id, ErrConflict)
+	}
+	last := revisions[len(revisions)-1]
+	if len(stored) == 0 {
+		// nothing of this paste was imported yet, so a claim on the id
+		// belongs to another
+		if err := d.claimID(ctx, id, last.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	for _, paste := range revisions[len(stored):] {
+		if err := d.putRevision(ctx, paste); err != nil {
+			if len(stored) == 0 && paste == revisions[0] {
+				d.releaseID(id)
+			}
+			return err
+		}
+	}
+	if len(stored) > 0 {
+		// the run cut short may not have got as far as claiming the id
+		if err := d.claimID(ctx, id, last.ExpiresAt); err != nil && !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return nil
+}
+
+// startsWith reports whether stored are the first of revisions, created at
+// the same times, rather than those of another paste under the same id
+func startsWith(revisions, stored []*Paste) bool {
+	if len(stored) > len(revisions) {
+		return false
+	}
+	for i, paste := range stored {
+		if paste.revision() != revisions[i].revision() || paste.SK != revisions[i].SK {
+			return false
+		}
+	}
+	return true
+}
+
+// ImportDiff writes diff to DynamoDB as it is. It returns ErrConflict if
+// the diff id is taken.
+func (d *DynamoStore) ImportDiff(ctx context.Context, diff *Diff) error {
+	av, err := marshalItem(diff, diff.SK, dynamoDiffPrefix+diff.PK, dynamoDiffSK)
+	if err != nil {
+		return err
+	}
+	_, err = d.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(d.tableName),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("diff %s: %w", diff.PK, ErrConflict)
+	}
+	return dynamoWriteError(err)
+}
+
+// RewrapKeys scans for encrypted items and rewrites their key fields. An
+// item is only updated if its data key is still the one scanned, so one
+// written in between, under the current key, is left alone.
+func (d *DynamoStore) RewrapKeys(ctx context.Context, rewrap rewrapFunc) (int, error) {
+	n := 0
+	var fnErr error
+	err := d.svc.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:            aws.String(d.tableName),
+		ProjectionExpression: aws.String("PK, SK, #keyID, #dataKey"),
+		FilterExpression:     aws.String("attribute_exists(#keyID)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#keyID":   aws.String("KeyID"),
+			"#dataKey": aws.String("DataKey"),
+		},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var keys struct{ PK, SK, KeyID, DataKey string }
+			if fnErr = dynamodbattribute.UnmarshalMap(item, &keys); fnErr != nil {
+				return false
+			}
+			oldKey := keys.DataKey
+			changed, err := rewrapFields(rewrap, &keys.KeyID, &keys.DataKey)
+			if err != nil {
+				fnErr = fmt.Errorf("%s %s: %w", keys.PK, keys.SK, err)
+				return false
+			}
+			if !changed {
+				continue
+			}
+			_, err = d.svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+				TableName:           aws.String(d.tableName),
+				Key:                 itemKey(keys.PK, keys.SK),
+				UpdateExpression:    aws.String("SET #keyID = :keyID, #dataKey = :dataKey"),
+				ConditionExpression: aws.String("#dataKey = :old"),
+				ExpressionAttributeNames: map[string]*string{
+					"#keyID":   aws.String("KeyID"),
+					"#dataKey": aws.String("DataKey"),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":keyID":   {S: aws.String(keys.KeyID)},
+					":dataKey": {S: aws.String(keys.DataKey)},
+					":old":     {S: aws.String(oldKey)},
+				},
+			})
+			if isConditionFailed(err) {
+				continue
+			}
+			if err != nil {
+				fnErr = dynamoWriteError(err)
+				return false
+			}
+			n++
+		}
+		return true
+	})
+	if fnErr != nil {
+		return n, fnErr
+	}
+	return n, err
+}
+
+// awsErrorCode returns the AWS error code of err, or "" if it has none
+func awsErrorCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// dynamoWriteError marks DynamoDB refusing an item over its 400 KB limit as
+// ErrTooLarge
+func dynamoWriteError(err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "ValidationException" && strings.Contains(aerr.Message(), "size") {
+		return fmt.Errorf("%w: %v", ErrTooLarge, err)
+	}
+	return err
+}
+
+// isConditionFailed reports whether err is DynamoDB rejecting a write
+// because its condition expression did not hold
+func isConditionFailed(err error) bool {
+	return awsErrorCode(err) == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// cancellationReasons returns the reasons, one per item, that DynamoDB
+// gives for cancelling a transaction, or nil when err is not a cancelled
+// transaction
+func cancellationReasons(err error) []*dynamodb.CancellationReason {
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		return canceled.CancellationReasons
+	}
+	return nil
+}
+
+// checkFailed reports whether item i of a cancelled transaction failed its
+// condition
+func checkFailed(reasons []*dynamodb.CancellationReason, i int) bool {
+	return i < len(reasons) && aws.StringValue(reasons[i].Code) == "ConditionalCheckFailed"
 }
 
 // Close is a no-op for DynamoDB as it doesn't require explicit closing
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestBoltStore opens a BoltStore in a temporary directory that is
+// closed when the test ends
+func newTestBoltStore(t *testing.T) *BoltStore {
+	t.Helper()
+	b, err := openBoltStore(filepath.Join(t.TempDir(), "pbin.db"))
+	if err != nil {
+		t.Fatalf("openBoltStore: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// checkSwept fails the test unless err is the ErrNotFound of a record that
+// is gone, rather than the ErrExpired of one still stored
+func checkSwept(t *testing.T, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+		t.Errorf("read after sweep = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBoltDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBoltStore(t)
+	now := time.Now()
+
+	past, err := b.AddPaste(ctx, &Paste{Text: "old", ExpiresAt: now.Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	future, err := b.AddPaste(ctx, &Paste{Text: "new", ExpiresAt: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	never, err := b.AddPaste(ctx, &Paste{Text: "kept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an edit that moves the expiry into the past must move its index entry
+	moved, err := b.AddPaste(ctx, &Paste{Text: "moved", ExpiresAt: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpdatePaste(ctx, &Paste{PK: moved, Text: "moved", ExpiresAt: now.Add(-time.Second).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := b.AddDiff(ctx, &Diff{OldText: "a", NewText: "b", ExpiresAt: now.Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := b.deleteExpired(now)
+	if err != nil {
+		t.Fatalf("deleteExpired: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("deleteExpired removed %d records, want 3", n)
+	}
+	for _, id := range []string{past, moved} {
+		_, err := b.GetPaste(ctx, id)
+		checkSwept(t, err)
+	}
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("revisions")).Bucket([]byte(moved)) != nil {
+			t.Errorf("revisions of %s outlived it", moved)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetDiff(ctx, diff)
+	checkSwept(t, err)
+	for _, id := range []string{future, never} {
+		if _, err := b.GetPaste(ctx, id); err != nil {
+			t.Errorf("GetPaste(%s) after sweep: %v", id, err)
+		}
+	}
+
+	// nothing is left to sweep until the next expiry passes
+	if n, err := b.deleteExpired(now); err != nil || n != 0 {
+		t.Errorf("second deleteExpired = %d, %v, want 0, nil", n, err)
+	}
+	if n, err := b.deleteExpired(now.Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("deleteExpired after an hour = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestBoltExpiryIndexIsFilledOnOpen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "pbin.db")
+	b, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := b.AddPaste(ctx, &Paste{Text: "old", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// drop the index as a database written before it existed has none
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(expiryBucket))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	b, err = openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if n, err := b.deleteExpired(time.Now()); err != nil || n != 1 {
+		t.Fatalf("deleteExpired = %d, %v, want 1, nil", n, err)
+	}
+	_, err = b.GetPaste(ctx, id)
+	checkSwept(t, err)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Deadlines for a single DataStore call and a single OpenAI request. A
+// request whose client went away is cancelled before they run out. Zero
+// disables a deadline.
+var (
+	storeReadTimeout  = time.Duration(envInt64("PBIN_STORE_READ_TIMEOUT_SECONDS", 5)) * time.Second
+	storeWriteTimeout = time.Duration(envInt64("PBIN_STORE_WRITE_TIMEOUT_SECONDS", 10)) * time.Second
+	openAITimeout     = time.Duration(envInt64("PBIN_OPENAI_TIMEOUT_SECONDS", 15)) * time.Second
+)
+
+// withTimeout derives a context that ends after d, or just ctx when d is
+// zero
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// timeoutStore bounds every call to the DataStore it wraps by the read or
+// write deadline. Scans and imports take as long as they take and pass
+// straight through.
+type timeoutStore struct {
+	migrationStore
+	read, write time.Duration
+}
+
+// newTimeoutStore wraps store with the configured deadlines
+func newTimeoutStore(store migrationStore) *timeoutStore {
+	return &timeoutStore{migrationStore: store, read: storeReadTimeout, write: storeWriteTimeout}
+}
+
+// contextError makes err match the error of ctx once it has ended, since
+// not every backend wraps it: the AWS SDK reports a cancelled request as
+// an awserr.Error of its own
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctx.Err(), err)
+}
+
+func (t *timeoutStore) GetPaste(ctx context.Context, id string) (*Paste, error) {
+	ctx, cancel := withTimeout(ctx, t.read)
+	defer cancel()
+	paste, err := t.migrationStore.GetPaste(ctx, id)
+	return paste, contextError(ctx, err)
+}
+
+// TakePaste counts as a write as it may burn the paste
+func (t *timeoutStore) TakePaste(ctx context.Context, id string) (*Paste, error) {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	paste, err := t.migrationStore.TakePaste(ctx, id)
+	return paste, contextError(ctx, err)
+}
+
+func (t *timeoutStore) AddPaste(ctx context.Context, paste *Paste) (string, error) {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	id, err := t.migrationStore.AddPaste(ctx, paste)
+	return id, contextError(ctx, err)
+}
+
+func (t *timeoutStore) UpdatePaste(ctx context.Context, paste *Paste) error {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	return contextError(ctx, t.migrationStore.UpdatePaste(ctx, paste))
+}
+
+func (t *timeoutStore) ListRevisions(ctx context.Context, id string) ([]*Paste, error) {
+	ctx, cancel := withTimeout(ctx, t.read)
+	defer cancel()
+	revisions, err := t.migrationStore.ListRevisions(ctx, id)
+	return revisions, contextError(ctx, err)
+}
+
+func (t *timeoutStore) GetRevision(ctx context.Context, id string, rev int) (*Paste, error) {
+	ctx, cancel := withTimeout(ctx, t.read)
+	defer cancel()
+	paste, err := t.migrationStore.GetRevision(ctx, id, rev)
+	return paste, contextError(ctx, err)
+}
+
+func (t *timeoutStore) DeletePaste(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	return contextError(ctx, t.migrationStore.DeletePaste(ctx, id))
+}
+
+func (t *timeoutStore) GetDiff(ctx context.Context, id string) (*Diff, error) {
+	ctx, cancel := withTimeout(ctx, t.read)
+	defer cancel()
+	diff, err := t.migrationStore.GetDiff(ctx, id)
+	return diff, contextError(ctx, err)
+}
+
+func (t *timeoutStore) AddDiff(ctx context.Context, diff *Diff) (string, error) {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	id, err := t.migrationStore.AddDiff(ctx, diff)
+	return id, contextError(ctx, err)
+}
+
+func (t *timeoutStore) AcquireBody(ctx context.Context, body *Body) (bool, error) {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	created, err := t.migrationStore.AcquireBody(ctx, body)
+	return created, contextError(ctx, err)
+}
+
+func (t *timeoutStore) GetBody(ctx context.Context, hash string) (*Body, error) {
+	ctx, cancel := withTimeout(ctx, t.read)
+	defer cancel()
+	body, err := t.migrationStore.GetBody(ctx, hash)
+	return body, contextError(ctx, err)
+}
+
+func (t *timeoutStore) ReleaseBody(ctx context.Context, hash string, expiresAt int64) error {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	return contextError(ctx, t.migrationStore.ReleaseBody(ctx, hash, expiresAt))
+}
+
+func (t *timeoutStore) DeleteDiff(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx, t.write)
+	defer cancel()
+	return contextError(ctx, t.migrationStore.DeleteDiff(ctx, id))
+}